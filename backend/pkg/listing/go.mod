@@ -0,0 +1,3 @@
+module bringee.com/listing
+
+go 1.22
@@ -0,0 +1,262 @@
+// Package listing implements the sorting, cursor pagination and filter
+// parameters shared by the list endpoints of the Bringee services.
+package listing
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxPageSize caps ?limit=. Larger limits are clamped, like the search
+// endpoints do.
+const MaxPageSize = 100
+
+// Query is the sort order and page position shared by all list endpoints:
+// ?sort=field|-field&limit=&cursor=. Without a limit the whole list is
+// returned, so callers that predate pagination keep working.
+type Query struct {
+	Sort   string
+	Desc   bool
+	Limit  int
+	Cursor *Cursor
+}
+
+// Cursor marks the last item of a page. It is handed out base64 encoded,
+// clients treat it as opaque and pass it back unchanged.
+type Cursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   string `json:"id"`
+}
+
+// SortKeys maps the sortable fields of a list to functions returning an
+// order preserving string key, see TimeKey and NumberKey.
+type SortKeys[T any] map[string]func(T) string
+
+// SortParam returns the sort order in the form of the ?sort= parameter.
+func (q Query) SortParam() string {
+	if q.Desc {
+		return "-" + q.Sort
+	}
+	return q.Sort
+}
+
+// ParseQuery reads sort, limit and cursor from the request parameters.
+func ParseQuery[T any](values url.Values, keys SortKeys[T], defaultSort string) (Query, error) {
+	var query Query
+
+	sortParam := values.Get("sort")
+	if sortParam == "" {
+		sortParam = defaultSort
+	}
+	query.Desc = strings.HasPrefix(sortParam, "-")
+	query.Sort = strings.TrimPrefix(sortParam, "-")
+	if _, ok := keys[query.Sort]; !ok {
+		fields := make([]string, 0, len(keys))
+		for field := range keys {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		return query, fmt.Errorf("sort must be one of %s, prefixed with - for descending order", strings.Join(fields, ", "))
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return query, fmt.Errorf("limit must be a positive number")
+		}
+		query.Limit = n
+		if query.Limit > MaxPageSize {
+			query.Limit = MaxPageSize
+		}
+	}
+
+	if encoded := values.Get("cursor"); encoded != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(encoded)
+		var cursor Cursor
+		if err == nil {
+			err = json.Unmarshal(raw, &cursor)
+		}
+		if err != nil || cursor.ID == "" {
+			return query, fmt.Errorf("invalid cursor")
+		}
+		if cursor.Sort != query.SortParam() {
+			return query, fmt.Errorf("cursor does not match sort order %s", query.SortParam())
+		}
+		query.Cursor = &cursor
+	}
+	return query, nil
+}
+
+// Paginate sorts items by the query's sort field, with the ID as tie
+// breaker, and returns the page after the cursor. Because the cursor holds
+// the sort key instead of an offset, inserts and deletes between requests
+// neither skip nor repeat items.
+func Paginate[T any](items []T, query Query, keys SortKeys[T], id func(T) string) ([]T, string) {
+	key := keys[query.Sort]
+	before := func(aKey, aID, bKey, bID string) bool {
+		if aKey != bKey {
+			return (aKey < bKey) != query.Desc
+		}
+		return aID != bID && (aID < bID) != query.Desc
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return before(key(items[i]), id(items[i]), key(items[j]), id(items[j]))
+	})
+
+	start := 0
+	if query.Cursor != nil {
+		start = sort.Search(len(items), func(i int) bool {
+			return before(query.Cursor.Key, query.Cursor.ID, key(items[i]), id(items[i]))
+		})
+	}
+	end := start + query.Limit
+	if query.Limit == 0 || end >= len(items) {
+		return items[start:], ""
+	}
+
+	last := items[end-1]
+	raw, _ := json.Marshal(Cursor{Sort: query.SortParam(), Key: key(last), ID: id(last)})
+	return items[start:end], base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// WritePage answers a list request with the page under name.
+func WritePage(w http.ResponseWriter, name string, page interface{}, total int, query Query, nextCursor string) {
+	response := map[string]interface{}{
+		name:    page,
+		"total": total,
+		"sort":  query.SortParam(),
+	}
+	if query.Limit > 0 {
+		response["limit"] = query.Limit
+	}
+	if nextCursor != "" {
+		response["next_cursor"] = nextCursor
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// TimeKey formats t with a fixed width, so keys compare like times.
+func TimeKey(t time.Time) string {
+	return t.UTC().Format("20060102T150405.000000000")
+}
+
+// NumberKey encodes v so that keys compare like numbers, including
+// negative ones.
+func NumberKey(v float64) string {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return fmt.Sprintf("%016x", bits)
+}
+
+// Filter collects the errors of the filter parameters of a list request,
+// so handlers can parse all of them before answering 400.
+type Filter struct {
+	Values url.Values
+	Err    error
+}
+
+// Set parses a comma separated list into an upper case set, nil if the
+// parameter is missing.
+func (f *Filter) Set(name string) map[string]bool {
+	value := f.Values.Get(name)
+	if value == "" {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[strings.ToUpper(item)] = true
+		}
+	}
+	return set
+}
+
+func (f *Filter) Number(name string) *float64 {
+	value := f.Values.Get(name)
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(n) {
+		f.fail(fmt.Errorf("%s must be a number", name))
+		return nil
+	}
+	return &n
+}
+
+// Time accepts RFC 3339 timestamps and plain dates.
+func (f *Filter) Time(name string) *time.Time {
+	value := f.Values.Get(name)
+	if value == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", value)
+	}
+	if err != nil {
+		f.fail(fmt.Errorf("%s must be an RFC 3339 timestamp or a date", name))
+		return nil
+	}
+	return &t
+}
+
+func (f *Filter) Boolean(name string) *bool {
+	value := f.Values.Get(name)
+	if value == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		f.fail(fmt.Errorf("%s must be true or false", name))
+		return nil
+	}
+	return &b
+}
+
+func (f *Filter) fail(err error) {
+	if f.Err == nil {
+		f.Err = err
+	}
+}
+
+func InSet(set map[string]bool, value string) bool {
+	return set == nil || set[strings.ToUpper(value)]
+}
+
+func InRange(v float64, min, max *float64) bool {
+	return (min == nil || v >= *min) && (max == nil || v <= *max)
+}
+
+func InTimeRange(t time.Time, after, before *time.Time) bool {
+	return (after == nil || !t.Before(*after)) && (before == nil || t.Before(*before))
+}
+
+// ContainsText matches the free-text search q case-insensitively against
+// any of fields.
+func ContainsText(q string, fields ...string) bool {
+	if q == "" {
+		return true
+	}
+	q = strings.ToLower(q)
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), q) {
+			return true
+		}
+	}
+	return false
+}
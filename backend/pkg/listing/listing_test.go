@@ -0,0 +1,145 @@
+package listing
+
+import (
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type item struct {
+	ID    string
+	Price float64
+}
+
+var itemKeys = SortKeys[item]{
+	"id":    func(i item) string { return i.ID },
+	"price": func(i item) string { return NumberKey(i.Price) },
+}
+
+func itemID(i item) string { return i.ID }
+
+func TestPaginate(t *testing.T) {
+	items := []item{
+		{ID: "c", Price: 10},
+		{ID: "a", Price: 2.5},
+		{ID: "e", Price: -3},
+		{ID: "b", Price: 10},
+		{ID: "d", Price: 100},
+	}
+
+	tests := []struct {
+		name  string
+		sort  string
+		limit int
+		pages [][]string
+	}{
+		{name: "no limit", sort: "price", pages: [][]string{{"e", "a", "b", "c", "d"}}},
+		{name: "ties broken by ID", sort: "price", limit: 2, pages: [][]string{{"e", "a"}, {"b", "c"}, {"d"}}},
+		{name: "descending", sort: "-price", limit: 2, pages: [][]string{{"d", "c"}, {"b", "a"}, {"e"}}},
+		{name: "exact last page", sort: "id", limit: 5, pages: [][]string{{"a", "b", "c", "d", "e"}}},
+		{name: "limit above total", sort: "id", limit: 10, pages: [][]string{{"a", "b", "c", "d", "e"}}},
+		{name: "page of one", sort: "-id", limit: 1, pages: [][]string{{"e"}, {"d"}, {"c"}, {"b"}, {"a"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := url.Values{"sort": {tt.sort}}
+			if tt.limit > 0 {
+				values.Set("limit", strconv.Itoa(tt.limit))
+			}
+
+			var pages [][]string
+			for {
+				query, err := ParseQuery(values, itemKeys, "id")
+				if err != nil {
+					t.Fatal(err)
+				}
+				page, next := Paginate(append([]item(nil), items...), query, itemKeys, itemID)
+				ids := []string{}
+				for _, i := range page {
+					ids = append(ids, i.ID)
+				}
+				pages = append(pages, ids)
+				if next == "" || len(pages) > len(items) {
+					break
+				}
+				values.Set("cursor", next)
+			}
+			if !reflect.DeepEqual(pages, tt.pages) {
+				t.Errorf("pages %v, want %v", pages, tt.pages)
+			}
+		})
+	}
+}
+
+// A cursor holds the sort key of the last item, so items removed or added
+// before it between two requests neither skip nor repeat items.
+func TestPaginateChangesBetweenPages(t *testing.T) {
+	query, _ := ParseQuery(url.Values{"sort": {"id"}, "limit": {"2"}}, itemKeys, "id")
+	first, next := Paginate([]item{{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "d"}}, query, itemKeys, itemID)
+	if len(first) != 2 || next == "" {
+		t.Fatalf("first page %v, cursor %q", first, next)
+	}
+
+	tests := []struct {
+		name  string
+		items []item
+		want  []string
+	}{
+		{name: "unchanged", items: []item{{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "d"}}, want: []string{"c", "d"}},
+		{name: "last item of the page deleted", items: []item{{ID: "a"}, {ID: "c"}, {ID: "d"}}, want: []string{"c", "d"}},
+		{name: "item inserted before the cursor", items: []item{{ID: "a"}, {ID: "aa"}, {ID: "b"}, {ID: "c"}, {ID: "d"}}, want: []string{"c", "d"}},
+		{name: "item inserted after the cursor", items: []item{{ID: "a"}, {ID: "b"}, {ID: "bb"}, {ID: "c"}, {ID: "d"}}, want: []string{"bb", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := ParseQuery(url.Values{"sort": {"id"}, "limit": {"2"}, "cursor": {next}}, itemKeys, "id")
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, _ := Paginate(tt.items, query, itemKeys, itemID)
+			ids := []string{}
+			for _, i := range page {
+				ids = append(ids, i.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("page %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  url.Values
+		want    Query
+		wantErr bool
+	}{
+		{name: "default sort", values: url.Values{}, want: Query{Sort: "id"}},
+		{name: "descending", values: url.Values{"sort": {"-price"}}, want: Query{Sort: "price", Desc: true}},
+		{name: "limit clamped", values: url.Values{"limit": {"1000"}}, want: Query{Sort: "id", Limit: MaxPageSize}},
+		{name: "unknown field", values: url.Values{"sort": {"weight"}}, wantErr: true},
+		{name: "zero limit", values: url.Values{"limit": {"0"}}, wantErr: true},
+		{name: "invalid limit", values: url.Values{"limit": {"ten"}}, wantErr: true},
+		{name: "invalid cursor", values: url.Values{"cursor": {"%%%"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := ParseQuery(tt.values, itemKeys, "id")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(query, tt.want) {
+				t.Errorf("query %+v, want %+v", query, tt.want)
+			}
+		})
+	}
+
+	// A cursor only continues the sort order it was issued for
+	_, next := Paginate([]item{{ID: "a"}, {ID: "b"}}, Query{Sort: "id", Limit: 1}, itemKeys, itemID)
+	if _, err := ParseQuery(url.Values{"sort": {"-id"}, "cursor": {next}}, itemKeys, "id"); err == nil {
+		t.Error("cursor accepted for a different sort order")
+	}
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PrecisionStreet means the provider located the street itself
+	PrecisionStreet = "STREET"
+	// PrecisionCity means the coordinates are the city centre, the
+	// gazetteer does not know individual streets
+	PrecisionCity = "CITY"
+	// PrecisionUnresolved means the geocoder did not find the address. It is
+	// kept as the customer wrote it, without coordinates.
+	PrecisionUnresolved = "UNRESOLVED"
+)
+
+// errAddressNotFound is returned by geocoders for well-formed addresses they
+// cannot locate. Callers keep such addresses as unresolved free text.
+var errAddressNotFound = errors.New("address not found")
+
+// Address is a validated, normalized postal address with coordinates.
+type Address struct {
+	Street    string  `json:"street,omitempty"`
+	Postcode  string  `json:"postcode,omitempty"`
+	City      string  `json:"city"`
+	Country   string  `json:"country"`
+	Lat       float64 `json:"lat"`
+	Lng       float64 `json:"lng"`
+	Precision string  `json:"precision"`
+	Formatted string  `json:"formatted"`
+}
+
+// Geocoder resolves free-text and structured addresses. The offline
+// gazetteer is used locally and in tests; production sets
+// GEOCODER_PROVIDER=nominatim.
+type Geocoder interface {
+	Name() string
+	// Geocode parses a free-text address such as
+	// "Musterstraße 123, 10115 Berlin".
+	Geocode(query string) (Address, error)
+	// Normalize validates a structured address and fills in coordinates.
+	Normalize(address Address) (Address, error)
+}
+
+var geocoder Geocoder = newGeocoder(os.Getenv("GEOCODER_PROVIDER"))
+
+func newGeocoder(name string) Geocoder {
+	switch strings.ToLower(name) {
+	case "", "gazetteer":
+		return newGazetteerGeocoder()
+	case "nominatim":
+		return newNominatimGeocoder(os.Getenv("NOMINATIM_URL"), os.Getenv("GEOCODER_USER_AGENT"))
+	default:
+		log.Printf("⚠️ Unknown geocoder %q, falling back to offline gazetteer", name)
+		return newGazetteerGeocoder()
+	}
+}
+
+// gazetteerPlace is a city the offline geocoder knows. PostcodePrefixes
+// are the leading digits of the city's postcodes, if the country has any.
+type gazetteerPlace struct {
+	City             string
+	Country          string
+	Lat              float64
+	Lng              float64
+	PostcodePrefixes []string
+	Aliases          []string
+}
+
+var gazetteerPlaces = []gazetteerPlace{
+	{City: "Berlin", Country: "DE", Lat: 52.5200, Lng: 13.4050, PostcodePrefixes: []string{"10", "12", "13", "140"}},
+	{City: "Hamburg", Country: "DE", Lat: 53.5511, Lng: 9.9937, PostcodePrefixes: []string{"20", "21", "22"}},
+	{City: "München", Country: "DE", Lat: 48.1351, Lng: 11.5820, PostcodePrefixes: []string{"80", "81"}, Aliases: []string{"Muenchen", "Munich"}},
+	{City: "Köln", Country: "DE", Lat: 50.9375, Lng: 6.9603, PostcodePrefixes: []string{"50", "51"}, Aliases: []string{"Koeln", "Cologne"}},
+	{City: "Frankfurt am Main", Country: "DE", Lat: 50.1109, Lng: 8.6821, PostcodePrefixes: []string{"60", "65"}, Aliases: []string{"Frankfurt", "Frankfurt/Main", "Frankfurt a.M."}},
+	{City: "Stuttgart", Country: "DE", Lat: 48.7758, Lng: 9.1829, PostcodePrefixes: []string{"70"}},
+	{City: "Düsseldorf", Country: "DE", Lat: 51.2277, Lng: 6.7735, PostcodePrefixes: []string{"40"}, Aliases: []string{"Duesseldorf"}},
+	{City: "Leipzig", Country: "DE", Lat: 51.3397, Lng: 12.3731, PostcodePrefixes: []string{"04"}},
+	{City: "Dresden", Country: "DE", Lat: 51.0504, Lng: 13.7373, PostcodePrefixes: []string{"01"}},
+	{City: "Hannover", Country: "DE", Lat: 52.3759, Lng: 9.7320, PostcodePrefixes: []string{"30"}, Aliases: []string{"Hanover"}},
+	{City: "Nürnberg", Country: "DE", Lat: 49.4521, Lng: 11.0767, PostcodePrefixes: []string{"90"}, Aliases: []string{"Nuernberg", "Nuremberg"}},
+	{City: "Bremen", Country: "DE", Lat: 53.0793, Lng: 8.8017, PostcodePrefixes: []string{"28"}},
+	{City: "Wien", Country: "AT", Lat: 48.2082, Lng: 16.3738, PostcodePrefixes: []string{"1"}, Aliases: []string{"Vienna"}},
+	{City: "Zürich", Country: "CH", Lat: 47.3769, Lng: 8.5417, PostcodePrefixes: []string{"80"}, Aliases: []string{"Zuerich", "Zurich"}},
+	{City: "Paris", Country: "FR", Lat: 48.8566, Lng: 2.3522, PostcodePrefixes: []string{"75"}},
+	{City: "Amsterdam", Country: "NL", Lat: 52.3676, Lng: 4.9041, PostcodePrefixes: []string{"10", "11"}},
+	{City: "Warszawa", Country: "PL", Lat: 52.2297, Lng: 21.0122, PostcodePrefixes: []string{"00", "01", "02", "03", "04"}, Aliases: []string{"Warschau", "Warsaw"}},
+	{City: "İstanbul", Country: "TR", Lat: 41.0082, Lng: 28.9784, PostcodePrefixes: []string{"34"}, Aliases: []string{"Istanbul"}},
+	{City: "London", Country: "GB", Lat: 51.5072, Lng: -0.1276},
+	{City: "New York", Country: "US", Lat: 40.7128, Lng: -74.0060, PostcodePrefixes: []string{"100", "101", "102"}, Aliases: []string{"New York City", "NYC"}},
+}
+
+// countryNames maps written country names to ISO 3166-1 alpha-2 codes.
+var countryNames = map[string]string{
+	"deutschland": "DE", "germany": "DE",
+	"österreich": "AT", "austria": "AT",
+	"schweiz": "CH", "switzerland": "CH",
+	"frankreich": "FR", "france": "FR",
+	"niederlande": "NL", "netherlands": "NL",
+	"polen": "PL", "poland": "PL",
+	"türkei": "TR", "turkey": "TR",
+	"großbritannien": "GB", "vereinigtes königreich": "GB", "united kingdom": "GB",
+	"usa": "US", "vereinigte staaten": "US", "united states": "US",
+}
+
+var postcodeFormats = map[string]*regexp.Regexp{
+	"DE": regexp.MustCompile(`^\d{5}$`),
+	"AT": regexp.MustCompile(`^\d{4}$`),
+	"CH": regexp.MustCompile(`^\d{4}$`),
+	"FR": regexp.MustCompile(`^\d{5}$`),
+	"NL": regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`),
+	"PL": regexp.MustCompile(`^\d{2}-\d{3}$`),
+	"TR": regexp.MustCompile(`^\d{5}$`),
+	"GB": regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`),
+	"US": regexp.MustCompile(`^\d{5}(-\d{4})?$`),
+}
+
+// isoCountryCode matches ISO 3166-1 alpha-2 codes.
+var isoCountryCode = regexp.MustCompile(`^[A-Z]{2}$`)
+
+// postcodeCity matches the "10115 Berlin" part of an address.
+var postcodeCity = regexp.MustCompile(`^(\d{2}-\d{3}|\d{4} ?[A-Z]{2}|\d{4,5}(?:-\d{4})?)\s+(.+)$`)
+
+// streetPostcodeCity splits "Musterstraße 123 10115 Berlin" before the last
+// postcode, for addresses written without commas.
+var streetPostcodeCity = regexp.MustCompile(`^(.+)\s+((?:\d{2}-\d{3}|\d{4} ?[A-Z]{2}|\d{4,5}(?:-\d{4})?)\s+\D.*)$`)
+
+// parseAddressQuery splits a free-text address into its parts without
+// checking them. Commas are optional: "Hauptstr. 1 München" is split after
+// the house number.
+func parseAddressQuery(query string) (Address, error) {
+	parts := []string{}
+	for _, part := range strings.Split(query, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return Address{}, fmt.Errorf("address is empty")
+	}
+
+	var address Address
+	if country, ok := parseCountry(parts[len(parts)-1]); ok && len(parts) > 1 {
+		address.Country = country
+		parts = parts[:len(parts)-1]
+	}
+	if len(parts) == 1 {
+		words := strings.Fields(parts[0])
+		if len(words) > 1 && address.Country == "" {
+			if country, ok := parseCountry(words[len(words)-1]); ok {
+				address.Country = country
+				words = words[:len(words)-1]
+			}
+		}
+		parts = splitStreet(strings.Join(words, " "))
+	}
+
+	locality := parts[len(parts)-1]
+	if match := postcodeCity.FindStringSubmatch(locality); match != nil {
+		address.Postcode = match[1]
+		address.City = match[2]
+	} else {
+		address.City = locality
+	}
+	address.Street = strings.Join(parts[:len(parts)-1], ", ")
+	return address, nil
+}
+
+// splitStreet separates street and locality of an address written without
+// commas, at the postcode or else after the last house number.
+func splitStreet(text string) []string {
+	if match := streetPostcodeCity.FindStringSubmatch(text); match != nil {
+		return []string{match[1], match[2]}
+	}
+	if postcodeCity.MatchString(text) {
+		return []string{text}
+	}
+	words := strings.Fields(text)
+	for i := len(words) - 2; i > 0; i-- {
+		if words[i][0] >= '0' && words[i][0] <= '9' {
+			return []string{strings.Join(words[:i+1], " "), strings.Join(words[i+1:], " ")}
+		}
+	}
+	return []string{text}
+}
+
+// gazetteerGeocoder resolves addresses against a fixed list of cities. It
+// needs no network access, which makes it suitable for local development
+// and tests.
+type gazetteerGeocoder struct {
+	places map[string]gazetteerPlace
+}
+
+func newGazetteerGeocoder() *gazetteerGeocoder {
+	g := &gazetteerGeocoder{places: make(map[string]gazetteerPlace)}
+	for _, place := range gazetteerPlaces {
+		for _, name := range append([]string{place.City}, place.Aliases...) {
+			g.places[strings.ToLower(name)] = place
+		}
+	}
+	return g
+}
+
+func (g *gazetteerGeocoder) Name() string {
+	return "gazetteer"
+}
+
+func (g *gazetteerGeocoder) Geocode(query string) (Address, error) {
+	address, err := parseAddressQuery(query)
+	if err != nil {
+		return Address{}, err
+	}
+	return g.Normalize(address)
+}
+
+func (g *gazetteerGeocoder) Normalize(address Address) (Address, error) {
+	address, err := cleanAddress(address)
+	if err != nil {
+		return Address{}, err
+	}
+
+	place, known := g.places[strings.ToLower(address.City)]
+	if !known {
+		return Address{}, fmt.Errorf("%w: unknown city %q", errAddressNotFound, address.City)
+	}
+	if address.Country != "" && address.Country != place.Country {
+		return Address{}, fmt.Errorf("%s is not in %s", place.City, address.Country)
+	}
+	if address.Postcode != "" {
+		if format, exists := postcodeFormats[place.Country]; exists && !format.MatchString(address.Postcode) {
+			return Address{}, fmt.Errorf("invalid postcode %q for %s", address.Postcode, place.Country)
+		}
+		if !hasPostcodePrefix(place, address.Postcode) {
+			return Address{}, fmt.Errorf("postcode %s does not belong to %s", address.Postcode, place.City)
+		}
+	}
+
+	address.City = place.City
+	address.Country = place.Country
+	if address.Lat == 0 && address.Lng == 0 {
+		address.Lat = place.Lat
+		address.Lng = place.Lng
+		address.Precision = PrecisionCity
+	}
+	address.Formatted = formatAddress(address)
+	return address, nil
+}
+
+// cleanAddress trims a structured address and checks what can be checked
+// without looking it up: a city is given and the country is known.
+func cleanAddress(address Address) (Address, error) {
+	address.Street = strings.TrimSpace(address.Street)
+	address.Postcode = strings.ToUpper(strings.TrimSpace(address.Postcode))
+	address.City = strings.TrimSpace(address.City)
+	if country, ok := parseCountry(address.Country); ok {
+		address.Country = country
+	} else if address.Country != "" {
+		return Address{}, fmt.Errorf("unknown country %q", address.Country)
+	}
+	if address.City == "" {
+		return Address{}, fmt.Errorf("city is required")
+	}
+	return address, nil
+}
+
+// nominatimGeocoder resolves addresses through the OpenStreetMap Nominatim
+// API. NOMINATIM_URL points it at a self-hosted instance; the public one
+// allows one request per second and requires an identifying User-Agent.
+type nominatimGeocoder struct {
+	baseURL   string
+	userAgent string
+	client    *http.Client
+}
+
+// nominatimPlace is the part of a Nominatim search result we use.
+type nominatimPlace struct {
+	Lat     string `json:"lat"`
+	Lon     string `json:"lon"`
+	Address struct {
+		HouseNumber  string `json:"house_number"`
+		Road         string `json:"road"`
+		Postcode     string `json:"postcode"`
+		City         string `json:"city"`
+		Town         string `json:"town"`
+		Village      string `json:"village"`
+		Municipality string `json:"municipality"`
+		CountryCode  string `json:"country_code"`
+	} `json:"address"`
+}
+
+func newNominatimGeocoder(baseURL, userAgent string) *nominatimGeocoder {
+	if baseURL == "" {
+		baseURL = "https://nominatim.openstreetmap.org"
+	}
+	if userAgent == "" {
+		userAgent = "bringee-shipment-service"
+	}
+	return &nominatimGeocoder{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		userAgent: userAgent,
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (g *nominatimGeocoder) Name() string {
+	return "nominatim"
+}
+
+func (g *nominatimGeocoder) Geocode(query string) (Address, error) {
+	if strings.TrimSpace(query) == "" {
+		return Address{}, fmt.Errorf("address is empty")
+	}
+	place, err := g.search(url.Values{"q": {query}})
+	if err != nil {
+		return Address{}, err
+	}
+	address := Address{Postcode: place.Address.Postcode}
+	if place.Address.Road != "" {
+		address.Street = strings.TrimSpace(place.Address.Road + " " + place.Address.HouseNumber)
+	}
+	return placeAddress(address, place)
+}
+
+func (g *nominatimGeocoder) Normalize(address Address) (Address, error) {
+	address, err := cleanAddress(address)
+	if err != nil {
+		return Address{}, err
+	}
+	if address.Postcode != "" && address.Country != "" {
+		if format, exists := postcodeFormats[address.Country]; exists && !format.MatchString(address.Postcode) {
+			return Address{}, fmt.Errorf("invalid postcode %q for %s", address.Postcode, address.Country)
+		}
+	}
+
+	params := url.Values{"city": {address.City}}
+	if address.Street != "" {
+		params.Set("street", address.Street)
+	}
+	if address.Postcode != "" {
+		params.Set("postalcode", address.Postcode)
+	}
+	if address.Country != "" {
+		params.Set("countrycodes", strings.ToLower(address.Country))
+	}
+	place, err := g.search(params)
+	if err != nil {
+		return Address{}, err
+	}
+	if address.Postcode == "" {
+		address.Postcode = place.Address.Postcode
+	}
+	return placeAddress(address, place)
+}
+
+// search returns the best match for the query or errAddressNotFound.
+func (g *nominatimGeocoder) search(params url.Values) (nominatimPlace, error) {
+	params.Set("format", "jsonv2")
+	params.Set("addressdetails", "1")
+	params.Set("limit", "1")
+	req, err := http.NewRequest("GET", g.baseURL+"/search?"+params.Encode(), nil)
+	if err != nil {
+		return nominatimPlace{}, err
+	}
+	req.Header.Set("User-Agent", g.userAgent)
+	req.Header.Set("Accept-Language", "de")
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nominatimPlace{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nominatimPlace{}, fmt.Errorf("nominatim returned %s", resp.Status)
+	}
+
+	var places []nominatimPlace
+	if err := json.NewDecoder(resp.Body).Decode(&places); err != nil {
+		return nominatimPlace{}, err
+	}
+	if len(places) == 0 {
+		return nominatimPlace{}, errAddressNotFound
+	}
+	return places[0], nil
+}
+
+// placeAddress completes the address with the city, country and
+// coordinates Nominatim found.
+func placeAddress(address Address, place nominatimPlace) (Address, error) {
+	lat, err := strconv.ParseFloat(place.Lat, 64)
+	if err != nil {
+		return Address{}, fmt.Errorf("nominatim returned invalid coordinates: %v", err)
+	}
+	lng, err := strconv.ParseFloat(place.Lon, 64)
+	if err != nil {
+		return Address{}, fmt.Errorf("nominatim returned invalid coordinates: %v", err)
+	}
+
+	for _, city := range []string{place.Address.City, place.Address.Town, place.Address.Village, place.Address.Municipality} {
+		if city != "" {
+			address.City = city
+			break
+		}
+	}
+	if address.City == "" {
+		return Address{}, errAddressNotFound
+	}
+	address.Country = strings.ToUpper(place.Address.CountryCode)
+	address.Lat = lat
+	address.Lng = lng
+	address.Precision = PrecisionCity
+	if place.Address.Road != "" {
+		address.Precision = PrecisionStreet
+	}
+	address.Formatted = formatAddress(address)
+	return address, nil
+}
+
+// unresolvedAddress keeps an address the geocoder could not find the way the
+// customer wrote it. It has no coordinates, so distance-based features skip
+// it.
+func unresolvedAddress(structured *Address, freeText string) (Address, error) {
+	var (
+		address Address
+		err     error
+	)
+	if structured != nil {
+		address, err = cleanAddress(*structured)
+	} else {
+		address, err = parseAddressQuery(freeText)
+	}
+	if err != nil {
+		return Address{}, err
+	}
+	address.Lat, address.Lng = 0, 0
+	address.Precision = PrecisionUnresolved
+	address.Formatted = strings.TrimSpace(freeText)
+	if address.Formatted == "" {
+		address.Formatted = formatAddress(address)
+	}
+	return address, nil
+}
+
+// hasCoordinates reports whether the address was located.
+func (a *Address) hasCoordinates() bool {
+	return a != nil && a.Precision != PrecisionUnresolved
+}
+
+func hasPostcodePrefix(place gazetteerPlace, postcode string) bool {
+	if len(place.PostcodePrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range place.PostcodePrefixes {
+		if strings.HasPrefix(postcode, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCountry accepts ISO codes and German or English country names.
+func parseCountry(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if code, exists := countryNames[strings.ToLower(value)]; exists {
+		return code, true
+	}
+	code := strings.ToUpper(value)
+	if _, exists := postcodeFormats[code]; exists {
+		return code, true
+	}
+	return "", false
+}
+
+// formatAddress writes the address in German postal order.
+func formatAddress(address Address) string {
+	locality := strings.TrimSpace(address.Postcode + " " + address.City)
+	parts := []string{}
+	if address.Street != "" {
+		parts = append(parts, address.Street)
+	}
+	return strings.Join(append(parts, locality, address.Country), ", ")
+}
+
+// resolveAddress normalizes the structured address if one was sent and
+// geocodes the free text otherwise. Addresses the geocoder does not find
+// are kept unresolved rather than rejected.
+func resolveAddress(structured *Address, freeText string) (*Address, error) {
+	var (
+		address Address
+		err     error
+	)
+	if structured != nil {
+		address, err = geocoder.Normalize(*structured)
+	} else {
+		address, err = geocoder.Geocode(freeText)
+	}
+	if errors.Is(err, errAddressNotFound) {
+		address, err = unresolvedAddress(structured, freeText)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+// resolveShipmentAddresses validates and normalizes pickup and drop-off of
+// a new shipment. The free-text fields are rewritten from the normalized
+// addresses, so route comparisons see one spelling per city.
+func resolveShipmentAddresses(req *CreateShipmentRequest) error {
+	origin, err := resolveAddress(req.Origin, req.FromLocation)
+	if err != nil {
+		return fmt.Errorf("invalid pickup address: %v", err)
+	}
+	// The recipient's address is the most precise drop-off we have
+	destinationText := req.RecipientAddress
+	if strings.TrimSpace(destinationText) == "" {
+		destinationText = req.ToLocation
+	}
+	destination, err := resolveAddress(req.Destination, destinationText)
+	if err != nil {
+		return fmt.Errorf("invalid drop-off address: %v", err)
+	}
+
+	for _, check := range []struct {
+		declared *string
+		address  *Address
+		label    string
+	}{
+		{&req.OriginCountry, origin, "origin_country"},
+		{&req.DestinationCountry, destination, "destination_country"},
+	} {
+		declared := strings.ToUpper(strings.TrimSpace(*check.declared))
+		// An unresolved address may not name its country
+		if check.address.Country == "" {
+			country, ok := parseCountry(declared)
+			// The geocoder knows few countries, the customer may name any
+			if !ok && isoCountryCode.MatchString(declared) {
+				country, ok = declared, true
+			}
+			if !ok {
+				return fmt.Errorf("%s is required when the address cannot be located", check.label)
+			}
+			check.address.Country = country
+			declared = country
+		}
+		if declared != "" && declared != check.address.Country {
+			return fmt.Errorf("%s %s does not match the address in %s", check.label, declared, check.address.Country)
+		}
+		*check.declared = check.address.Country
+	}
+
+	req.Origin = origin
+	req.Destination = destination
+	req.FromLocation = origin.City
+	req.ToLocation = destination.City
+	if destination.Street != "" {
+		req.RecipientAddress = destination.Formatted
+	}
+	return nil
+}
+
+// geocodeHandler lets clients validate an address before creating a
+// shipment. It takes either {"query": "..."} or a structured address.
+func geocodeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Query string `json:"query"`
+		Address
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	var structured *Address
+	if req.Query == "" {
+		structured = &req.Address
+	}
+	address, err := resolveAddress(structured, req.Query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(address)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Broker is the message broker the outbox relay publishes to. Production
+// uses Google Cloud Pub/Sub (spec 4.3).
+type Broker interface {
+	Name() string
+	Publish(topic string, event DomainEvent) error
+}
+
+var eventBroker Broker = newBroker(os.Getenv("EVENT_BROKER"))
+
+func newBroker(name string) Broker {
+	if name == "" && os.Getenv("PUBSUB_EMULATOR_HOST") != "" {
+		name = "pubsub"
+	}
+	switch strings.ToLower(name) {
+	case "", "memory":
+		return newInMemoryBroker()
+	case "pubsub":
+		return newPubSubBroker(os.Getenv("PUBSUB_PROJECT_ID"), os.Getenv("PUBSUB_EMULATOR_HOST"))
+	default:
+		log.Printf("⚠️ Unknown event broker %q, falling back to in-memory broker", name)
+		return newInMemoryBroker()
+	}
+}
+
+// inMemoryBroker keeps published events and hands them to in-process
+// subscribers. It is meant for local development and tests.
+type inMemoryBroker struct {
+	mu          sync.Mutex
+	published   map[string][]DomainEvent
+	subscribers map[string][]func(DomainEvent) error
+}
+
+func newInMemoryBroker() *inMemoryBroker {
+	return &inMemoryBroker{
+		published:   make(map[string][]DomainEvent),
+		subscribers: make(map[string][]func(DomainEvent) error),
+	}
+}
+
+func (b *inMemoryBroker) Name() string {
+	return "memory"
+}
+
+// Publish fails if a subscriber fails, so the relay retries the event like
+// an unacknowledged Pub/Sub message.
+func (b *inMemoryBroker) Publish(topic string, event DomainEvent) error {
+	b.mu.Lock()
+	b.published[topic] = append(b.published[topic], event)
+	subscribers := b.subscribers[topic]
+	b.mu.Unlock()
+
+	for _, handle := range subscribers {
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *inMemoryBroker) Subscribe(topic string, handle func(DomainEvent) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[topic] = append(b.subscribers[topic], handle)
+}
+
+// pubSubBroker publishes through the Pub/Sub REST API. With
+// PUBSUB_EMULATOR_HOST set it talks to the local emulator without
+// credentials and creates missing topics; on Cloud Run it authenticates
+// with the service account token of the metadata server.
+type pubSubBroker struct {
+	baseURL  string
+	project  string
+	emulator bool
+	client   *http.Client
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+	topics      map[string]bool
+}
+
+func newPubSubBroker(project, emulatorHost string) *pubSubBroker {
+	if project == "" {
+		project = "bringee-local"
+	}
+	broker := &pubSubBroker{
+		baseURL: "https://pubsub.googleapis.com",
+		project: project,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		topics:  make(map[string]bool),
+	}
+	if emulatorHost != "" {
+		broker.baseURL = "http://" + strings.TrimPrefix(emulatorHost, "http://")
+		broker.emulator = true
+	}
+	return broker
+}
+
+func (b *pubSubBroker) Name() string {
+	if b.emulator {
+		return "pubsub-emulator"
+	}
+	return "pubsub"
+}
+
+type pubSubMessage struct {
+	Data       string            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+func (b *pubSubBroker) Publish(topic string, event DomainEvent) error {
+	if err := b.ensureTopic(topic); err != nil {
+		return err
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string][]pubSubMessage{
+		"messages": {{
+			Data: base64.StdEncoding.EncodeToString(data),
+			Attributes: map[string]string{
+				"event_id":     event.ID,
+				"event_type":   event.Type,
+				"aggregate_id": event.AggregateID,
+			},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := b.do("POST", b.topicPath(topic)+":publish", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pubsub publish returned %s", resp.Status)
+	}
+	return nil
+}
+
+// ensureTopic creates the topic on the emulator. Production topics are
+// managed by Terraform.
+func (b *pubSubBroker) ensureTopic(topic string) error {
+	b.mu.Lock()
+	known := b.topics[topic]
+	b.mu.Unlock()
+	if known || !b.emulator {
+		return nil
+	}
+
+	resp, err := b.do("PUT", b.topicPath(topic), []byte("{}"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		return fmt.Errorf("creating pubsub topic %s returned %s", topic, resp.Status)
+	}
+
+	b.mu.Lock()
+	b.topics[topic] = true
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *pubSubBroker) topicPath(topic string) string {
+	return b.baseURL + "/v1/projects/" + b.project + "/topics/" + topic
+}
+
+func (b *pubSubBroker) do(method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if !b.emulator {
+		token, err := b.accessToken()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return b.client.Do(req)
+}
+
+// accessToken fetches and caches the service account token from the
+// metadata server.
+func (b *pubSubBroker) accessToken() (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.token != "" && time.Now().Before(b.tokenExpiry) {
+		return b.token, nil
+	}
+
+	req, err := http.NewRequest("GET", "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	b.token = token.AccessToken
+	// Refresh a minute early so a request never carries an expired token
+	b.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return b.token, nil
+}
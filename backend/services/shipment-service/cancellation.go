@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	PenaltyRankingDemotion = "RANKING_DEMOTION"
+	PenaltyProStatusLoss   = "PRO_STATUS_LOSS"
+)
+
+// CancellationPolicy implements the tiered cancellation rules of spec
+// 6.5.2. Tiers are matched by the hours left until the planned handover,
+// the first tier whose MinHoursBefore is reached applies.
+type CancellationPolicy struct {
+	SenderTiers          []SenderCancellationTier   `json:"sender_tiers"`
+	TravelerTiers        []TravelerCancellationTier `json:"traveler_tiers"`
+	TravelerSharePercent float64                    `json:"traveler_share_percent"`
+}
+
+type SenderCancellationTier struct {
+	Label          string  `json:"label"`
+	MinHoursBefore float64 `json:"min_hours_before"`
+	FeePercent     float64 `json:"fee_percent"`
+	MinFeeUSD      float64 `json:"min_fee_usd"`
+}
+
+type TravelerCancellationTier struct {
+	Label          string   `json:"label"`
+	MinHoursBefore float64  `json:"min_hours_before"`
+	Penalties      []string `json:"penalties"`
+	DemotionDays   int      `json:"demotion_days,omitempty"`
+}
+
+// CancellationQuote shows the consequences of a cancellation before the
+// user confirms it.
+type CancellationQuote struct {
+	ShipmentID              string     `json:"shipment_id"`
+	Role                    string     `json:"role"`
+	PlannedHandoverAt       *time.Time `json:"planned_handover_at,omitempty"`
+	HoursBeforeHandover     *float64   `json:"hours_before_handover,omitempty"`
+	Tier                    string     `json:"tier"`
+	FeeUSD                  float64    `json:"fee_usd"`
+	RefundUSD               float64    `json:"refund_usd"`
+	TravelerCompensationUSD float64    `json:"traveler_compensation_usd"`
+	Penalties               []string   `json:"penalties"`
+	DemotionDays            int        `json:"demotion_days,omitempty"`
+	QuotedAt                time.Time  `json:"quoted_at"`
+}
+
+// Cancellation is the record of a confirmed cancellation.
+type Cancellation struct {
+	CancellationQuote
+	UserID      string    `json:"user_id"`
+	Reason      string    `json:"reason"`
+	CancelledAt time.Time `json:"cancelled_at"`
+}
+
+type CancelShipmentRequest struct {
+	UserID string `json:"user_id"`
+	Reason string `json:"reason"`
+	// AcceptedFeeUSD must match the quoted fee, so a tier change between
+	// quote and confirmation never charges more than the user saw.
+	AcceptedFeeUSD float64 `json:"accepted_fee_usd"`
+}
+
+var cancellationPolicy = loadCancellationPolicy(os.Getenv("CANCELLATION_POLICY_FILE"))
+
+var cancellations = make(map[string][]Cancellation)
+
+func loadCancellationPolicy(path string) CancellationPolicy {
+	policy := defaultCancellationPolicy()
+	if path == "" {
+		return policy
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var filePolicy CancellationPolicy
+		if err = json.Unmarshal(data, &filePolicy); err == nil {
+			policy = filePolicy
+		}
+	}
+	if err != nil {
+		log.Printf("⚠️ Could not load cancellation policy from %s, using defaults: %v", path, err)
+	}
+
+	sort.Slice(policy.SenderTiers, func(i, j int) bool {
+		return policy.SenderTiers[i].MinHoursBefore > policy.SenderTiers[j].MinHoursBefore
+	})
+	sort.Slice(policy.TravelerTiers, func(i, j int) bool {
+		return policy.TravelerTiers[i].MinHoursBefore > policy.TravelerTiers[j].MinHoursBefore
+	})
+	return policy
+}
+
+func defaultCancellationPolicy() CancellationPolicy {
+	return CancellationPolicy{
+		SenderTiers: []SenderCancellationTier{
+			{Label: ">48h", MinHoursBefore: 48, FeePercent: 0},
+			{Label: "24-48h", MinHoursBefore: 24, FeePercent: 25, MinFeeUSD: 2},
+			{Label: "<24h", MinHoursBefore: 0, FeePercent: 50, MinFeeUSD: 5},
+		},
+		TravelerTiers: []TravelerCancellationTier{
+			{Label: ">48h", MinHoursBefore: 48, Penalties: []string{}},
+			{Label: "24-48h", MinHoursBefore: 24, Penalties: []string{PenaltyRankingDemotion}, DemotionDays: 7},
+			{Label: "<24h", MinHoursBefore: 0, Penalties: []string{PenaltyRankingDemotion, PenaltyProStatusLoss}, DemotionDays: 30},
+		},
+		TravelerSharePercent: 80,
+	}
+}
+
+// shipmentCancellationHandler quotes (GET ?user_id=) and confirms (POST) the
+// cancellation of a shipment by its sender or traveler.
+func shipmentCancellationHandler(w http.ResponseWriter, r *http.Request) {
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		quote, err := quoteCancellation(shipment, r.URL.Query().Get("user_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"quote":         quote,
+			"cancellations": cancellationHistory(shipmentID),
+		})
+
+	case "POST":
+		var req CancelShipmentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		quote, err := quoteCancellation(shipment, req.UserID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if roundCents(req.AcceptedFeeUSD) != quote.FeeUSD {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": "Cancellation fee changed, please confirm the new quote",
+				"quote": quote,
+			})
+			return
+		}
+
+		now := time.Now()
+		event := ShipmentEventData{CancelledBy: req.UserID, CancelledByRole: quote.Role, Reason: req.Reason}
+		if quote.Role == roleTraveler {
+			event.TravelerID = req.UserID
+			event.Reopened = true
+			reopenShipment(&shipment)
+			voidPayment(shipmentID, "TRAVELER_CANCELLATION")
+			// Cancelling early enough is no violation, only tiers with
+			// penalties go on the traveler's record
+			if len(quote.Penalties) > 0 {
+				if err := userService.RecordIncident(req.UserID, UserIncident{
+					Type:         "TRAVELER_CANCELLATION",
+					ShipmentID:   shipmentID,
+					Notes:        req.Reason,
+					ReportedBy:   disputeActorPlatform,
+					Penalties:    quote.Penalties,
+					DemotionDays: quote.DemotionDays,
+				}); err != nil {
+					log.Printf("recording cancellation penalties for traveler %s failed: %v", req.UserID, err)
+				}
+			}
+		} else {
+			shipment.Status = "CANCELLED"
+			shipment.CancelledAt = &now
+			shipment.CancellationReason = "SENDER_CANCELLATION"
+			cancelInsurance(&shipment)
+			cancelPayment(shipmentID, quote.FeeUSD, quote.TravelerCompensationUSD, "SENDER_CANCELLATION")
+		}
+		saveShipmentWithEvent(shipment, EventShipmentCancelled, event)
+		delete(handovers, shipmentID)
+
+		cancellation := Cancellation{
+			CancellationQuote: quote,
+			UserID:            req.UserID,
+			Reason:            req.Reason,
+			CancelledAt:       now,
+		}
+		cancellations[shipmentID] = append(cancellations[shipmentID], cancellation)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"shipment":     shipment,
+			"cancellation": cancellation,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// quoteCancellation applies the policy to a cancellation by userID now.
+// Before a traveler accepted the shipment, the sender cancels for free.
+func quoteCancellation(shipment Shipment, userID string) (CancellationQuote, error) {
+	role := shipmentRole(shipment, userID)
+	if role == "" {
+		return CancellationQuote{}, fmt.Errorf("only sender or traveler can cancel a shipment")
+	}
+	switch shipment.Status {
+	case "POSTED":
+		if role != roleSender {
+			return CancellationQuote{}, fmt.Errorf("only the sender can cancel a posted shipment")
+		}
+	case "ACCEPTED":
+	default:
+		return CancellationQuote{}, fmt.Errorf("shipments in status %s cannot be cancelled", shipment.Status)
+	}
+
+	quote := CancellationQuote{
+		ShipmentID: shipment.ID,
+		Role:       role,
+		Tier:       "FREE",
+		Penalties:  []string{},
+		QuotedAt:   time.Now(),
+	}
+	payment := payments[shipment.ID]
+	if payment != nil && payment.Status == PaymentHeld {
+		quote.RefundUSD = payment.AmountUSD
+	}
+	if shipment.Status == "POSTED" {
+		return quote, nil
+	}
+
+	hours := math.Inf(1)
+	if handoverAt := plannedHandover(shipment); handoverAt != nil {
+		quote.PlannedHandoverAt = handoverAt
+		hours = math.Round(time.Until(*handoverAt).Hours()*10) / 10
+		quote.HoursBeforeHandover = &hours
+	}
+
+	if role == roleTraveler {
+		for _, tier := range cancellationPolicy.TravelerTiers {
+			if hours >= tier.MinHoursBefore || tier.MinHoursBefore <= 0 {
+				quote.Tier = tier.Label
+				quote.Penalties = append(quote.Penalties, tier.Penalties...)
+				quote.DemotionDays = tier.DemotionDays
+				break
+			}
+		}
+		return quote, nil
+	}
+
+	for _, tier := range cancellationPolicy.SenderTiers {
+		if hours >= tier.MinHoursBefore || tier.MinHoursBefore <= 0 {
+			quote.Tier = tier.Label
+			if tier.FeePercent > 0 || tier.MinFeeUSD > 0 {
+				fee := math.Max(shipment.AgreedFeeUSD*tier.FeePercent/100, tier.MinFeeUSD)
+				quote.FeeUSD = roundCents(math.Min(fee, shipment.AgreedFeeUSD))
+			}
+			break
+		}
+	}
+	quote.TravelerCompensationUSD = roundCents(quote.FeeUSD * cancellationPolicy.TravelerSharePercent / 100)
+	quote.RefundUSD = roundCents(math.Max(0, quote.RefundUSD-quote.FeeUSD))
+	return quote, nil
+}
+
+// plannedHandover is the agreed handover time, falling back to the
+// estimated delivery date for shipments accepted without one.
+func plannedHandover(shipment Shipment) *time.Time {
+	if shipment.PlannedHandoverAt != nil {
+		return shipment.PlannedHandoverAt
+	}
+	if !shipment.EstimatedDeliveryDate.IsZero() {
+		estimated := shipment.EstimatedDeliveryDate
+		return &estimated
+	}
+	return nil
+}
+
+// reopenShipment posts a shipment again after its traveler cancelled, so
+// another traveler can take it over.
+func reopenShipment(shipment *Shipment) {
+	shipment.Status = "POSTED"
+	shipment.TravelerID = nil
+	shipment.AcceptedAt = nil
+	shipment.AgreedFeeUSD = 0
+	shipment.BringeeCommissionUSD = 0
+	shipment.PlannedHandoverAt = nil
+	shipment.TripID = ""
+	if shipment.Insurance != nil {
+		shipment.Insurance.Status = CoverageQuoted
+		shipment.Insurance.PolicyNumber = ""
+		shipment.Insurance.IssuedAt = nil
+	}
+}
+
+func cancellationHistory(shipmentID string) []Cancellation {
+	history := cancellations[shipmentID]
+	if history == nil {
+		history = []Cancellation{}
+	}
+	return history
+}
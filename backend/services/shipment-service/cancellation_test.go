@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQuoteCancellation(t *testing.T) {
+	cancellationPolicy = loadCancellationPolicy("")
+	traveler := "traveler-1"
+	in := func(hours float64) *time.Time {
+		at := time.Now().Add(time.Duration(hours * float64(time.Hour)))
+		return &at
+	}
+
+	tests := []struct {
+		name         string
+		status       string
+		userID       string
+		handoverAt   *time.Time
+		wantErr      bool
+		tier         string
+		feeUSD       float64
+		refundUSD    float64
+		compensation float64
+		penalties    []string
+		demotionDays int
+	}{
+		{name: "posted by sender", status: "POSTED", userID: "sender-1", tier: "FREE", refundUSD: 25, penalties: []string{}},
+		{name: "posted by traveler", status: "POSTED", userID: traveler, wantErr: true},
+		{name: "stranger", status: "ACCEPTED", userID: "someone-else", wantErr: true},
+		{name: "after handover", status: "HANDED_OVER", userID: "sender-1", wantErr: true},
+		{name: "sender early", status: "ACCEPTED", userID: "sender-1", handoverAt: in(72), tier: ">48h", refundUSD: 25, penalties: []string{}},
+		{name: "sender without planned handover", status: "ACCEPTED", userID: "sender-1", tier: ">48h", refundUSD: 25, penalties: []string{}},
+		// 25% of 20 USD
+		{name: "sender a day ahead", status: "ACCEPTED", userID: "sender-1", handoverAt: in(30), tier: "24-48h", feeUSD: 5, refundUSD: 20, compensation: 4, penalties: []string{}},
+		// 50% of 20 USD
+		{name: "sender late", status: "ACCEPTED", userID: "sender-1", handoverAt: in(10), tier: "<24h", feeUSD: 10, refundUSD: 15, compensation: 8, penalties: []string{}},
+		{name: "sender after planned handover", status: "ACCEPTED", userID: "sender-1", handoverAt: in(-2), tier: "<24h", feeUSD: 10, refundUSD: 15, compensation: 8, penalties: []string{}},
+		{name: "traveler early", status: "ACCEPTED", userID: traveler, handoverAt: in(72), tier: ">48h", refundUSD: 25, penalties: []string{}},
+		{name: "traveler a day ahead", status: "ACCEPTED", userID: traveler, handoverAt: in(30), tier: "24-48h", refundUSD: 25, penalties: []string{PenaltyRankingDemotion}, demotionDays: 7},
+		{name: "traveler late", status: "ACCEPTED", userID: traveler, handoverAt: in(10), tier: "<24h", refundUSD: 25, penalties: []string{PenaltyRankingDemotion, PenaltyProStatusLoss}, demotionDays: 30},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shipment := Shipment{
+				ID:                "cancel-test",
+				SenderID:          "sender-1",
+				TravelerID:        &traveler,
+				Status:            tt.status,
+				AgreedFeeUSD:      20,
+				PlannedHandoverAt: tt.handoverAt,
+			}
+			payments[shipment.ID] = &EscrowPayment{ShipmentID: shipment.ID, AmountUSD: 25, TravelerPayoutUSD: 18, CommissionUSD: 2, Status: PaymentHeld}
+			defer delete(payments, shipment.ID)
+
+			quote, err := quoteCancellation(shipment, tt.userID)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("quote %+v, want an error", quote)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if quote.Tier != tt.tier || quote.FeeUSD != tt.feeUSD || quote.RefundUSD != tt.refundUSD || quote.TravelerCompensationUSD != tt.compensation {
+				t.Errorf("tier %s, fee %.2f, refund %.2f, compensation %.2f, want %s, %.2f, %.2f, %.2f",
+					quote.Tier, quote.FeeUSD, quote.RefundUSD, quote.TravelerCompensationUSD,
+					tt.tier, tt.feeUSD, tt.refundUSD, tt.compensation)
+			}
+			if !reflect.DeepEqual(quote.Penalties, tt.penalties) || quote.DemotionDays != tt.demotionDays {
+				t.Errorf("penalties %v for %d days, want %v for %d days", quote.Penalties, quote.DemotionDays, tt.penalties, tt.demotionDays)
+			}
+		})
+	}
+}
+
+func TestQuoteCancellationMinimumFee(t *testing.T) {
+	cancellationPolicy = loadCancellationPolicy("")
+	traveler := "traveler-1"
+	handoverAt := time.Now().Add(10 * time.Hour)
+
+	tests := []struct {
+		name         string
+		agreedFeeUSD float64
+		feeUSD       float64
+	}{
+		// 50% would be 3 USD, below the 5 USD minimum
+		{name: "minimum fee applies", agreedFeeUSD: 6, feeUSD: 5},
+		// The fee never exceeds the agreed fee
+		{name: "capped at the agreed fee", agreedFeeUSD: 4, feeUSD: 4},
+		{name: "percentage above the minimum", agreedFeeUSD: 30, feeUSD: 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shipment := Shipment{ID: "cancel-test", SenderID: "sender-1", TravelerID: &traveler, Status: "ACCEPTED", AgreedFeeUSD: tt.agreedFeeUSD, PlannedHandoverAt: &handoverAt}
+			quote, err := quoteCancellation(shipment, "sender-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if quote.FeeUSD != tt.feeUSD {
+				t.Errorf("fee %.2f, want %.2f", quote.FeeUSD, tt.feeUSD)
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ClaimPartialDamage   = "PARTIAL_DAMAGE"
+	ClaimPartialDelivery = "PARTIAL_DELIVERY"
+
+	ClaimSubmitted         = "SUBMITTED"
+	ClaimApproved          = "APPROVED"
+	ClaimPartiallyApproved = "PARTIALLY_APPROVED"
+	ClaimRejected          = "REJECTED"
+
+	maxClaimItems = 20
+)
+
+// Claim reports partial damage or a partially delivered shipment. Unlike a
+// dispute it does not question the whole transaction: an admin awards a
+// refund per item and the traveler keeps the rest of the payout.
+type Claim struct {
+	ID              string         `json:"id"`
+	ShipmentID      string         `json:"shipment_id"`
+	SenderID        string         `json:"sender_id"`
+	Type            string         `json:"type"`
+	Items           []ClaimItem    `json:"items"`
+	TotalClaimedUSD float64        `json:"total_claimed_usd"`
+	Status          string         `json:"status"`
+	Decision        *ClaimDecision `json:"decision,omitempty"`
+	CreatedAt       time.Time      `json:"created_at"`
+}
+
+type ClaimItem struct {
+	Description string       `json:"description"`
+	ClaimedUSD  float64      `json:"claimed_usd"`
+	AwardedUSD  float64      `json:"awarded_usd"`
+	Photos      []ClaimPhoto `json:"photos"`
+}
+
+type ClaimPhoto struct {
+	ID          string    `json:"id"`
+	BlobKey     string    `json:"blob_key"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+type ClaimDecision struct {
+	AwardedUSD float64   `json:"awarded_usd"`
+	PayoutUSD  float64   `json:"payout_usd"`
+	DecidedBy  string    `json:"decided_by"`
+	Notes      string    `json:"notes,omitempty"`
+	DecidedAt  time.Time `json:"decided_at"`
+}
+
+type CreateClaimRequest struct {
+	UserID string `json:"user_id"`
+	Type   string `json:"type"`
+	Items  []struct {
+		Description string  `json:"description"`
+		ClaimedUSD  float64 `json:"claimed_usd"`
+	} `json:"items"`
+}
+
+// ClaimDecisionRequest awards a refund per item, in the order of the
+// claim's items. An empty list rejects the claim.
+type ClaimDecisionRequest struct {
+	AdminID    string    `json:"admin_id"`
+	ItemAwards []float64 `json:"item_awards"`
+	Notes      string    `json:"notes"`
+}
+
+var claims = make(map[string]*Claim)
+
+// shipmentClaimsHandler submits (POST) and lists (GET) the claims of a
+// shipment.
+func shipmentClaimsHandler(w http.ResponseWriter, r *http.Request) {
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if !requirePartyOrAdmin(w, r, shipment) {
+			return
+		}
+		shipmentClaims := []*Claim{}
+		for _, claim := range claims {
+			if claim.ShipmentID == shipmentID {
+				shipmentClaims = append(shipmentClaims, claim)
+			}
+		}
+		sort.Slice(shipmentClaims, func(i, j int) bool {
+			return shipmentClaims[i].CreatedAt.Before(shipmentClaims[j].CreatedAt)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"claims": shipmentClaims,
+			"total":  len(shipmentClaims),
+		})
+
+	case "POST":
+		var req CreateClaimRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if shipmentRole(shipment, req.UserID) != roleSender {
+			http.Error(w, "Only the sender can submit a claim", http.StatusForbidden)
+			return
+		}
+		claimType := strings.ToUpper(req.Type)
+		if claimType != ClaimPartialDamage && claimType != ClaimPartialDelivery {
+			http.Error(w, "Type must be PARTIAL_DAMAGE or PARTIAL_DELIVERY", http.StatusBadRequest)
+			return
+		}
+		if len(req.Items) == 0 || len(req.Items) > maxClaimItems {
+			http.Error(w, fmt.Sprintf("A claim needs between 1 and %d items", maxClaimItems), http.StatusBadRequest)
+			return
+		}
+		if err := claimAllowed(shipment); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		claim := &Claim{
+			ID:         "claim-" + strconv.FormatInt(time.Now().UnixNano(), 10),
+			ShipmentID: shipmentID,
+			SenderID:   req.UserID,
+			Type:       claimType,
+			Items:      []ClaimItem{},
+			Status:     ClaimSubmitted,
+			CreatedAt:  time.Now(),
+		}
+		for _, item := range req.Items {
+			if strings.TrimSpace(item.Description) == "" || item.ClaimedUSD <= 0 {
+				http.Error(w, "Every item needs a description and a positive claimed amount", http.StatusBadRequest)
+				return
+			}
+			claim.Items = append(claim.Items, ClaimItem{
+				Description: item.Description,
+				ClaimedUSD:  roundCents(item.ClaimedUSD),
+				Photos:      []ClaimPhoto{},
+			})
+			claim.TotalClaimedUSD = roundCents(claim.TotalClaimedUSD + item.ClaimedUSD)
+		}
+		if payment := payments[shipmentID]; claim.TotalClaimedUSD > refundableUSD(payment) {
+			http.Error(w, fmt.Sprintf("Claimed amount exceeds the refundable %.2f USD", refundableUSD(payment)), http.StatusBadRequest)
+			return
+		}
+		claims[claim.ID] = claim
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(claim)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// claimsHandler is the admin review queue, optionally filtered by ?status=.
+func claimsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	status := strings.ToUpper(r.URL.Query().Get("status"))
+	list := []*Claim{}
+	for _, claim := range claims {
+		if status == "" || claim.Status == status {
+			list = append(list, claim)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"claims": list,
+		"total":  len(list),
+	})
+}
+
+func claimHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/claims/"), "/")
+	parts := strings.Split(rest, "/")
+
+	claim, exists := claims[parts[0]]
+	if !exists {
+		http.Error(w, "Claim not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		if !requirePartyOrAdmin(w, r, shipments[claim.ShipmentID]) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(claim)
+	case len(parts) == 4 && parts[1] == "items" && parts[3] == "photos" && r.Method == "POST":
+		index, err := strconv.Atoi(parts[2])
+		if err != nil || index < 0 || index >= len(claim.Items) {
+			http.Error(w, "Claim item not found", http.StatusNotFound)
+			return
+		}
+		claimPhotoUploadHandler(w, r, claim, index)
+	case len(parts) == 2 && parts[1] == "decision" && r.Method == "POST":
+		claimDecisionHandler(w, r, claim)
+	case len(parts) == 1, len(parts) == 2 && parts[1] == "decision", len(parts) == 4 && parts[1] == "items" && parts[3] == "photos":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// claimPhotoUploadHandler attaches a photo of the damage to one item.
+func claimPhotoUploadHandler(w http.ResponseWriter, r *http.Request, claim *Claim, index int) {
+	if claim.Status != ClaimSubmitted {
+		http.Error(w, "Claim already decided", http.StatusConflict)
+		return
+	}
+	if len(claim.Items[index].Photos) >= maxPhotosPerItem {
+		http.Error(w, fmt.Sprintf("At most %d photos per claim item", maxPhotosPerItem), http.StatusConflict)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPhotoBytes+1<<20)
+	if err := r.ParseMultipartForm(maxPhotoBytes); err != nil {
+		http.Error(w, "Invalid multipart upload or photo too large", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("user_id") != claim.SenderID {
+		http.Error(w, "Only the sender can add photos to a claim", http.StatusForbidden)
+		return
+	}
+	file, header, err := r.FormFile("photo")
+	if err != nil {
+		http.Error(w, "Missing photo field", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxPhotoBytes+1))
+	if err != nil || len(data) == 0 || len(data) > maxPhotoBytes {
+		http.Error(w, "Invalid photo", http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(data)
+	extension, allowed := allowedPhotoTypes[contentType]
+	if !allowed {
+		http.Error(w, "Unsupported photo type, use JPEG, PNG or WebP", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	photoID := "photo-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	photo := ClaimPhoto{
+		ID:          photoID,
+		BlobKey:     "claims/" + claim.ID + "/" + photoID + extension,
+		FileName:    filepath.Base(header.Filename),
+		ContentType: contentType,
+		UploadedAt:  time.Now(),
+	}
+	if err := blobStorage.Put(photo.BlobKey, data); err != nil {
+		log.Printf("storing photo for claim %s failed: %v", claim.ID, err)
+		http.Error(w, "Could not store photo", http.StatusInternalServerError)
+		return
+	}
+	claim.Items[index].Photos = append(claim.Items[index].Photos, photo)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(photo)
+}
+
+// claimDecisionHandler lets an admin award a refund per item. The total
+// award is refunded from the escrow payment, so the traveler receives the
+// agreed fee minus the award.
+func claimDecisionHandler(w http.ResponseWriter, r *http.Request, claim *Claim) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	if claim.Status != ClaimSubmitted {
+		http.Error(w, "Claim already decided", http.StatusConflict)
+		return
+	}
+
+	var req ClaimDecisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.AdminID == "" {
+		http.Error(w, "Admin ID is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.ItemAwards) != 0 && len(req.ItemAwards) != len(claim.Items) {
+		http.Error(w, fmt.Sprintf("Expected %d item awards", len(claim.Items)), http.StatusBadRequest)
+		return
+	}
+
+	awarded := 0.0
+	for i, award := range req.ItemAwards {
+		if award < 0 || award > claim.Items[i].ClaimedUSD {
+			http.Error(w, fmt.Sprintf("Award for item %d must be between 0 and %.2f USD", i, claim.Items[i].ClaimedUSD), http.StatusBadRequest)
+			return
+		}
+		awarded += award
+	}
+	awarded = roundCents(awarded)
+	if awarded > refundableUSD(payments[claim.ShipmentID]) {
+		http.Error(w, fmt.Sprintf("Award exceeds the refundable %.2f USD", refundableUSD(payments[claim.ShipmentID])), http.StatusConflict)
+		return
+	}
+
+	for i, award := range req.ItemAwards {
+		claim.Items[i].AwardedUSD = roundCents(award)
+	}
+	decision := &ClaimDecision{
+		AwardedUSD: awarded,
+		DecidedBy:  req.AdminID,
+		Notes:      req.Notes,
+		DecidedAt:  time.Now(),
+	}
+	if awarded > 0 {
+		if payment := settlePayment(claim.ShipmentID, awarded, "CLAIM_DECISION"); payment != nil {
+			decision.PayoutUSD = payment.TravelerPayoutUSD
+		}
+	} else if payment, exists := payments[claim.ShipmentID]; exists {
+		decision.PayoutUSD = payment.TravelerPayoutUSD
+	}
+	claim.Decision = decision
+
+	switch {
+	case awarded <= 0:
+		claim.Status = ClaimRejected
+	case awarded >= claim.TotalClaimedUSD:
+		claim.Status = ClaimApproved
+	default:
+		claim.Status = ClaimPartiallyApproved
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(claim)
+}
+
+// claimAllowed checks that the shipment was delivered within the claim
+// window and has no undecided claim.
+func claimAllowed(shipment Shipment) error {
+	if shipment.Status != "DELIVERED" || shipment.DeliveredAt == nil {
+		return fmt.Errorf("claims require a delivered shipment")
+	}
+	if time.Now().After(shipment.DeliveredAt.Add(disputeWindow)) {
+		return fmt.Errorf("claim window closed %s", shipment.DeliveredAt.Add(disputeWindow).Format(time.RFC3339))
+	}
+	if _, exists := payments[shipment.ID]; !exists {
+		return fmt.Errorf("shipment has no payment")
+	}
+	if claim := pendingClaim(shipment.ID); claim != nil {
+		return fmt.Errorf("claim %s is still under review", claim.ID)
+	}
+	// A loss is compensated once, by the insurer or from escrow
+	for _, claim := range insuranceClaims {
+		if claim.ShipmentID == shipment.ID && claim.Status != InsuranceClaimRejected {
+			return fmt.Errorf("insurance claim %s already covers this shipment", claim.ID)
+		}
+	}
+	return nil
+}
+
+// pendingClaim returns the undecided claim of a shipment, if any.
+func pendingClaim(shipmentID string) *Claim {
+	for _, claim := range claims {
+		if claim.ShipmentID == shipmentID && claim.Status == ClaimSubmitted {
+			return claim
+		}
+	}
+	return nil
+}
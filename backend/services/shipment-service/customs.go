@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// LandedCostRequest carries everything a customs provider needs to estimate
+// duties and taxes (spec 6.3.2).
+type LandedCostRequest struct {
+	OriginCountry      string  `json:"origin_country"`
+	DestinationCountry string  `json:"destination_country"`
+	SenderAddress      string  `json:"sender_address"`
+	RecipientAddress   string  `json:"recipient_address"`
+	Currency           string  `json:"currency"`
+	ItemValueUSD       float64 `json:"item_value_usd"`
+	TransportFeeUSD    float64 `json:"transport_fee_usd"`
+	HSCode             string  `json:"hs_code"`
+}
+
+type LandedCostLine struct {
+	Label       string  `json:"label"`
+	AmountUSD   float64 `json:"amount_usd"`
+	AmountLocal float64 `json:"amount_local"`
+	Explanation string  `json:"explanation"`
+}
+
+// LandedCostEstimate is shown to the sender before posting. Following the
+// DDU model (spec 6.3.4) the recipient pays any difference to the actual
+// charges levied at the border. Providers calculate in USD, the *Local
+// amounts are converted to Currency with ExchangeRate.
+type LandedCostEstimate struct {
+	Provider        string           `json:"provider"`
+	Currency        string           `json:"currency"`
+	ExchangeRate    float64          `json:"exchange_rate"`
+	ItemValueUSD    float64          `json:"item_value_usd"`
+	TransportFeeUSD float64          `json:"transport_fee_usd"`
+	DutiesUSD       float64          `json:"duties_usd"`
+	TaxesUSD        float64          `json:"taxes_usd"`
+	TotalUSD        float64          `json:"total_usd"`
+	DutiesLocal     float64          `json:"duties_local"`
+	TaxesLocal      float64          `json:"taxes_local"`
+	TotalLocal      float64          `json:"total_local"`
+	Lines           []LandedCostLine `json:"lines"`
+	Incoterm        string           `json:"incoterm"`
+	Notice          string           `json:"notice"`
+}
+
+// CustomsProvider is the adapter every landed-cost provider (Zonos, Avalara,
+// SimplyDuty) implements so the provider can be switched by configuration.
+type CustomsProvider interface {
+	Name() string
+	EstimateLandedCost(req LandedCostRequest) (LandedCostEstimate, error)
+}
+
+var customsProvider CustomsProvider = newCustomsProvider(os.Getenv("CUSTOMS_PROVIDER"))
+
+const (
+	defaultCountry  = "DE"
+	defaultCurrency = "USD"
+	dduNotice       = "Geschätzte Zölle und Steuern (DDU). Abweichungen bei der Einfuhr trägt der Empfänger."
+)
+
+var supportedCurrencies = map[string]bool{"USD": true, "EUR": true, "GBP": true, "CHF": true}
+
+// usdExchangeRates are reference rates for showing estimates in the
+// sender's currency. The amount actually charged at the border depends on
+// the customs authority's rate of the day.
+var usdExchangeRates = map[string]float64{"USD": 1, "EUR": 0.92, "GBP": 0.79, "CHF": 0.88}
+
+func newCustomsProvider(name string) CustomsProvider {
+	switch strings.ToLower(name) {
+	case "", "local":
+		return newRuleTableCustomsProvider()
+	default:
+		log.Printf("⚠️ Unknown customs provider %q, falling back to local rule table", name)
+		return newRuleTableCustomsProvider()
+	}
+}
+
+type countryRules struct {
+	CustomsUnion     string
+	DeMinimisDutyUSD float64
+	DeMinimisTaxUSD  float64
+	VATRate          float64
+	DefaultDutyRate  float64
+}
+
+// ruleTableCustomsProvider estimates duties from a static table of country
+// rules and HS chapter rates. It is meant for local development and tests.
+type ruleTableCustomsProvider struct {
+	countries    map[string]countryRules
+	chapterRates map[string]float64
+}
+
+func newRuleTableCustomsProvider() *ruleTableCustomsProvider {
+	eu := func(vat float64) countryRules {
+		return countryRules{CustomsUnion: "EU", DeMinimisDutyUSD: 160, DeMinimisTaxUSD: 0, VATRate: vat, DefaultDutyRate: 0.04}
+	}
+	return &ruleTableCustomsProvider{
+		countries: map[string]countryRules{
+			"DE": eu(0.19),
+			"AT": eu(0.20),
+			"FR": eu(0.20),
+			"NL": eu(0.21),
+			"IT": eu(0.22),
+			"ES": eu(0.21),
+			"PL": eu(0.23),
+			"CH": {CustomsUnion: "CH", DeMinimisDutyUSD: 0, DeMinimisTaxUSD: 65, VATRate: 0.081, DefaultDutyRate: 0.02},
+			"GB": {CustomsUnion: "GB", DeMinimisDutyUSD: 170, DeMinimisTaxUSD: 0, VATRate: 0.20, DefaultDutyRate: 0.04},
+			"US": {CustomsUnion: "US", DeMinimisDutyUSD: 800, DeMinimisTaxUSD: 800, VATRate: 0, DefaultDutyRate: 0.05},
+			"TR": {CustomsUnion: "TR", DeMinimisDutyUSD: 30, DeMinimisTaxUSD: 30, VATRate: 0.20, DefaultDutyRate: 0.10},
+		},
+		// Duty rates by HS chapter (first two digits of the code)
+		chapterRates: map[string]float64{
+			"49": 0.00,  // printed matter, documents
+			"61": 0.12,  // knitted apparel
+			"62": 0.12,  // woven apparel
+			"64": 0.08,  // footwear
+			"71": 0.025, // jewellery
+			"84": 0.00,  // computers and machinery
+			"85": 0.02,  // electrical and electronic equipment
+			"95": 0.047, // toys and games
+		},
+	}
+}
+
+func (p *ruleTableCustomsProvider) Name() string {
+	return "local"
+}
+
+func (p *ruleTableCustomsProvider) EstimateLandedCost(req LandedCostRequest) (LandedCostEstimate, error) {
+	origin, ok := p.countries[req.OriginCountry]
+	if !ok {
+		return LandedCostEstimate{}, fmt.Errorf("unsupported origin country %q", req.OriginCountry)
+	}
+	destination, ok := p.countries[req.DestinationCountry]
+	if !ok {
+		return LandedCostEstimate{}, fmt.Errorf("unsupported destination country %q", req.DestinationCountry)
+	}
+
+	estimate := LandedCostEstimate{
+		Provider:        p.Name(),
+		Currency:        req.Currency,
+		ItemValueUSD:    req.ItemValueUSD,
+		TransportFeeUSD: req.TransportFeeUSD,
+		Incoterm:        "DDU",
+		Notice:          dduNotice,
+	}
+	estimate.Lines = append(estimate.Lines,
+		LandedCostLine{Label: "Warenwert", AmountUSD: req.ItemValueUSD, Explanation: "Vom Absender angegebener Wert"},
+		LandedCostLine{Label: "Transportgebühr", AmountUSD: req.TransportFeeUSD, Explanation: "Gebühr des Transporteurs"},
+	)
+
+	if origin.CustomsUnion == destination.CustomsUnion {
+		estimate.Lines = append(estimate.Lines, LandedCostLine{
+			Label:       "Zölle & Steuern",
+			Explanation: fmt.Sprintf("Keine Einfuhrabgaben innerhalb der Zollunion %s", destination.CustomsUnion),
+		})
+		estimate.TotalUSD = roundCents(req.ItemValueUSD + req.TransportFeeUSD)
+		return estimate, nil
+	}
+
+	// Duties are assessed on the CIF value, i.e. goods plus transport
+	customsValue := req.ItemValueUSD + req.TransportFeeUSD
+
+	dutyRate, rateSource := destination.DefaultDutyRate, "Standardsatz des Ziellandes"
+	if len(req.HSCode) >= 2 {
+		if rate, ok := p.chapterRates[req.HSCode[:2]]; ok {
+			dutyRate, rateSource = rate, fmt.Sprintf("HS-Kapitel %s", req.HSCode[:2])
+		}
+	}
+
+	if customsValue > destination.DeMinimisDutyUSD {
+		estimate.DutiesUSD = roundCents(customsValue * dutyRate)
+		estimate.Lines = append(estimate.Lines, LandedCostLine{
+			Label:       "Zoll",
+			AmountUSD:   estimate.DutiesUSD,
+			Explanation: fmt.Sprintf("%.1f%% auf %.2f USD (%s)", dutyRate*100, customsValue, rateSource),
+		})
+	} else {
+		estimate.Lines = append(estimate.Lines, LandedCostLine{
+			Label:       "Zoll",
+			Explanation: fmt.Sprintf("Zollfrei unter der Freigrenze von %.2f USD", destination.DeMinimisDutyUSD),
+		})
+	}
+
+	if destination.VATRate > 0 && customsValue > destination.DeMinimisTaxUSD {
+		estimate.TaxesUSD = roundCents((customsValue + estimate.DutiesUSD) * destination.VATRate)
+		estimate.Lines = append(estimate.Lines, LandedCostLine{
+			Label:       "Einfuhrumsatzsteuer",
+			AmountUSD:   estimate.TaxesUSD,
+			Explanation: fmt.Sprintf("%.1f%% auf Zollwert inklusive Zoll", destination.VATRate*100),
+		})
+	} else {
+		estimate.Lines = append(estimate.Lines, LandedCostLine{
+			Label:       "Einfuhrumsatzsteuer",
+			Explanation: "Keine Einfuhrumsatzsteuer fällig",
+		})
+	}
+
+	estimate.TotalUSD = roundCents(customsValue + estimate.DutiesUSD + estimate.TaxesUSD)
+	return estimate, nil
+}
+
+func customsEstimateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CreateShipmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// Resolve the addresses like creating the shipment does, so the
+	// estimate matches the one stored with it
+	if err := resolveShipmentAddresses(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	normalizeCustomsFields(&req)
+	if !supportedCurrencies[req.Currency] {
+		http.Error(w, "Unsupported currency", http.StatusBadRequest)
+		return
+	}
+
+	// Without an agreed fee yet, estimate with the suggested fee
+	transportFee := priceSuggester.Suggest(req).RecommendedFeeUSD
+	estimate, err := customsProvider.EstimateLandedCost(landedCostRequest(req, transportFee))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	localizeEstimate(&estimate)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(estimate)
+}
+
+// normalizeCustomsFields upper-cases country and currency codes and defaults
+// missing countries to the home market.
+func normalizeCustomsFields(req *CreateShipmentRequest) {
+	req.DestinationCountry = strings.ToUpper(strings.TrimSpace(req.DestinationCountry))
+	if req.DestinationCountry == "" {
+		req.DestinationCountry = defaultCountry
+	}
+	req.OriginCountry = strings.ToUpper(strings.TrimSpace(req.OriginCountry))
+	if req.OriginCountry == "" {
+		req.OriginCountry = defaultCountry
+	}
+	req.Currency = strings.ToUpper(strings.TrimSpace(req.Currency))
+	if req.Currency == "" {
+		req.Currency = defaultCurrency
+	}
+	req.HSCode = strings.ReplaceAll(strings.TrimSpace(req.HSCode), ".", "")
+}
+
+func landedCostRequest(req CreateShipmentRequest, transportFeeUSD float64) LandedCostRequest {
+	return LandedCostRequest{
+		OriginCountry:      req.OriginCountry,
+		DestinationCountry: req.DestinationCountry,
+		SenderAddress:      req.FromLocation,
+		RecipientAddress:   req.RecipientAddress,
+		Currency:           req.Currency,
+		ItemValueUSD:       req.ItemValueUSD,
+		TransportFeeUSD:    transportFeeUSD,
+		HSCode:             req.HSCode,
+	}
+}
+
+// localizeEstimate converts the USD amounts of an estimate to its currency.
+func localizeEstimate(estimate *LandedCostEstimate) {
+	rate, ok := usdExchangeRates[estimate.Currency]
+	if !ok {
+		estimate.Currency, rate = "USD", 1
+	}
+	estimate.ExchangeRate = rate
+	estimate.DutiesLocal = roundCents(estimate.DutiesUSD * rate)
+	estimate.TaxesLocal = roundCents(estimate.TaxesUSD * rate)
+	estimate.TotalLocal = roundCents(estimate.TotalUSD * rate)
+	for i := range estimate.Lines {
+		estimate.Lines[i].AmountLocal = roundCents(estimate.Lines[i].AmountUSD * rate)
+	}
+}
+
+// estimateShipmentDuties refreshes the customs estimate of a shipment, e.g.
+// once the transport fee has been agreed. If the provider cannot estimate,
+// the shipment is marked CustomsEstimateUnavailable and CustomsEstimateError
+// says why, so zero duties are never mistaken for a duty-free import.
+func estimateShipmentDuties(shipment *Shipment, transportFeeUSD float64) {
+	estimate, err := customsProvider.EstimateLandedCost(LandedCostRequest{
+		OriginCountry:      shipment.OriginCountry,
+		DestinationCountry: shipment.DestinationCountry,
+		SenderAddress:      shipment.FromLocation,
+		RecipientAddress:   shipment.RecipientAddress,
+		Currency:           shipment.Currency,
+		ItemValueUSD:       shipment.ItemValueUSD,
+		TransportFeeUSD:    transportFeeUSD,
+		HSCode:             shipment.HSCode,
+	})
+	if err != nil {
+		log.Printf("customs estimate for shipment %s failed: %v", shipment.ID, err)
+		shipment.DutiesAndTaxesUSD = 0
+		shipment.CustomsEstimate = nil
+		shipment.CustomsEstimateUnavailable = true
+		shipment.CustomsEstimateError = err.Error()
+		return
+	}
+	localizeEstimate(&estimate)
+	shipment.DutiesAndTaxesUSD = roundCents(estimate.DutiesUSD + estimate.TaxesUSD)
+	shipment.CustomsEstimate = &estimate
+	shipment.CustomsEstimateUnavailable = false
+	shipment.CustomsEstimateError = ""
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AttemptWaiting  = "WAITING"
+	AttemptFailed   = "FAILED"
+	AttemptResolved = "RESOLVED"
+
+	OptionReschedule = "RESCHEDULE"
+	OptionRedirect   = "REDIRECT"
+	OptionReturn     = "RETURN"
+
+	defaultDeliveryWait = 30 * time.Minute
+	// How often waiting delivery attempts are checked for expiry
+	deliveryAttemptCheckInterval = time.Minute
+)
+
+// DeliveryAttempt is a "recipient not present" report (spec 6.2.5). After
+// the waiting period the shipment becomes FAILED_DELIVERY and the sender
+// chooses how to continue.
+type DeliveryAttempt struct {
+	ID          string     `json:"id"`
+	ShipmentID  string     `json:"shipment_id"`
+	ReportedBy  string     `json:"reported_by"`
+	Location    string     `json:"location"`
+	Latitude    float64    `json:"latitude"`
+	Longitude   float64    `json:"longitude"`
+	AttemptedAt time.Time  `json:"attempted_at"`
+	WaitUntil   time.Time  `json:"wait_until"`
+	Status      string     `json:"status"`
+	Resolution  string     `json:"resolution,omitempty"`
+	FeeUSD      float64    `json:"fee_usd,omitempty"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+}
+
+type ReportDeliveryAttemptRequest struct {
+	UserID      string    `json:"user_id"`
+	Location    string    `json:"location"`
+	Latitude    float64   `json:"latitude"`
+	Longitude   float64   `json:"longitude"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+type ResolveFailedDeliveryRequest struct {
+	UserID       string    `json:"user_id"`
+	Option       string    `json:"option"`
+	NewDate      time.Time `json:"new_date"`
+	DropOffPoint string    `json:"drop_off_point_id"`
+}
+
+// DeliveryFeeRule charges a fixed amount plus a share of the agreed fee.
+// The fee is paid by the sender and passed on to the traveler.
+type DeliveryFeeRule struct {
+	FixedUSD     float64 `json:"fixed_usd"`
+	PercentOfFee float64 `json:"percent_of_fee"`
+	Description  string  `json:"description"`
+}
+
+type FailedDeliveryOption struct {
+	Option        string         `json:"option"`
+	FeeUSD        float64        `json:"fee_usd"`
+	Description   string         `json:"description"`
+	DropOffPoints []DropOffPoint `json:"drop_off_points,omitempty"`
+}
+
+// DropOffPoint is a partner parcel shop or locker that accepts redirected
+// shipments.
+type DropOffPoint struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	Address string  `json:"address"`
+	City    string  `json:"city"`
+	FeeUSD  float64 `json:"fee_usd"`
+}
+
+var deliveryAttempts = make(map[string][]DeliveryAttempt)
+var deliveryWait = deliveryWaitFromEnv()
+
+var failedDeliveryFees = map[string]DeliveryFeeRule{
+	OptionReschedule: {FixedUSD: 5, PercentOfFee: 0.2, Description: "Neuer Zustellversuch zu einem späteren Termin"},
+	OptionRedirect:   {FixedUSD: 3, PercentOfFee: 0.1, Description: "Abgabe an einem Paketshop oder Schließfach"},
+	OptionReturn:     {FixedUSD: 0, PercentOfFee: 1.0, Description: "Rücksendung an den Absender"},
+}
+
+var dropOffPoints = []DropOffPoint{
+	{ID: "dp-ber-1", Name: "Paketshop Alexanderplatz", Address: "Alexanderplatz 1, 10178 Berlin", City: "Berlin", FeeUSD: 2},
+	{ID: "dp-ber-2", Name: "Packstation 101", Address: "Friedrichstraße 50, 10117 Berlin", City: "Berlin", FeeUSD: 1},
+	{ID: "dp-muc-1", Name: "Paketshop Marienplatz", Address: "Marienplatz 8, 80331 München", City: "München", FeeUSD: 2},
+	{ID: "dp-ham-1", Name: "Packstation 205", Address: "Mönckebergstraße 7, 20095 Hamburg", City: "Hamburg", FeeUSD: 1},
+	{ID: "dp-fra-1", Name: "Paketshop Zeil", Address: "Zeil 90, 60313 Frankfurt", City: "Frankfurt", FeeUSD: 2},
+}
+
+// deliveryWaitFromEnv reads DELIVERY_WAIT_MINUTES, defaulting to 30 minutes.
+func deliveryWaitFromEnv() time.Duration {
+	if minutes, err := strconv.Atoi(os.Getenv("DELIVERY_WAIT_MINUTES")); err == nil && minutes >= 0 {
+		return time.Duration(minutes) * time.Minute
+	}
+	return defaultDeliveryWait
+}
+
+func shipmentDeliveryAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		attempts := deliveryAttempts[shipmentID]
+		if attempts == nil {
+			attempts = []DeliveryAttempt{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"attempts": attempts,
+			"total":    len(attempts),
+		})
+
+	case "POST":
+		var req ReportDeliveryAttemptRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if shipmentRole(shipment, req.UserID) != roleTraveler {
+			http.Error(w, "Only the traveler can report a delivery attempt", http.StatusForbidden)
+			return
+		}
+		if shipment.Status != "IN_TRANSIT" {
+			http.Error(w, "Delivery attempts can only be reported for shipments in transit", http.StatusConflict)
+			return
+		}
+		if openDeliveryAttempt(shipmentID) != nil {
+			http.Error(w, "A delivery attempt is already waiting", http.StatusConflict)
+			return
+		}
+		if req.AttemptedAt.IsZero() || req.AttemptedAt.After(time.Now()) {
+			req.AttemptedAt = time.Now()
+		}
+
+		attempt := DeliveryAttempt{
+			ID:          "attempt-" + strconv.FormatInt(time.Now().UnixNano(), 10),
+			ShipmentID:  shipmentID,
+			ReportedBy:  req.UserID,
+			Location:    req.Location,
+			Latitude:    req.Latitude,
+			Longitude:   req.Longitude,
+			AttemptedAt: req.AttemptedAt,
+			WaitUntil:   req.AttemptedAt.Add(deliveryWait),
+			Status:      AttemptWaiting,
+		}
+		deliveryAttempts[shipmentID] = append(deliveryAttempts[shipmentID], attempt)
+
+		message := fmt.Sprintf("Der Transporteur wartet bis %s Uhr am Zustellort (%s). Bitte melden Sie sich.",
+			attempt.WaitUntil.Format("15:04"), attempt.Location)
+		notifier.Notify(Notification{ShipmentID: shipmentID, UserID: shipment.SenderID, Message: message})
+		notifier.Notify(Notification{ShipmentID: shipmentID, Phone: shipment.RecipientPhone, Message: message})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(attempt)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// shipmentFailedDeliveryHandler lists the continuation options with their
+// fees (GET) and applies the sender's choice (POST).
+func shipmentFailedDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+	if shipment.Status != "FAILED_DELIVERY" {
+		http.Error(w, "Shipment has no failed delivery", http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"options": failedDeliveryOptions(shipment),
+		})
+
+	case "POST":
+		var req ResolveFailedDeliveryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if shipmentRole(shipment, req.UserID) != roleSender {
+			http.Error(w, "Only the sender can decide how to continue", http.StatusForbidden)
+			return
+		}
+
+		option := strings.ToUpper(req.Option)
+		rule, known := failedDeliveryFees[option]
+		if !known {
+			http.Error(w, "Option must be RESCHEDULE, REDIRECT or RETURN", http.StatusBadRequest)
+			return
+		}
+		fee := deliveryFee(rule, shipment.AgreedFeeUSD)
+		previousStatus := shipment.Status
+
+		switch option {
+		case OptionReschedule:
+			if !req.NewDate.After(time.Now()) {
+				http.Error(w, "A future delivery date is required", http.StatusBadRequest)
+				return
+			}
+			shipment.EstimatedDeliveryDate = req.NewDate
+			shipment.Status = "IN_TRANSIT"
+		case OptionRedirect:
+			if _, known := findDropOffPoint(dropOffPoints, req.DropOffPoint); !known {
+				http.Error(w, "Unknown drop-off point", http.StatusBadRequest)
+				return
+			}
+			point, found := findDropOffPoint(destinationDropOffPoints(shipment), req.DropOffPoint)
+			if !found {
+				http.Error(w, "Drop-off point must be in the destination city", http.StatusConflict)
+				return
+			}
+			destination, err := resolveAddress(nil, point.Address)
+			if err != nil {
+				http.Error(w, "Could not locate drop-off point: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if destination.Country == "" {
+				destination.Country = shipment.DestinationCountry
+			}
+			// Customs and screening were done for the destination country
+			if destination.Country != shipment.DestinationCountry {
+				http.Error(w, "Drop-off point must be in the destination country", http.StatusConflict)
+				return
+			}
+			fee = roundCents(fee + point.FeeUSD)
+			shipment.Destination = destination
+			shipment.ToLocation = destination.City
+			shipment.RecipientAddress = point.Name + ", " + point.Address
+			shipment.Status = "IN_TRANSIT"
+		case OptionReturn:
+			shipment.Status = "RETURNING_TO_SENDER"
+		}
+
+		now := time.Now()
+		attempts := deliveryAttempts[shipmentID]
+		for i := range attempts {
+			if attempts[i].Status == AttemptFailed {
+				attempts[i].Status = AttemptResolved
+				attempts[i].Resolution = option
+				attempts[i].FeeUSD = fee
+				attempts[i].ResolvedAt = &now
+			}
+		}
+		shipment.ExtraFeesUSD = roundCents(shipment.ExtraFeesUSD + fee)
+		saveShipmentWithEvent(shipment, EventShipmentStatusChanged, ShipmentEventData{PreviousStatus: previousStatus, Reason: option})
+		chargeExtraFee(shipmentID, fee)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(shipment)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runDeliveryAttemptExpiry checks the open delivery attempts on its own
+// schedule, so reads never change a shipment.
+func runDeliveryAttemptExpiry() {
+	for {
+		time.Sleep(deliveryAttemptCheckInterval)
+
+		storeMu.Lock()
+		for shipmentID := range deliveryAttempts {
+			expireDeliveryAttempts(shipmentID)
+		}
+		storeMu.Unlock()
+	}
+}
+
+// expireDeliveryAttempts moves a shipment to FAILED_DELIVERY once the
+// waiting period of its open attempt is over. An attempt still waiting when the shipment has left
+// IN_TRANSIT, e.g. because the recipient turned up and it was delivered, is
+// resolved with that status instead.
+func expireDeliveryAttempts(shipmentID string) {
+	attempt := openDeliveryAttempt(shipmentID)
+	if attempt == nil {
+		return
+	}
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		return
+	}
+	now := time.Now()
+	if shipment.Status != "IN_TRANSIT" {
+		attempt.Status = AttemptResolved
+		attempt.Resolution = shipment.Status
+		attempt.ResolvedAt = &now
+		return
+	}
+	if now.Before(attempt.WaitUntil) {
+		return
+	}
+
+	attempt.Status = AttemptFailed
+	shipment.Status = "FAILED_DELIVERY"
+	saveShipmentWithEvent(shipment, EventShipmentStatusChanged, ShipmentEventData{PreviousStatus: "IN_TRANSIT"})
+
+	notifier.Notify(Notification{
+		ShipmentID: shipmentID,
+		UserID:     shipment.SenderID,
+		Message:    "Die Zustellung ist fehlgeschlagen. Bitte wählen Sie: neuer Termin, Abgabe im Paketshop oder Rücksendung.",
+	})
+	notifier.Notify(Notification{
+		ShipmentID: shipmentID,
+		Phone:      shipment.RecipientPhone,
+		Message:    "Ihre Sendung konnte nicht zugestellt werden. Der Absender wurde informiert.",
+	})
+}
+
+func openDeliveryAttempt(shipmentID string) *DeliveryAttempt {
+	attempts := deliveryAttempts[shipmentID]
+	for i := range attempts {
+		if attempts[i].Status == AttemptWaiting {
+			return &attempts[i]
+		}
+	}
+	return nil
+}
+
+func failedDeliveryOptions(shipment Shipment) []FailedDeliveryOption {
+	points := destinationDropOffPoints(shipment)
+
+	options := make([]FailedDeliveryOption, 0, len(failedDeliveryFees))
+	for _, option := range []string{OptionReschedule, OptionRedirect, OptionReturn} {
+		// Without a drop-off point in the destination city there is nowhere
+		// to redirect to
+		if option == OptionRedirect && len(points) == 0 {
+			continue
+		}
+		rule := failedDeliveryFees[option]
+		entry := FailedDeliveryOption{
+			Option:      option,
+			FeeUSD:      deliveryFee(rule, shipment.AgreedFeeUSD),
+			Description: rule.Description,
+		}
+		if option == OptionRedirect {
+			entry.DropOffPoints = points
+		}
+		options = append(options, entry)
+	}
+	return options
+}
+
+// destinationDropOffPoints lists the drop-off points in the shipment's
+// destination city, the only ones the traveler can still reach.
+func destinationDropOffPoints(shipment Shipment) []DropOffPoint {
+	city := shipment.ToLocation
+	if shipment.Destination != nil && shipment.Destination.City != "" {
+		city = shipment.Destination.City
+	}
+	var points []DropOffPoint
+	for _, point := range dropOffPoints {
+		if strings.EqualFold(point.City, strings.TrimSpace(city)) {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+func findDropOffPoint(points []DropOffPoint, id string) (DropOffPoint, bool) {
+	for _, point := range points {
+		if point.ID == id {
+			return point, true
+		}
+	}
+	return DropOffPoint{}, false
+}
+
+func deliveryFee(rule DeliveryFeeRule, agreedFeeUSD float64) float64 {
+	return roundCents(math.Max(0, rule.FixedUSD+rule.PercentOfFee*agreedFeeUSD))
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DisputeNegotiation = "NEGOTIATION"
+	DisputeMediation   = "MEDIATION"
+	DisputeResolved    = "RESOLVED"
+
+	OutcomeRefund        = "REFUND"
+	OutcomePartialRefund = "PARTIAL_REFUND"
+	OutcomePayout        = "PAYOUT"
+
+	disputeWindow        = 14 * 24 * time.Hour
+	negotiationPeriod    = 72 * time.Hour
+	maxEvidenceBytes     = 10 << 20
+	maxEvidencePerParty  = 10
+	roleMediator         = "mediator"
+	disputeActorPlatform = "platform"
+)
+
+var allowedEvidenceTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+// Dispute follows the ODR flow of spec 6.6.1: a time-boxed negotiation
+// between sender and traveler, escalation to a Bringee mediator and a
+// binding decision that settles the held payment.
+type Dispute struct {
+	ID                string            `json:"id"`
+	ShipmentID        string            `json:"shipment_id"`
+	OpenedBy          string            `json:"opened_by"`
+	OpenedByRole      string            `json:"opened_by_role"`
+	Reason            string            `json:"reason"`
+	Description       string            `json:"description"`
+	Status            string            `json:"status"`
+	NegotiationEndsAt time.Time         `json:"negotiation_ends_at"`
+	MediatorID        string            `json:"mediator_id,omitempty"`
+	Proposal          *DisputeProposal  `json:"proposal,omitempty"`
+	Messages          []DisputeMessage  `json:"messages"`
+	Evidence          []DisputeEvidence `json:"evidence"`
+	Decision          *DisputeDecision  `json:"decision,omitempty"`
+	Events            []DisputeEvent    `json:"events"`
+	CreatedAt         time.Time         `json:"created_at"`
+}
+
+type DisputeMessage struct {
+	SenderID  string    `json:"sender_id"`
+	Role      string    `json:"role"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type DisputeEvidence struct {
+	ID          string    `json:"id"`
+	UploadedBy  string    `json:"uploaded_by"`
+	Description string    `json:"description"`
+	BlobKey     string    `json:"blob_key"`
+	FileName    string    `json:"file_name"`
+	ContentType string    `json:"content_type"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+// DisputeProposal is a settlement offered by one party during negotiation.
+type DisputeProposal struct {
+	ProposedBy string    `json:"proposed_by"`
+	RefundUSD  float64   `json:"refund_usd"`
+	ProposedAt time.Time `json:"proposed_at"`
+}
+
+type DisputeDecision struct {
+	Outcome   string    `json:"outcome"`
+	RefundUSD float64   `json:"refund_usd"`
+	PayoutUSD float64   `json:"payout_usd"`
+	DecidedBy string    `json:"decided_by"`
+	Rationale string    `json:"rationale"`
+	DecidedAt time.Time `json:"decided_at"`
+}
+
+type DisputeEvent struct {
+	Type      string    `json:"type"`
+	Actor     string    `json:"actor"`
+	Details   string    `json:"details,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type OpenDisputeRequest struct {
+	UserID      string `json:"user_id"`
+	Reason      string `json:"reason"`
+	Description string `json:"description"`
+}
+
+type DisputeActionRequest struct {
+	UserID     string  `json:"user_id"`
+	Message    string  `json:"message"`
+	RefundUSD  float64 `json:"refund_usd"`
+	MediatorID string  `json:"mediator_id"`
+	Outcome    string  `json:"outcome"`
+	Rationale  string  `json:"rationale"`
+}
+
+var disputes = make(map[string]*Dispute)
+
+// shipmentDisputesHandler opens (POST) and lists (GET) the disputes of a
+// shipment.
+func shipmentDisputesHandler(w http.ResponseWriter, r *http.Request) {
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if !requirePartyOrAdmin(w, r, shipment) {
+			return
+		}
+		shipmentDisputes := []*Dispute{}
+		for _, dispute := range disputes {
+			if dispute.ShipmentID == shipmentID {
+				expireNegotiation(dispute)
+				shipmentDisputes = append(shipmentDisputes, dispute)
+			}
+		}
+		sort.Slice(shipmentDisputes, func(i, j int) bool {
+			return shipmentDisputes[i].CreatedAt.Before(shipmentDisputes[j].CreatedAt)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"disputes": shipmentDisputes,
+			"total":    len(shipmentDisputes),
+		})
+
+	case "POST":
+		var req OpenDisputeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		role := shipmentRole(shipment, req.UserID)
+		if role == "" {
+			http.Error(w, "Only sender or traveler can open a dispute", http.StatusForbidden)
+			return
+		}
+		if strings.TrimSpace(req.Reason) == "" {
+			http.Error(w, "Reason is required", http.StatusBadRequest)
+			return
+		}
+		if err := disputeAllowed(shipment); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		now := time.Now()
+		dispute := &Dispute{
+			ID:                "dispute-" + randomHex(8),
+			ShipmentID:        shipmentID,
+			OpenedBy:          req.UserID,
+			OpenedByRole:      role,
+			Reason:            req.Reason,
+			Description:       req.Description,
+			Status:            DisputeNegotiation,
+			NegotiationEndsAt: now.Add(negotiationPeriod),
+			Messages:          []DisputeMessage{},
+			Evidence:          []DisputeEvidence{},
+			CreatedAt:         now,
+		}
+		appendDisputeEvent(dispute, "OPENED", req.UserID, req.Reason)
+		disputes[dispute.ID] = dispute
+
+		previousStatus := shipment.Status
+		shipment.Status = "DISPUTED"
+		saveShipmentWithEvent(shipment, EventDisputeOpened, ShipmentEventData{PreviousStatus: previousStatus, DisputeID: dispute.ID, Reason: req.Reason})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(dispute)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// disputesHandler is the mediator queue, optionally filtered by ?status=.
+func disputesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	status := strings.ToUpper(r.URL.Query().Get("status"))
+	list := []*Dispute{}
+	for _, dispute := range disputes {
+		expireNegotiation(dispute)
+		if status == "" || dispute.Status == status {
+			list = append(list, dispute)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"disputes": list,
+		"total":    len(list),
+	})
+}
+
+func disputeHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/disputes/"), "/")
+	disputeID, action, _ := strings.Cut(rest, "/")
+
+	dispute, exists := disputes[disputeID]
+	if !exists {
+		http.Error(w, "Dispute not found", http.StatusNotFound)
+		return
+	}
+	expireNegotiation(dispute)
+
+	if action == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requirePartyOrAdmin(w, r, shipments[dispute.ShipmentID]) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dispute)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if dispute.Status == DisputeResolved {
+		http.Error(w, "Dispute already resolved", http.StatusConflict)
+		return
+	}
+	if action == "evidence" {
+		disputeEvidenceHandler(w, r, dispute)
+		return
+	}
+
+	var req DisputeActionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	shipment := shipments[dispute.ShipmentID]
+	role := shipmentRole(shipment, req.UserID)
+
+	switch action {
+	case "messages":
+		if role == "" && !isAssignedMediator(dispute, req.UserID) {
+			http.Error(w, "Only parties and the mediator can write in a dispute", http.StatusForbidden)
+			return
+		}
+		if role == "" {
+			role = roleMediator
+		}
+		dispute.Messages = append(dispute.Messages, DisputeMessage{
+			SenderID:  req.UserID,
+			Role:      role,
+			Message:   req.Message,
+			Timestamp: time.Now(),
+		})
+		appendDisputeEvent(dispute, "MESSAGE", req.UserID, "")
+
+	case "propose":
+		if role == "" || dispute.Status != DisputeNegotiation {
+			http.Error(w, "Only parties can propose a settlement during negotiation", http.StatusConflict)
+			return
+		}
+		if err := validRefund(dispute.ShipmentID, req.RefundUSD); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dispute.Proposal = &DisputeProposal{ProposedBy: req.UserID, RefundUSD: req.RefundUSD, ProposedAt: time.Now()}
+		appendDisputeEvent(dispute, "PROPOSED", req.UserID, fmt.Sprintf("refund %.2f USD", req.RefundUSD))
+
+	case "accept":
+		if role == "" || dispute.Status != DisputeNegotiation || dispute.Proposal == nil || dispute.Proposal.ProposedBy == req.UserID {
+			http.Error(w, "Only the other party can accept an open proposal", http.StatusConflict)
+			return
+		}
+		appendDisputeEvent(dispute, "ACCEPTED", req.UserID, "")
+		resolveDispute(dispute, dispute.Proposal.RefundUSD, req.UserID, "Einigung der Parteien")
+
+	case "escalate":
+		if role == "" || dispute.Status != DisputeNegotiation {
+			http.Error(w, "Only parties can escalate a dispute in negotiation", http.StatusConflict)
+			return
+		}
+		dispute.Status = DisputeMediation
+		appendDisputeEvent(dispute, "ESCALATED", req.UserID, req.Message)
+
+	case "assign":
+		if !requireAdmin(w, r) {
+			return
+		}
+		if req.MediatorID == "" {
+			http.Error(w, "Mediator ID is required", http.StatusBadRequest)
+			return
+		}
+		dispute.Status = DisputeMediation
+		dispute.MediatorID = req.MediatorID
+		appendDisputeEvent(dispute, "MEDIATOR_ASSIGNED", req.MediatorID, "")
+
+	case "decision":
+		if !requireAdmin(w, r) {
+			return
+		}
+		if dispute.Status != DisputeMediation || !isAssignedMediator(dispute, req.UserID) {
+			http.Error(w, "Only the assigned mediator can decide a dispute in mediation", http.StatusForbidden)
+			return
+		}
+		refund, err := decisionRefund(dispute.ShipmentID, strings.ToUpper(req.Outcome), req.RefundUSD)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resolveDispute(dispute, refund, req.UserID, req.Rationale)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dispute)
+}
+
+func disputeEvidenceHandler(w http.ResponseWriter, r *http.Request, dispute *Dispute) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxEvidenceBytes+1<<20)
+	if err := r.ParseMultipartForm(maxEvidenceBytes); err != nil {
+		http.Error(w, "Invalid multipart upload or file too large", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.FormValue("user_id")
+	if shipmentRole(shipments[dispute.ShipmentID], userID) == "" && !isAssignedMediator(dispute, userID) {
+		http.Error(w, "Only parties and the mediator can upload evidence", http.StatusForbidden)
+		return
+	}
+	uploaded := 0
+	for _, evidence := range dispute.Evidence {
+		if evidence.UploadedBy == userID {
+			uploaded++
+		}
+	}
+	if uploaded >= maxEvidencePerParty {
+		http.Error(w, fmt.Sprintf("At most %d evidence files per party", maxEvidencePerParty), http.StatusConflict)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing file field", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxEvidenceBytes+1))
+	if err != nil || len(data) == 0 || len(data) > maxEvidenceBytes {
+		http.Error(w, "Invalid evidence file", http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(data)
+	extension, allowed := allowedEvidenceTypes[contentType]
+	if !allowed {
+		http.Error(w, "Unsupported file type, use JPEG, PNG, WebP or PDF", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	evidenceID := "evidence-" + randomHex(8)
+	evidence := DisputeEvidence{
+		ID:          evidenceID,
+		UploadedBy:  userID,
+		Description: r.FormValue("description"),
+		BlobKey:     "disputes/" + dispute.ID + "/" + evidenceID + extension,
+		FileName:    filepath.Base(header.Filename),
+		ContentType: contentType,
+		UploadedAt:  time.Now(),
+	}
+	if err := blobStorage.Put(evidence.BlobKey, data); err != nil {
+		log.Printf("storing evidence for dispute %s failed: %v", dispute.ID, err)
+		http.Error(w, "Could not store evidence", http.StatusInternalServerError)
+		return
+	}
+	dispute.Evidence = append(dispute.Evidence, evidence)
+	appendDisputeEvent(dispute, "EVIDENCE_ADDED", userID, evidence.FileName)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(evidence)
+}
+
+// disputeAllowed checks that the shipment has a traveler, is not already
+// disputed and that the dispute window after the expected delivery is open.
+func disputeAllowed(shipment Shipment) error {
+	if shipment.TravelerID == nil {
+		return fmt.Errorf("disputes require an accepted shipment")
+	}
+	if openDispute(shipment.ID) != nil {
+		return fmt.Errorf("shipment already has an open dispute")
+	}
+	switch shipment.Status {
+	case "POSTED", "CANCELLED", "DISPUTED", "REFUNDED", "SETTLED":
+		return fmt.Errorf("shipments in status %s cannot be disputed", shipment.Status)
+	}
+	if !shipment.EstimatedDeliveryDate.IsZero() && time.Now().After(shipment.EstimatedDeliveryDate.Add(disputeWindow)) {
+		return fmt.Errorf("dispute window closed %s", shipment.EstimatedDeliveryDate.Add(disputeWindow).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// openDispute returns the unresolved dispute of a shipment, if any. While
+// it is open the payment is held and the status only changes through the
+// dispute endpoints.
+func openDispute(shipmentID string) *Dispute {
+	for _, dispute := range disputes {
+		if dispute.ShipmentID == shipmentID && dispute.Status != DisputeResolved {
+			return dispute
+		}
+	}
+	return nil
+}
+
+// expireNegotiation escalates a dispute to mediation once the negotiation
+// period is over without agreement.
+func expireNegotiation(dispute *Dispute) {
+	if dispute.Status == DisputeNegotiation && time.Now().After(dispute.NegotiationEndsAt) {
+		dispute.Status = DisputeMediation
+		appendDisputeEvent(dispute, "ESCALATED", disputeActorPlatform, "Verhandlungsfrist abgelaufen")
+	}
+}
+
+// resolveDispute records the decision and settles the held payment: the
+// sender gets the refund back, the traveler receives the rest of the payout.
+// With the payment settled the shipment is closed: REFUNDED, DELIVERED if
+// it arrived, else SETTLED.
+func resolveDispute(dispute *Dispute, refundUSD float64, decidedBy, rationale string) {
+	shipment := shipments[dispute.ShipmentID]
+	payment := settlePayment(dispute.ShipmentID, refundUSD, "DISPUTE_DECISION")
+
+	outcome := OutcomePartialRefund
+	switch {
+	case refundUSD <= 0:
+		outcome = OutcomePayout
+	case payment != nil && payment.Status == PaymentRefunded:
+		outcome = OutcomeRefund
+	}
+
+	decision := &DisputeDecision{
+		Outcome:   outcome,
+		RefundUSD: refundUSD,
+		DecidedBy: decidedBy,
+		Rationale: rationale,
+		DecidedAt: time.Now(),
+	}
+	if payment != nil {
+		decision.PayoutUSD = payment.TravelerPayoutUSD
+	}
+	dispute.Decision = decision
+	dispute.Status = DisputeResolved
+	dispute.Proposal = nil
+	appendDisputeEvent(dispute, "DECIDED", decidedBy, fmt.Sprintf("%s, refund %.2f USD", outcome, refundUSD))
+
+	previousStatus := shipment.Status
+	switch {
+	case outcome == OutcomeRefund:
+		shipment.Status = "REFUNDED"
+	case shipment.DeliveredAt != nil:
+		shipment.Status = "DELIVERED"
+	default:
+		shipment.Status = "SETTLED"
+	}
+	saveShipmentWithEvent(shipment, EventDisputeResolved, ShipmentEventData{
+		PreviousStatus: previousStatus,
+		DisputeID:      dispute.ID,
+		Outcome:        outcome,
+		RefundUSD:      refundUSD,
+	})
+}
+
+// decisionRefund turns a mediator outcome into the amount refunded to the
+// sender.
+func decisionRefund(shipmentID, outcome string, refundUSD float64) (float64, error) {
+	payment, exists := payments[shipmentID]
+	switch outcome {
+	case OutcomePayout:
+		return 0, nil
+	case OutcomeRefund:
+		if !exists {
+			return 0, fmt.Errorf("shipment has no payment to refund")
+		}
+		return refundableUSD(payment), nil
+	case OutcomePartialRefund:
+		if err := validRefund(shipmentID, refundUSD); err != nil {
+			return 0, err
+		}
+		return refundUSD, nil
+	}
+	return 0, fmt.Errorf("outcome must be REFUND, PARTIAL_REFUND or PAYOUT")
+}
+
+func validRefund(shipmentID string, refundUSD float64) error {
+	payment, exists := payments[shipmentID]
+	if !exists {
+		return fmt.Errorf("shipment has no payment")
+	}
+	if refundUSD < 0 || refundUSD > refundableUSD(payment) {
+		return fmt.Errorf("refund must be between 0 and %.2f USD", refundableUSD(payment))
+	}
+	return nil
+}
+
+func isAssignedMediator(dispute *Dispute, userID string) bool {
+	return userID != "" && dispute.MediatorID == userID
+}
+
+func appendDisputeEvent(dispute *Dispute, eventType, actor, details string) {
+	dispute.Events = append(dispute.Events, DisputeEvent{
+		Type:      eventType,
+		Actor:     actor,
+		Details:   details,
+		Timestamp: time.Now(),
+	})
+}
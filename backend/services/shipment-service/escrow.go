@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"time"
+)
+
+// How often held payments are checked for the end of their claim window
+const paymentReleaseCheckInterval = time.Minute
+
+const (
+	PaymentHeld              = "HELD"
+	PaymentVoided            = "VOIDED"
+	PaymentReleased          = "RELEASED"
+	PaymentRefunded          = "REFUNDED"
+	PaymentPartiallyRefunded = "PARTIALLY_REFUNDED"
+)
+
+// EscrowPayment mirrors the "separate charges and transfers" flow (spec
+// 6.1.3): the sender's payment is held on the platform until the claim
+// window after delivery is over, then the traveler's share is transferred
+// and the commission stays with Bringee.
+type EscrowPayment struct {
+	ShipmentID          string     `json:"shipment_id"`
+	TransferGroup       string     `json:"transfer_group"`
+	AmountUSD           float64    `json:"amount_usd"`
+	TravelerPayoutUSD   float64    `json:"traveler_payout_usd"`
+	CommissionUSD       float64    `json:"commission_usd"`
+	InsurancePremiumUSD float64    `json:"insurance_premium_usd,omitempty"`
+	RefundedUSD         float64    `json:"refunded_usd"`
+	Status              string     `json:"status"`
+	StatusReason        string     `json:"status_reason,omitempty"`
+	HeldAt              time.Time  `json:"held_at"`
+	ReleaseAfter        *time.Time `json:"release_after,omitempty"`
+	SettledAt           *time.Time `json:"settled_at,omitempty"`
+}
+
+var payments = make(map[string]*EscrowPayment)
+
+// holdPayment charges the sender once a traveler has accepted the shipment.
+// The insurance premium is collected with the payment and passed on to the
+// insurer.
+func holdPayment(shipment Shipment) *EscrowPayment {
+	premium := 0.0
+	if shipment.Insurance != nil && shipment.Insurance.Status == CoverageActive {
+		premium = shipment.Insurance.PremiumUSD
+	}
+	payment := &EscrowPayment{
+		ShipmentID:          shipment.ID,
+		TransferGroup:       "shipment-" + shipment.ID,
+		AmountUSD:           roundCents(shipment.AgreedFeeUSD + shipment.DutiesAndTaxesUSD + premium),
+		InsurancePremiumUSD: premium,
+		TravelerPayoutUSD:   roundCents(shipment.AgreedFeeUSD - shipment.BringeeCommissionUSD),
+		CommissionUSD:       roundCents(shipment.BringeeCommissionUSD),
+		Status:              PaymentHeld,
+		HeldAt:              time.Now(),
+	}
+	payments[shipment.ID] = payment
+	return payment
+}
+
+// voidPayment returns the full held amount to the sender, e.g. when the
+// transaction is cancelled before any service was rendered.
+func voidPayment(shipmentID, reason string) {
+	payment, exists := payments[shipmentID]
+	if !exists || payment.Status != PaymentHeld {
+		return
+	}
+	now := time.Now()
+	payment.Status = PaymentVoided
+	payment.StatusReason = reason
+	payment.RefundedUSD = payment.AmountUSD
+	payment.TravelerPayoutUSD = 0
+	payment.CommissionUSD = 0
+	payment.SettledAt = &now
+}
+
+// cancelPayment settles a sender cancellation: the cancellation fee is
+// captured, the traveler's share of it is transferred as compensation and
+// the rest of the held amount goes back to the sender.
+func cancelPayment(shipmentID string, feeUSD, travelerShareUSD float64, reason string) {
+	payment, exists := payments[shipmentID]
+	if !exists || payment.Status != PaymentHeld {
+		return
+	}
+	if feeUSD <= 0 {
+		voidPayment(shipmentID, reason)
+		return
+	}
+	now := time.Now()
+	payment.Status = PaymentPartiallyRefunded
+	payment.StatusReason = reason
+	payment.RefundedUSD = roundCents(payment.AmountUSD - feeUSD)
+	payment.TravelerPayoutUSD = roundCents(travelerShareUSD)
+	payment.CommissionUSD = roundCents(feeUSD - travelerShareUSD)
+	payment.SettledAt = &now
+}
+
+// scheduleRelease keeps the payment held for the claim window after a
+// confirmed delivery, so an award can still be taken from the traveler's
+// payout. runPaymentRelease transfers it once the window is over.
+func scheduleRelease(shipmentID string, deliveredAt time.Time) {
+	payment, exists := payments[shipmentID]
+	if !exists || payment.Status != PaymentHeld {
+		return
+	}
+	releaseAfter := deliveredAt.Add(disputeWindow)
+	payment.ReleaseAfter = &releaseAfter
+}
+
+// runPaymentRelease transfers the held payments whose claim window is over.
+// A payment with an undecided claim or an open dispute stays held until the
+// decision.
+func runPaymentRelease() {
+	for {
+		time.Sleep(paymentReleaseCheckInterval)
+
+		storeMu.Lock()
+		now := time.Now()
+		for shipmentID, payment := range payments {
+			if payment.Status != PaymentHeld || payment.ReleaseAfter == nil || now.Before(*payment.ReleaseAfter) {
+				continue
+			}
+			if pendingClaim(shipmentID) != nil || openDispute(shipmentID) != nil {
+				continue
+			}
+			releasePayment(shipmentID)
+		}
+		storeMu.Unlock()
+	}
+}
+
+// releasePayment transfers the traveler's share, less any refund awarded
+// while the payment was held.
+func releasePayment(shipmentID string) {
+	payment, exists := payments[shipmentID]
+	if !exists || payment.Status != PaymentHeld {
+		return
+	}
+	now := time.Now()
+	payment.Status = settledStatus(payment)
+	payment.SettledAt = &now
+}
+
+func shipmentPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	payment, exists := payments[shipmentID]
+	if !exists {
+		http.Error(w, "No payment for this shipment", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payment)
+}
+
+// chargeExtraFee adds a fee paid by the sender for extra work of the
+// traveler, such as a second delivery attempt, to the held payment.
+func chargeExtraFee(shipmentID string, feeUSD float64) {
+	payment, exists := payments[shipmentID]
+	if !exists || payment.Status != PaymentHeld || feeUSD <= 0 {
+		return
+	}
+	payment.AmountUSD = roundCents(payment.AmountUSD + feeUSD)
+	payment.TravelerPayoutUSD = roundCents(payment.TravelerPayoutUSD + feeUSD)
+}
+
+// settlePayment refunds part or all of a payment to the sender after a
+// dispute or claim decision. The refund is taken from the traveler's payout
+// first and from the commission only beyond that. A payment held for the
+// claim window stays held, with the refund deducted, until it is released.
+// A payment that was already released is settled by the platform, which is
+// responsible for refunds (spec 6.1.3). Refunds accumulate, so a claim can
+// follow an earlier partial refund.
+func settlePayment(shipmentID string, refundUSD float64, reason string) *EscrowPayment {
+	payment, exists := payments[shipmentID]
+	if !exists {
+		return nil
+	}
+	if payment.Status != PaymentHeld && payment.Status != PaymentReleased && payment.Status != PaymentPartiallyRefunded {
+		return payment
+	}
+
+	refundUSD = math.Min(math.Max(refundUSD, 0), refundableUSD(payment))
+	fromCommission := math.Max(0, refundUSD-payment.TravelerPayoutUSD)
+	payment.TravelerPayoutUSD = roundCents(math.Max(0, payment.TravelerPayoutUSD-refundUSD))
+	payment.CommissionUSD = roundCents(math.Max(0, payment.CommissionUSD-fromCommission))
+	payment.RefundedUSD = roundCents(payment.RefundedUSD + refundUSD)
+	payment.StatusReason = reason
+
+	if payment.Status == PaymentHeld && payment.ReleaseAfter != nil && payment.RefundedUSD < payment.AmountUSD {
+		return payment
+	}
+	now := time.Now()
+	payment.Status = settledStatus(payment)
+	payment.SettledAt = &now
+	return payment
+}
+
+// settledStatus tells how a payment ends up once its money has moved.
+func settledStatus(payment *EscrowPayment) string {
+	switch {
+	case payment.RefundedUSD == 0:
+		return PaymentReleased
+	case payment.RefundedUSD >= payment.AmountUSD:
+		return PaymentRefunded
+	}
+	return PaymentPartiallyRefunded
+}
+
+// refundableUSD is the part of a payment that has not been refunded yet.
+func refundableUSD(payment *EscrowPayment) float64 {
+	if payment == nil {
+		return 0
+	}
+	return roundCents(payment.AmountUSD - payment.RefundedUSD)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSettlePayment(t *testing.T) {
+	releaseAfter := time.Now().Add(disputeWindow)
+
+	tests := []struct {
+		name        string
+		payment     EscrowPayment
+		refundUSD   float64
+		status      string
+		payoutUSD   float64
+		commission  float64
+		refundedUSD float64
+		wantSettled bool
+	}{
+		{
+			name:    "no refund releases the payout",
+			payment: EscrowPayment{AmountUSD: 20, TravelerPayoutUSD: 18, CommissionUSD: 2, Status: PaymentHeld},
+			status:  PaymentReleased, payoutUSD: 18, commission: 2, wantSettled: true,
+		},
+		{
+			name:      "partial refund from the payout",
+			payment:   EscrowPayment{AmountUSD: 20, TravelerPayoutUSD: 18, CommissionUSD: 2, Status: PaymentHeld},
+			refundUSD: 5,
+			status:    PaymentPartiallyRefunded, payoutUSD: 13, commission: 2, refundedUSD: 5, wantSettled: true,
+		},
+		{
+			name:      "refund beyond the payout takes the commission",
+			payment:   EscrowPayment{AmountUSD: 20, TravelerPayoutUSD: 18, CommissionUSD: 2, Status: PaymentHeld},
+			refundUSD: 19,
+			status:    PaymentPartiallyRefunded, payoutUSD: 0, commission: 1, refundedUSD: 19, wantSettled: true,
+		},
+		{
+			name:      "full refund",
+			payment:   EscrowPayment{AmountUSD: 20, TravelerPayoutUSD: 18, CommissionUSD: 2, Status: PaymentHeld},
+			refundUSD: 20,
+			status:    PaymentRefunded, refundedUSD: 20, wantSettled: true,
+		},
+		{
+			name:      "refund capped at the amount",
+			payment:   EscrowPayment{AmountUSD: 20, TravelerPayoutUSD: 18, CommissionUSD: 2, Status: PaymentHeld},
+			refundUSD: 30,
+			status:    PaymentRefunded, refundedUSD: 20, wantSettled: true,
+		},
+		{
+			name:      "negative refund is ignored",
+			payment:   EscrowPayment{AmountUSD: 20, TravelerPayoutUSD: 18, CommissionUSD: 2, Status: PaymentHeld},
+			refundUSD: -5,
+			status:    PaymentReleased, payoutUSD: 18, commission: 2, wantSettled: true,
+		},
+		{
+			name:      "held for the claim window stays held",
+			payment:   EscrowPayment{AmountUSD: 20, TravelerPayoutUSD: 18, CommissionUSD: 2, Status: PaymentHeld, ReleaseAfter: &releaseAfter},
+			refundUSD: 4,
+			status:    PaymentHeld, payoutUSD: 14, commission: 2, refundedUSD: 4,
+		},
+		{
+			name:      "full refund in the claim window settles",
+			payment:   EscrowPayment{AmountUSD: 20, TravelerPayoutUSD: 18, CommissionUSD: 2, Status: PaymentHeld, ReleaseAfter: &releaseAfter},
+			refundUSD: 20,
+			status:    PaymentRefunded, refundedUSD: 20, wantSettled: true,
+		},
+		{
+			name:      "released payment is refunded by the platform",
+			payment:   EscrowPayment{AmountUSD: 20, TravelerPayoutUSD: 18, CommissionUSD: 2, Status: PaymentReleased},
+			refundUSD: 5,
+			status:    PaymentPartiallyRefunded, payoutUSD: 13, commission: 2, refundedUSD: 5, wantSettled: true,
+		},
+		{
+			name:      "refunds accumulate",
+			payment:   EscrowPayment{AmountUSD: 20, TravelerPayoutUSD: 13, CommissionUSD: 2, RefundedUSD: 5, Status: PaymentPartiallyRefunded},
+			refundUSD: 20,
+			status:    PaymentRefunded, refundedUSD: 20, wantSettled: true,
+		},
+		{
+			name:      "voided payment is left alone",
+			payment:   EscrowPayment{AmountUSD: 20, RefundedUSD: 20, Status: PaymentVoided},
+			refundUSD: 5,
+			status:    PaymentVoided, refundedUSD: 20,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payment := tt.payment
+			payment.ShipmentID = "settle-test"
+			payments[payment.ShipmentID] = &payment
+			defer delete(payments, payment.ShipmentID)
+
+			settled := settlePayment(payment.ShipmentID, tt.refundUSD, "TEST")
+			if settled.Status != tt.status || settled.TravelerPayoutUSD != tt.payoutUSD || settled.CommissionUSD != tt.commission || settled.RefundedUSD != tt.refundedUSD {
+				t.Errorf("%s payout %.2f commission %.2f refunded %.2f, want %s %.2f %.2f %.2f",
+					settled.Status, settled.TravelerPayoutUSD, settled.CommissionUSD, settled.RefundedUSD,
+					tt.status, tt.payoutUSD, tt.commission, tt.refundedUSD)
+			}
+			if (settled.SettledAt != nil) != tt.wantSettled {
+				t.Errorf("settled at %v, want settled %v", settled.SettledAt, tt.wantSettled)
+			}
+		})
+	}
+
+	if settlePayment("no-such-shipment", 5, "TEST") != nil {
+		t.Error("settling a shipment without payment returned a payment")
+	}
+}
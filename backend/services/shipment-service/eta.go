@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Where an ETA comes from, from most to least reliable.
+const (
+	ETASourceDelivered = "DELIVERED"
+	ETASourceLocation  = "LOCATION"
+	ETASourceTrip      = "TRIP"
+	ETASourcePromised  = "PROMISED"
+)
+
+const (
+	// Straight-line distances are this much shorter than the road
+	roadDetourFactor = 1.3
+	// Travel speed assumed when the pings do not tell, clamped to
+	// minTravelKmh..maxTravelKmh when they do
+	defaultTravelKmh = 70
+	minTravelKmh     = 20
+	maxTravelKmh     = 110
+	// Pings within this window before the latest one measure the speed
+	speedSampleWindow = 2 * time.Hour
+	// How often the delay monitor re-evaluates shipments on their way
+	delayCheckInterval = 5 * time.Minute
+)
+
+// delayThreshold is read from ETA_DELAY_THRESHOLD_HOURS, defaulting to 2
+// hours. A shipment is flagged once its ETA slips past the promised date
+// by more than that, and cleared again below half of it, so an ETA
+// hovering around the threshold does not flap.
+var delayThreshold = delayThresholdFromEnv()
+
+func delayThresholdFromEnv() time.Duration {
+	if hours, err := strconv.ParseFloat(os.Getenv("ETA_DELAY_THRESHOLD_HOURS"), 64); err == nil && hours > 0 {
+		return time.Duration(hours * float64(time.Hour))
+	}
+	return 2 * time.Hour
+}
+
+// etaStatuses are the statuses in which a shipment is on its way to the
+// recipient, so its ETA can still change.
+var etaStatuses = map[string]bool{
+	"ACCEPTED":    true,
+	"HANDED_OVER": true,
+	"IN_TRANSIT":  true,
+}
+
+// DeliveryETA is the current arrival estimate of a shipment. Confidence
+// runs from 0 to 1, Earliest and Latest bound the estimate.
+type DeliveryETA struct {
+	ShipmentID          string     `json:"shipment_id"`
+	Status              string     `json:"status"`
+	EstimatedArrival    time.Time  `json:"estimated_arrival"`
+	Earliest            time.Time  `json:"earliest"`
+	Latest              time.Time  `json:"latest"`
+	Confidence          float64    `json:"confidence"`
+	Source              string     `json:"source"`
+	RemainingKm         *float64   `json:"remaining_km,omitempty"`
+	SpeedKmh            float64    `json:"speed_kmh,omitempty"`
+	LastPingAt          *time.Time `json:"last_ping_at,omitempty"`
+	PromisedDate        *time.Time `json:"promised_date,omitempty"`
+	SlippageHours       float64    `json:"slippage_hours"`
+	Delayed             bool       `json:"delayed"`
+	DelayedSince        *time.Time `json:"delayed_since,omitempty"`
+	DelayThresholdHours float64    `json:"delay_threshold_hours"`
+	ComputedAt          time.Time  `json:"computed_at"`
+}
+
+// computeETA estimates the arrival from the latest location ping if the
+// destination is geocoded, else from the arrival window of the traveler's
+// trip, else it can only repeat the promised date.
+func computeETA(shipment Shipment, now time.Time) DeliveryETA {
+	eta := DeliveryETA{
+		ShipmentID:          shipment.ID,
+		Status:              shipment.Status,
+		Delayed:             shipment.Delayed,
+		DelayedSince:        shipment.DelayedSince,
+		DelayThresholdHours: delayThreshold.Hours(),
+		ComputedAt:          now,
+	}
+	if !shipment.EstimatedDeliveryDate.IsZero() {
+		promised := shipment.EstimatedDeliveryDate
+		eta.PromisedDate = &promised
+	}
+
+	trip, hasTrip := trips[shipment.TripID]
+	ping, hasPing := locations.latest(shipment.ID)
+	destination := shipment.Destination
+	switch {
+	case shipment.DeliveredAt != nil:
+		eta.Source = ETASourceDelivered
+		eta.EstimatedArrival = *shipment.DeliveredAt
+		eta.Earliest, eta.Latest = eta.EstimatedArrival, eta.EstimatedArrival
+		eta.Confidence = 1
+
+	case hasPing && destination != nil && (destination.Lat != 0 || destination.Lng != 0):
+		remaining := roadDetourFactor * haversineKm(GeoPoint{Lat: ping.Lat, Lng: ping.Lng}, GeoPoint{Lat: destination.Lat, Lng: destination.Lng})
+		remaining = math.Round(remaining*10) / 10
+		speed := travelSpeed(locations.history(shipment.ID, nil))
+		travel := time.Duration(remaining / speed * float64(time.Hour))
+		lastPingAt := ping.Timestamp
+		eta.Source = ETASourceLocation
+		eta.RemainingKm = &remaining
+		eta.SpeedKmh = math.Round(speed*10) / 10
+		eta.LastPingAt = &lastPingAt
+		// The arrival predicted at an old ping may already have passed
+		eta.EstimatedArrival = maxTime(ping.Timestamp.Add(travel), now)
+		// A stale ping and a long way to go both widen the estimate
+		age := now.Sub(ping.Timestamp)
+		spread := travel/5 + age/2 + 15*time.Minute
+		eta.Earliest = maxTime(eta.EstimatedArrival.Add(-spread), now)
+		eta.Latest = eta.EstimatedArrival.Add(spread)
+		eta.Confidence = 0.9 - 0.1*age.Hours() - 0.02*travel.Hours()
+
+	case hasTrip:
+		eta.Source = ETASourceTrip
+		window := trip.ArrivalTo.Sub(trip.ArrivalFrom)
+		eta.EstimatedArrival = trip.ArrivalFrom.Add(window / 2)
+		eta.Earliest, eta.Latest = trip.ArrivalFrom, trip.ArrivalTo
+		eta.Confidence = 0.7 - 0.02*window.Hours()
+		if now.After(trip.ArrivalTo) {
+			// The window passed without a delivery, nothing is known
+			// beyond the parcel being late
+			eta.EstimatedArrival = now.Add(window / 2)
+			eta.Earliest, eta.Latest = now, now.Add(window)
+			eta.Confidence = 0.2
+		}
+
+	default:
+		eta.Source = ETASourcePromised
+		eta.EstimatedArrival = maxTime(shipment.EstimatedDeliveryDate, now)
+		eta.Earliest, eta.Latest = eta.EstimatedArrival, eta.EstimatedArrival.Add(24*time.Hour)
+		eta.Confidence = 0.3
+	}
+
+	eta.Confidence = math.Round(math.Max(0.1, math.Min(1, eta.Confidence))*100) / 100
+	if eta.PromisedDate != nil {
+		eta.SlippageHours = math.Round(eta.EstimatedArrival.Sub(*eta.PromisedDate).Hours()*10) / 10
+	}
+	return eta
+}
+
+// travelSpeed averages the speed between the pings of the last
+// speedSampleWindow. A parked traveler shows zero speed, so the result is
+// clamped instead of predicting that the parcel never arrives.
+func travelSpeed(history []LocationPing) float64 {
+	if len(history) < 2 {
+		return defaultTravelKmh
+	}
+	last := history[len(history)-1]
+	km, hours := 0.0, 0.0
+	for i := len(history) - 1; i > 0; i-- {
+		if last.Timestamp.Sub(history[i-1].Timestamp) > speedSampleWindow {
+			break
+		}
+		km += haversineKm(GeoPoint{Lat: history[i-1].Lat, Lng: history[i-1].Lng}, GeoPoint{Lat: history[i].Lat, Lng: history[i].Lng})
+		hours += history[i].Timestamp.Sub(history[i-1].Timestamp).Hours()
+	}
+	if hours < 0.1 {
+		return defaultTravelKmh
+	}
+	return math.Max(minTravelKmh, math.Min(maxTravelKmh, roadDetourFactor*km/hours))
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// runDelayMonitor re-evaluates the DELAYED flag of every shipment on its
+// way, so the events fire even if nobody reads the shipment. Location
+// uploads refresh their shipment right away.
+func runDelayMonitor() {
+	for {
+		time.Sleep(delayCheckInterval)
+
+		storeMu.Lock()
+		for shipmentID, shipment := range shipments {
+			if etaStatuses[shipment.Status] {
+				refreshDelay(shipmentID)
+			}
+		}
+		storeMu.Unlock()
+	}
+}
+
+// refreshDelay recomputes the ETA of a shipment on its way and raises or
+// clears the DELAYED flag.
+func refreshDelay(shipmentID string) {
+	shipment, exists := shipments[shipmentID]
+	if !exists || !etaStatuses[shipment.Status] || shipment.EstimatedDeliveryDate.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	eta := computeETA(shipment, now)
+	slippage := time.Duration(eta.SlippageHours * float64(time.Hour))
+	promised := shipment.EstimatedDeliveryDate
+	data := ShipmentEventData{ETA: &eta.EstimatedArrival, PromisedDate: &promised, SlippageHours: eta.SlippageHours, ETASource: eta.Source}
+	switch {
+	case !shipment.Delayed && slippage > delayThreshold:
+		shipment.Delayed = true
+		shipment.DelayedSince = &now
+		saveShipmentWithEvent(shipment, EventShipmentDelayed, data)
+	case shipment.Delayed && slippage < delayThreshold/2:
+		shipment.Delayed = false
+		shipment.DelayedSince = nil
+		saveShipmentWithEvent(shipment, EventShipmentBackOnSchedule, data)
+	}
+}
+
+// etaForRole returns the ETA as the given role may see it. The remaining
+// distance, speed and ping time would locate the traveler more precisely
+// than coarse location sharing allows the sender to.
+func etaForRole(eta DeliveryETA, role, mode string) DeliveryETA {
+	if role == roleSender && mode == LocationCoarse {
+		eta.RemainingKm = nil
+		eta.SpeedKmh = 0
+		eta.LastPingAt = nil
+	}
+	return eta
+}
+
+// shipmentETAHandler returns the current ETA of a shipment to its sender
+// or traveler (GET ?user_id=).
+func shipmentETAHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+	role := shipmentRole(shipment, r.URL.Query().Get("user_id"))
+	if role == "" {
+		http.Error(w, "Only sender or traveler can see the shipment's ETA", http.StatusForbidden)
+		return
+	}
+	if !etaStatuses[shipment.Status] && shipment.DeliveredAt == nil {
+		http.Error(w, "Shipment in status "+shipment.Status+" is not on its way", http.StatusConflict)
+		return
+	}
+
+	eta := etaForRole(computeETA(shipment, time.Now()), role, locations.privacyMode(shipmentID))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(eta)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventShipmentPosted    = "ShipmentPosted"
+	EventBidPlaced         = "BidPlaced"
+	EventShipmentAccepted  = "ShipmentAccepted"
+	EventShipmentDelivered = "ShipmentDelivered"
+	EventShipmentCancelled = "ShipmentCancelled"
+	// Any other status transition, e.g. HANDED_OVER or IN_TRANSIT
+	EventShipmentStatusChanged = "ShipmentStatusChanged"
+	// The sender changed recipient or item details of a posted shipment
+	EventShipmentUpdated = "ShipmentUpdated"
+	// The ETA slipped past the promised date, or recovered
+	EventShipmentDelayed        = "ShipmentDelayed"
+	EventShipmentBackOnSchedule = "ShipmentBackOnSchedule"
+	// A dispute was opened, or decided and the payment settled
+	EventDisputeOpened   = "DisputeOpened"
+	EventDisputeResolved = "DisputeResolved"
+
+	OutboxPending   = "PENDING"
+	OutboxPublished = "PUBLISHED"
+
+	defaultShipmentEventsTopic = "shipment-events"
+)
+
+// DomainEvent is the envelope published for every shipment state change
+// (spec 4.3). Consumers deduplicate on ID, because delivery is
+// at-least-once.
+type DomainEvent struct {
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	AggregateID string            `json:"aggregate_id"`
+	Version     int               `json:"version"`
+	OccurredAt  time.Time         `json:"occurred_at"`
+	Data        ShipmentEventData `json:"data"`
+}
+
+// ShipmentEventData carries the participants of the shipment, so consumers
+// such as user-service do not need to call back into shipment-service.
+type ShipmentEventData struct {
+	ShipmentID      string     `json:"shipment_id"`
+	SenderID        string     `json:"sender_id"`
+	TravelerID      string     `json:"traveler_id,omitempty"`
+	Status          string     `json:"status"`
+	PreviousStatus  string     `json:"previous_status,omitempty"`
+	FromLocation    string     `json:"from_location,omitempty"`
+	ToLocation      string     `json:"to_location,omitempty"`
+	AgreedFeeUSD    float64    `json:"agreed_fee_usd,omitempty"`
+	BidID           string     `json:"bid_id,omitempty"`
+	BidderID        string     `json:"bidder_id,omitempty"`
+	BidPriceUSD     float64    `json:"bid_price_usd,omitempty"`
+	CancelledBy     string     `json:"cancelled_by,omitempty"`
+	CancelledByRole string     `json:"cancelled_by_role,omitempty"`
+	Reason          string     `json:"reason,omitempty"`
+	Reopened        bool       `json:"reopened,omitempty"`
+	ETA             *time.Time `json:"eta,omitempty"`
+	ETASource       string     `json:"eta_source,omitempty"`
+	PromisedDate    *time.Time `json:"promised_date,omitempty"`
+	SlippageHours   float64    `json:"slippage_hours,omitempty"`
+	DisputeID       string     `json:"dispute_id,omitempty"`
+	Outcome         string     `json:"outcome,omitempty"`
+	RefundUSD       float64    `json:"refund_usd,omitempty"`
+}
+
+// OutboxEntry is a domain event waiting to be published by the relay.
+type OutboxEntry struct {
+	Event       DomainEvent `json:"event"`
+	Topic       string      `json:"topic"`
+	Status      string      `json:"status"`
+	Attempts    int         `json:"attempts"`
+	LastError   string      `json:"last_error,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+	PublishedAt *time.Time  `json:"published_at,omitempty"`
+}
+
+// eventOutbox is the transactional outbox. Shipments and their events are
+// written under the same lock, the in-memory equivalent of inserting the
+// outbox row in the same database transaction as the state change.
+type eventOutbox struct {
+	mu      sync.Mutex
+	entries []*OutboxEntry
+	topic   string
+}
+
+var outbox = newEventOutbox(os.Getenv("SHIPMENT_EVENTS_TOPIC"))
+
+func newEventOutbox(topic string) *eventOutbox {
+	if topic == "" {
+		topic = defaultShipmentEventsTopic
+	}
+	return &eventOutbox{topic: topic}
+}
+
+// saveShipmentWithEvent stores the shipment and appends its domain event
+// atomically, so an event is never lost or published for a state change
+// that was not stored.
+func saveShipmentWithEvent(shipment Shipment, eventType string, data ShipmentEventData) DomainEvent {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+
+	if previous, exists := shipments[shipment.ID]; !exists || previous.Status != shipment.Status {
+		recordStatusChange(shipment)
+	}
+	shipments[shipment.ID] = shipment
+	return outbox.appendLocked(eventType, shipment, data)
+}
+
+// recordShipmentEvent appends an event that has no shipment change of its
+// own, such as a bid.
+func recordShipmentEvent(shipment Shipment, eventType string, data ShipmentEventData) DomainEvent {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+
+	return outbox.appendLocked(eventType, shipment, data)
+}
+
+func (o *eventOutbox) appendLocked(eventType string, shipment Shipment, data ShipmentEventData) DomainEvent {
+	data.ShipmentID = shipment.ID
+	data.SenderID = shipment.SenderID
+	if shipment.TravelerID != nil && data.TravelerID == "" {
+		data.TravelerID = *shipment.TravelerID
+	}
+	data.Status = shipment.Status
+
+	event := DomainEvent{
+		ID:          newEventID(),
+		Type:        eventType,
+		AggregateID: shipment.ID,
+		Version:     1,
+		OccurredAt:  time.Now(),
+		Data:        data,
+	}
+	o.entries = append(o.entries, &OutboxEntry{
+		Event:     event,
+		Topic:     o.topic,
+		Status:    OutboxPending,
+		CreatedAt: event.OccurredAt,
+	})
+	webhooks.enqueue(event)
+	return event
+}
+
+// pending returns the entries the relay still has to publish, oldest first.
+func (o *eventOutbox) pending() []*OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	list := []*OutboxEntry{}
+	for _, entry := range o.entries {
+		if entry.Status == OutboxPending {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+func (o *eventOutbox) markPublished(entry *OutboxEntry) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	entry.Attempts++
+	entry.Status = OutboxPublished
+	entry.LastError = ""
+	entry.PublishedAt = &now
+}
+
+func (o *eventOutbox) markFailed(entry *OutboxEntry, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entry.Attempts++
+	entry.LastError = err.Error()
+}
+
+func (o *eventOutbox) snapshot(status string) []OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	list := []OutboxEntry{}
+	for _, entry := range o.entries {
+		if status == "" || entry.Status == status {
+			list = append(list, *entry)
+		}
+	}
+	return list
+}
+
+// outboxRelay publishes pending outbox entries to the broker. An entry is
+// only marked as published once the broker acknowledged it; a crash in
+// between publishes it again, which gives at-least-once delivery.
+type outboxRelay struct {
+	outbox   *eventOutbox
+	broker   Broker
+	interval time.Duration
+}
+
+func newOutboxRelay(o *eventOutbox, broker Broker) *outboxRelay {
+	interval := 2 * time.Second
+	if seconds, err := strconv.Atoi(os.Getenv("OUTBOX_RELAY_INTERVAL_SECONDS")); err == nil && seconds > 0 {
+		interval = time.Duration(seconds) * time.Second
+	}
+	return &outboxRelay{outbox: o, broker: broker, interval: interval}
+}
+
+func (r *outboxRelay) Run() {
+	log.Printf("📤 Outbox relay publishing to %s every %s", r.broker.Name(), r.interval)
+	for {
+		r.publishPending()
+		time.Sleep(r.interval)
+	}
+}
+
+// publishPending publishes in creation order and stops at the first failure,
+// so events of a shipment are not overtaken by later ones.
+func (r *outboxRelay) publishPending() {
+	for _, entry := range r.outbox.pending() {
+		if err := r.broker.Publish(entry.Topic, entry.Event); err != nil {
+			log.Printf("publishing event %s (%s) failed: %v", entry.Event.ID, entry.Event.Type, err)
+			r.outbox.markFailed(entry, err)
+			return
+		}
+		r.outbox.markPublished(entry)
+	}
+}
+
+// outboxHandler lets operators inspect the outbox, optionally filtered by
+// ?status=PENDING|PUBLISHED.
+func outboxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	entries := outbox.snapshot(strings.ToUpper(r.URL.Query().Get("status")))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": entries,
+		"total":   len(entries),
+	})
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "evt-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	return "evt-" + hex.EncodeToString(b)
+}
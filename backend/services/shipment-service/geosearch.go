@@ -0,0 +1,582 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bringee.com/listing"
+)
+
+const (
+	earthRadiusKm   = 6371.0
+	kmPerDegreeLat  = 111.32
+	geoCellSizeDeg  = 0.25
+	defaultRadiusKm = 25.0
+	maxRadiusKm     = 500.0
+	defaultWidthKm  = 10.0
+	maxWidthKm      = 100.0
+	maxRoutePoints  = 500
+	defaultPageSize = 20
+)
+
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// GeoRadius matches points within RadiusKm of the centre.
+type GeoRadius struct {
+	GeoPoint
+	RadiusKm float64 `json:"radius_km"`
+}
+
+// GeoCorridor matches points within WidthKm of a route polyline.
+type GeoCorridor struct {
+	Points  []GeoPoint `json:"points"`
+	WidthKm float64    `json:"width_km"`
+}
+
+// ShipmentSearchQuery selects shipments by pickup radius or by a corridor
+// around a route. With a corridor, pickup and drop-off must both lie in it
+// and in the direction of travel.
+type ShipmentSearchQuery struct {
+	Pickup   *GeoRadius   `json:"pickup,omitempty"`
+	Dropoff  *GeoRadius   `json:"dropoff,omitempty"`
+	Corridor *GeoCorridor `json:"corridor,omitempty"`
+	Status   string       `json:"status"`
+	Limit    int          `json:"limit"`
+	Offset   int          `json:"offset"`
+}
+
+type ShipmentSearchHit struct {
+	ShipmentID        string   `json:"shipment_id"`
+	PickupDistanceKm  float64  `json:"pickup_distance_km"`
+	DropoffDistanceKm *float64 `json:"dropoff_distance_km,omitempty"`
+}
+
+type ShipmentSearchResult struct {
+	Shipment          Shipment `json:"shipment"`
+	PickupDistanceKm  float64  `json:"pickup_distance_km"`
+	DropoffDistanceKm *float64 `json:"dropoff_distance_km,omitempty"`
+}
+
+// ShipmentSearcher runs geo queries and returns one page of hits, ordered
+// by distance, together with the total number of hits.
+type ShipmentSearcher interface {
+	Name() string
+	Search(query ShipmentSearchQuery) ([]ShipmentSearchHit, int, error)
+}
+
+var shipmentGeoIndex = newGridIndex()
+
+var shipmentSearcher ShipmentSearcher = newShipmentSearcher(os.Getenv("SHIPMENT_SEARCH_BACKEND"))
+
+func newShipmentSearcher(name string) ShipmentSearcher {
+	switch strings.ToLower(name) {
+	case "", "memory":
+		return memoryShipmentSearcher{index: shipmentGeoIndex}
+	case "postgis":
+		// The PostgreSQL driver is registered by the build that persists
+		// shipments; without it sql.Open fails and we stay in memory
+		db, err := sql.Open(os.Getenv("DATABASE_DRIVER"), os.Getenv("DATABASE_URL"))
+		if err == nil {
+			return postgisShipmentSearcher{db: db}
+		}
+		log.Printf("⚠️ PostGIS search unavailable (%v), falling back to in-memory search", err)
+		return memoryShipmentSearcher{index: shipmentGeoIndex}
+	default:
+		log.Printf("⚠️ Unknown shipment search backend %q, falling back to in-memory search", name)
+		return memoryShipmentSearcher{index: shipmentGeoIndex}
+	}
+}
+
+// gridIndex is an in-memory spatial index of pickup points, bucketed into
+// cells of geoCellSizeDeg degrees. Queries only look at the cells covering
+// their bounding box.
+type gridIndex struct {
+	mu     sync.RWMutex
+	cells  map[[2]int]map[string]GeoPoint
+	points map[string]GeoPoint
+}
+
+func newGridIndex() *gridIndex {
+	return &gridIndex{
+		cells:  make(map[[2]int]map[string]GeoPoint),
+		points: make(map[string]GeoPoint),
+	}
+}
+
+func geoCell(p GeoPoint) [2]int {
+	return [2]int{int(math.Floor(p.Lat / geoCellSizeDeg)), int(math.Floor(p.Lng / geoCellSizeDeg))}
+}
+
+func (g *gridIndex) Put(id string, p GeoPoint) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.deleteLocked(id)
+	cell := geoCell(p)
+	if g.cells[cell] == nil {
+		g.cells[cell] = make(map[string]GeoPoint)
+	}
+	g.cells[cell][id] = p
+	g.points[id] = p
+}
+
+func (g *gridIndex) Delete(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.deleteLocked(id)
+}
+
+func (g *gridIndex) deleteLocked(id string) {
+	if p, exists := g.points[id]; exists {
+		delete(g.cells[geoCell(p)], id)
+		delete(g.points, id)
+	}
+}
+
+// InBox returns the indexed points inside the bounding box.
+func (g *gridIndex) InBox(minLat, minLng, maxLat, maxLng float64) map[string]GeoPoint {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	found := make(map[string]GeoPoint)
+	low, high := geoCell(GeoPoint{minLat, minLng}), geoCell(GeoPoint{maxLat, maxLng})
+	for row := low[0]; row <= high[0]; row++ {
+		for col := low[1]; col <= high[1]; col++ {
+			for id, p := range g.cells[[2]int{row, col}] {
+				if p.Lat >= minLat && p.Lat <= maxLat && p.Lng >= minLng && p.Lng <= maxLng {
+					found[id] = p
+				}
+			}
+		}
+	}
+	return found
+}
+
+// indexShipment adds the pickup of a shipment to the spatial index.
+func indexShipment(shipment Shipment) {
+	if shipment.Origin.hasCoordinates() {
+		shipmentGeoIndex.Put(shipment.ID, GeoPoint{shipment.Origin.Lat, shipment.Origin.Lng})
+	}
+}
+
+// memoryShipmentSearcher answers queries from the grid index and the
+// shipments map.
+type memoryShipmentSearcher struct {
+	index *gridIndex
+}
+
+func (memoryShipmentSearcher) Name() string {
+	return "memory"
+}
+
+func (s memoryShipmentSearcher) Search(query ShipmentSearchQuery) ([]ShipmentSearchHit, int, error) {
+	type scored struct {
+		hit   ShipmentSearchHit
+		score float64
+	}
+	matches := []scored{}
+
+	var candidates map[string]GeoPoint
+	if query.Corridor != nil {
+		minLat, minLng, maxLat, maxLng := routeBounds(query.Corridor.Points)
+		dLat, dLng := kmToDegrees(query.Corridor.WidthKm, math.Max(math.Abs(minLat), math.Abs(maxLat)))
+		candidates = s.index.InBox(minLat-dLat, minLng-dLng, maxLat+dLat, maxLng+dLng)
+	} else {
+		dLat, dLng := kmToDegrees(query.Pickup.RadiusKm, query.Pickup.Lat)
+		candidates = s.index.InBox(query.Pickup.Lat-dLat, query.Pickup.Lng-dLng, query.Pickup.Lat+dLat, query.Pickup.Lng+dLng)
+	}
+
+	for id, pickup := range candidates {
+		shipment, exists := shipments[id]
+		if !exists || shipment.Status != query.Status {
+			continue
+		}
+		hit := ShipmentSearchHit{ShipmentID: id}
+		var dropoff *GeoPoint
+		if shipment.Destination.hasCoordinates() {
+			dropoff = &GeoPoint{shipment.Destination.Lat, shipment.Destination.Lng}
+		}
+
+		if query.Corridor != nil {
+			pickupKm, pickupAlong := distanceToRoute(query.Corridor.Points, pickup)
+			if dropoff == nil || pickupKm > query.Corridor.WidthKm {
+				continue
+			}
+			dropoffKm, dropoffAlong := distanceToRoute(query.Corridor.Points, *dropoff)
+			// The drop-off has to come after the pickup along the route
+			if dropoffKm > query.Corridor.WidthKm || dropoffAlong <= pickupAlong {
+				continue
+			}
+			hit.PickupDistanceKm, hit.DropoffDistanceKm = pickupKm, &dropoffKm
+		}
+		if query.Pickup != nil {
+			hit.PickupDistanceKm = haversineKm(query.Pickup.GeoPoint, pickup)
+			if hit.PickupDistanceKm > query.Pickup.RadiusKm {
+				continue
+			}
+		}
+		if query.Dropoff != nil {
+			if dropoff == nil {
+				continue
+			}
+			dropoffKm := haversineKm(query.Dropoff.GeoPoint, *dropoff)
+			if dropoffKm > query.Dropoff.RadiusKm {
+				continue
+			}
+			hit.DropoffDistanceKm = &dropoffKm
+		}
+
+		hit.PickupDistanceKm = math.Round(hit.PickupDistanceKm*10) / 10
+		score := hit.PickupDistanceKm
+		if hit.DropoffDistanceKm != nil {
+			rounded := math.Round(*hit.DropoffDistanceKm*10) / 10
+			hit.DropoffDistanceKm = &rounded
+			score += rounded
+		}
+		matches = append(matches, scored{hit: hit, score: score})
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score < matches[j].score
+		}
+		return matches[i].hit.ShipmentID < matches[j].hit.ShipmentID
+	})
+
+	hits := []ShipmentSearchHit{}
+	for i := query.Offset; i < len(matches) && i < query.Offset+query.Limit; i++ {
+		hits = append(hits, matches[i].hit)
+	}
+	return hits, len(matches), nil
+}
+
+// postgisShipmentSearcher runs the same queries against a shipments table
+// with geography columns:
+//
+//	CREATE TABLE shipments (
+//	    id text PRIMARY KEY,
+//	    status text NOT NULL,
+//	    pickup geography(Point, 4326),
+//	    dropoff geography(Point, 4326)
+//	);
+//	CREATE INDEX shipments_pickup_gix ON shipments USING GIST (pickup);
+//	CREATE INDEX shipments_dropoff_gix ON shipments USING GIST (dropoff);
+type postgisShipmentSearcher struct {
+	db *sql.DB
+}
+
+func (postgisShipmentSearcher) Name() string {
+	return "postgis"
+}
+
+func (s postgisShipmentSearcher) Search(query ShipmentSearchQuery) ([]ShipmentSearchHit, int, error) {
+	statement, args := postgisSearchSQL(query)
+	rows, err := s.db.Query(statement, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	hits := []ShipmentSearchHit{}
+	total := 0
+	for rows.Next() {
+		var hit ShipmentSearchHit
+		var dropoffKm sql.NullFloat64
+		if err := rows.Scan(&hit.ShipmentID, &hit.PickupDistanceKm, &dropoffKm, &total); err != nil {
+			return nil, 0, err
+		}
+		if dropoffKm.Valid {
+			hit.DropoffDistanceKm = &dropoffKm.Float64
+		}
+		hits = append(hits, hit)
+	}
+	return hits, total, rows.Err()
+}
+
+// postgisSearchSQL builds the PostGIS equivalent of the in-memory search.
+// ST_DWithin on geography uses the GIST index and metres; ST_MakePoint
+// takes longitude first.
+func postgisSearchSQL(query ShipmentSearchQuery) (string, []interface{}) {
+	args := []interface{}{query.Status}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	pickupKm, dropoffKm := "0", "NULL::float8"
+	where := []string{"s.status = $1"}
+	from := "shipments s"
+
+	if query.Corridor != nil {
+		points := make([]string, len(query.Corridor.Points))
+		for i, p := range query.Corridor.Points {
+			points[i] = fmt.Sprintf("%f %f", p.Lng, p.Lat)
+		}
+		from += ", (SELECT ST_GeomFromText(" + arg("LINESTRING("+strings.Join(points, ", ")+")") + ", 4326) AS line) route"
+		width := arg(query.Corridor.WidthKm * 1000)
+		pickupKm = "ST_Distance(s.pickup, route.line::geography) / 1000"
+		dropoffKm = "ST_Distance(s.dropoff, route.line::geography) / 1000"
+		where = append(where,
+			"ST_DWithin(s.pickup, route.line::geography, "+width+")",
+			"ST_DWithin(s.dropoff, route.line::geography, "+width+")",
+			"ST_LineLocatePoint(route.line, s.pickup::geometry) < ST_LineLocatePoint(route.line, s.dropoff::geometry)")
+	}
+	if query.Pickup != nil {
+		centre := "ST_MakePoint(" + arg(query.Pickup.Lng) + ", " + arg(query.Pickup.Lat) + ")::geography"
+		pickupKm = "ST_Distance(s.pickup, " + centre + ") / 1000"
+		where = append(where, "ST_DWithin(s.pickup, "+centre+", "+arg(query.Pickup.RadiusKm*1000)+")")
+	}
+	if query.Dropoff != nil {
+		centre := "ST_MakePoint(" + arg(query.Dropoff.Lng) + ", " + arg(query.Dropoff.Lat) + ")::geography"
+		dropoffKm = "ST_Distance(s.dropoff, " + centre + ") / 1000"
+		where = append(where, "ST_DWithin(s.dropoff, "+centre+", "+arg(query.Dropoff.RadiusKm*1000)+")")
+	}
+
+	// PostgreSQL only accepts output column names as bare ORDER BY items,
+	// so the distances are repeated in the sum
+	statement := "SELECT s.id, " + pickupKm + " AS pickup_km, " + dropoffKm + " AS dropoff_km, COUNT(*) OVER () AS total" +
+		" FROM " + from +
+		" WHERE " + strings.Join(where, " AND ") +
+		" ORDER BY (" + pickupKm + ") + COALESCE(" + dropoffKm + ", 0), s.id" +
+		" LIMIT " + arg(query.Limit) + " OFFSET " + arg(query.Offset)
+	return statement, args
+}
+
+func haversineKm(a, b GeoPoint) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// distanceToRoute returns the distance of p to the polyline and how far
+// along the route, in km, the closest point lies. Segments are projected
+// onto a local plane, which is accurate enough for corridors of a few
+// dozen kilometres.
+func distanceToRoute(route []GeoPoint, p GeoPoint) (float64, float64) {
+	best, bestAlong, along := math.Inf(1), 0.0, 0.0
+	for i := 0; i+1 < len(route); i++ {
+		a, b := route[i], route[i+1]
+		scale := math.Cos(p.Lat * math.Pi / 180)
+		ax, ay := (a.Lng-p.Lng)*scale*kmPerDegreeLat, (a.Lat-p.Lat)*kmPerDegreeLat
+		bx, by := (b.Lng-p.Lng)*scale*kmPerDegreeLat, (b.Lat-p.Lat)*kmPerDegreeLat
+		dx, dy := bx-ax, by-ay
+		length := math.Hypot(dx, dy)
+
+		t := 0.0
+		if length > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/(length*length)))
+		}
+		if d := math.Hypot(ax+t*dx, ay+t*dy); d < best {
+			best, bestAlong = d, along+t*length
+		}
+		along += length
+	}
+	return best, bestAlong
+}
+
+func routeBounds(route []GeoPoint) (float64, float64, float64, float64) {
+	minLat, minLng, maxLat, maxLng := 90.0, 180.0, -90.0, -180.0
+	for _, p := range route {
+		minLat, maxLat = math.Min(minLat, p.Lat), math.Max(maxLat, p.Lat)
+		minLng, maxLng = math.Min(minLng, p.Lng), math.Max(maxLng, p.Lng)
+	}
+	return minLat, minLng, maxLat, maxLng
+}
+
+// kmToDegrees converts a distance to degrees of latitude and of longitude
+// at the given latitude.
+func kmToDegrees(km, lat float64) (float64, float64) {
+	dLat := km / kmPerDegreeLat
+	cos := math.Cos(math.Min(math.Abs(lat), 89) * math.Pi / 180)
+	return dLat, math.Min(km/(kmPerDegreeLat*cos), 180)
+}
+
+func validGeoPoint(p GeoPoint) bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180
+}
+
+// normalizeSearchQuery applies defaults and limits and rejects queries that
+// would scan the whole index.
+func normalizeSearchQuery(query *ShipmentSearchQuery) error {
+	if query.Pickup == nil && query.Corridor == nil {
+		return fmt.Errorf("pickup or corridor is required")
+	}
+	for _, radius := range []*GeoRadius{query.Pickup, query.Dropoff} {
+		if radius == nil {
+			continue
+		}
+		if radius.RadiusKm == 0 {
+			radius.RadiusKm = defaultRadiusKm
+		}
+		if !validGeoPoint(radius.GeoPoint) || radius.RadiusKm < 0 || radius.RadiusKm > maxRadiusKm {
+			return fmt.Errorf("radius search needs valid coordinates and a radius up to %.0f km", maxRadiusKm)
+		}
+	}
+	if corridor := query.Corridor; corridor != nil {
+		if corridor.WidthKm == 0 {
+			corridor.WidthKm = defaultWidthKm
+		}
+		if len(corridor.Points) < 2 || len(corridor.Points) > maxRoutePoints || corridor.WidthKm < 0 || corridor.WidthKm > maxWidthKm {
+			return fmt.Errorf("corridor needs 2 to %d points and a width up to %.0f km", maxRoutePoints, maxWidthKm)
+		}
+		for _, p := range corridor.Points {
+			if !validGeoPoint(p) {
+				return fmt.Errorf("corridor contains invalid coordinates")
+			}
+		}
+	}
+
+	query.Status = strings.ToUpper(query.Status)
+	if query.Status == "" {
+		query.Status = "POSTED"
+	}
+	if query.Limit <= 0 {
+		query.Limit = defaultPageSize
+	}
+	if query.Limit > listing.MaxPageSize {
+		query.Limit = listing.MaxPageSize
+	}
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+	return nil
+}
+
+// searchQueryFromURL reads a query from GET parameters:
+// pickup=lat,lng&pickup_radius_km=&dropoff=lat,lng&dropoff_radius_km=
+// &route=lat,lng&route=lat,lng&corridor_km=&status=&limit=&offset=, with
+// one route parameter per polyline point
+func searchQueryFromURL(r *http.Request) (ShipmentSearchQuery, error) {
+	values := r.URL.Query()
+	query := ShipmentSearchQuery{Status: values.Get("status")}
+
+	for _, spec := range []struct {
+		name   string
+		target **GeoRadius
+	}{{"pickup", &query.Pickup}, {"dropoff", &query.Dropoff}} {
+		if values.Get(spec.name) == "" {
+			continue
+		}
+		point, err := parseGeoPoint(values.Get(spec.name))
+		if err != nil {
+			return query, err
+		}
+		radius := &GeoRadius{GeoPoint: point}
+		if raw := values.Get(spec.name + "_radius_km"); raw != "" {
+			if radius.RadiusKm, err = strconv.ParseFloat(raw, 64); err != nil {
+				return query, fmt.Errorf("invalid %s_radius_km", spec.name)
+			}
+		}
+		*spec.target = radius
+	}
+
+	if route := values["route"]; len(route) > 0 {
+		corridor := &GeoCorridor{}
+		for _, raw := range route {
+			point, err := parseGeoPoint(raw)
+			if err != nil {
+				return query, err
+			}
+			corridor.Points = append(corridor.Points, point)
+		}
+		if raw := values.Get("corridor_km"); raw != "" {
+			width, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return query, fmt.Errorf("invalid corridor_km")
+			}
+			corridor.WidthKm = width
+		}
+		query.Corridor = corridor
+	}
+
+	for name, target := range map[string]*int{"limit": &query.Limit, "offset": &query.Offset} {
+		if raw := values.Get(name); raw != "" {
+			value, err := strconv.Atoi(raw)
+			if err != nil {
+				return query, fmt.Errorf("invalid %s", name)
+			}
+			*target = value
+		}
+	}
+	return query, nil
+}
+
+func parseGeoPoint(raw string) (GeoPoint, error) {
+	latText, lngText, found := strings.Cut(raw, ",")
+	lat, latErr := strconv.ParseFloat(strings.TrimSpace(latText), 64)
+	lng, lngErr := strconv.ParseFloat(strings.TrimSpace(lngText), 64)
+	if !found || latErr != nil || lngErr != nil {
+		return GeoPoint{}, fmt.Errorf("invalid coordinates %q, expected lat,lng", raw)
+	}
+	return GeoPoint{Lat: lat, Lng: lng}, nil
+}
+
+// shipmentSearchHandler serves GET (query parameters) and POST (JSON body)
+// geo searches over shipments.
+func shipmentSearchHandler(w http.ResponseWriter, r *http.Request) {
+	var query ShipmentSearchQuery
+	switch r.Method {
+	case "GET":
+		var err error
+		if query, err = searchQueryFromURL(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := normalizeSearchQuery(&query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hits, total, err := shipmentSearcher.Search(query)
+	if err != nil {
+		log.Printf("shipment search on %s failed: %v", shipmentSearcher.Name(), err)
+		http.Error(w, "Search failed", http.StatusBadGateway)
+		return
+	}
+
+	results := []ShipmentSearchResult{}
+	for _, hit := range hits {
+		if shipment, exists := shipments[hit.ShipmentID]; exists {
+			results = append(results, ShipmentSearchResult{
+				Shipment:          shipment,
+				PickupDistanceKm:  hit.PickupDistanceKm,
+				DropoffDistanceKm: hit.DropoffDistanceKm,
+			})
+		}
+	}
+	response := map[string]interface{}{
+		"results": results,
+		"total":   total,
+		"limit":   query.Limit,
+		"offset":  query.Offset,
+	}
+	if next := query.Offset + query.Limit; next < total {
+		response["next_offset"] = next
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPostgisSearchSQL(t *testing.T) {
+	berlin := GeoPoint{Lat: 52.52, Lng: 13.405}
+	munich := GeoPoint{Lat: 48.137, Lng: 11.575}
+
+	tests := []struct {
+		name    string
+		query   ShipmentSearchQuery
+		orderBy string
+		args    []interface{}
+	}{
+		{
+			name:    "status only",
+			query:   ShipmentSearchQuery{Status: "POSTED", Limit: 20},
+			orderBy: "(0) + COALESCE(NULL::float8, 0), s.id",
+			args:    []interface{}{"POSTED", 20, 0},
+		},
+		{
+			name:    "pickup radius",
+			query:   ShipmentSearchQuery{Status: "POSTED", Pickup: &GeoRadius{GeoPoint: berlin, RadiusKm: 10}, Limit: 20, Offset: 40},
+			orderBy: "(ST_Distance(s.pickup, ST_MakePoint($2, $3)::geography) / 1000) + COALESCE(NULL::float8, 0), s.id",
+			args:    []interface{}{"POSTED", 13.405, 52.52, 10000.0, 20, 40},
+		},
+		{
+			name: "pickup and drop-off radius",
+			query: ShipmentSearchQuery{
+				Status:  "POSTED",
+				Pickup:  &GeoRadius{GeoPoint: berlin, RadiusKm: 10},
+				Dropoff: &GeoRadius{GeoPoint: munich, RadiusKm: 5},
+				Limit:   20,
+			},
+			orderBy: "(ST_Distance(s.pickup, ST_MakePoint($2, $3)::geography) / 1000) + COALESCE(ST_Distance(s.dropoff, ST_MakePoint($5, $6)::geography) / 1000, 0), s.id",
+			args:    []interface{}{"POSTED", 13.405, 52.52, 10000.0, 11.575, 48.137, 5000.0, 20, 0},
+		},
+		{
+			name: "corridor",
+			query: ShipmentSearchQuery{
+				Status:   "POSTED",
+				Corridor: &GeoCorridor{Points: []GeoPoint{berlin, munich}, WidthKm: 15},
+				Limit:    20,
+			},
+			orderBy: "(ST_Distance(s.pickup, route.line::geography) / 1000) + COALESCE(ST_Distance(s.dropoff, route.line::geography) / 1000, 0), s.id",
+			args:    []interface{}{"POSTED", "LINESTRING(13.405000 52.520000, 11.575000 48.137000)", 15000.0, 20, 0},
+		},
+	}
+
+	placeholder := regexp.MustCompile(`\$(\d+)`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statement, args := postgisSearchSQL(tt.query)
+
+			_, rest, found := strings.Cut(statement, " ORDER BY ")
+			if !found {
+				t.Fatalf("no ORDER BY in %q", statement)
+			}
+			orderBy, _, _ := strings.Cut(rest, " LIMIT ")
+			if orderBy != tt.orderBy {
+				t.Errorf("ORDER BY %q, want %q", orderBy, tt.orderBy)
+			}
+			// Output column names are only valid as bare ORDER BY items
+			for _, alias := range []string{"pickup_km", "dropoff_km"} {
+				if strings.Contains(orderBy, alias) {
+					t.Errorf("ORDER BY uses the alias %s in an expression: %q", alias, orderBy)
+				}
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args %v, want %v", args, tt.args)
+			}
+			for _, match := range placeholder.FindAllStringSubmatch(statement, -1) {
+				if n, _ := strconv.Atoi(match[1]); n < 1 || n > len(args) {
+					t.Errorf("placeholder %s without an argument in %q", match[0], statement)
+				}
+			}
+		})
+	}
+}
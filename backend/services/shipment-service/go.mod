@@ -1,3 +1,7 @@
 module bringee.com/shipment-service
 
 go 1.22
+
+require bringee.com/listing v0.0.0
+
+replace bringee.com/listing => ../../pkg/listing
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	handoverTokenTTL    = 10 * time.Minute
+	handoverTokenLength = 6
+	// No 0/O or 1/I so the code can be read out and typed in manually
+	handoverTokenAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	// After this many wrong tokens the token is void and a new one must be
+	// generated, so the code cannot be guessed within its TTL
+	maxHandoverTokenAttempts = 5
+
+	roleSender   = "sender"
+	roleTraveler = "traveler"
+)
+
+// Handover records the digital handshake at pickup (spec 6.2.1). One party
+// generates a short-lived token, the other confirms it and the traveler
+// acknowledges the inspection. Only then is the shipment HANDED_OVER.
+type Handover struct {
+	ShipmentID                 string     `json:"shipment_id"`
+	Token                      string     `json:"token,omitempty"`
+	QRPayload                  string     `json:"qr_payload,omitempty"`
+	InitiatedBy                string     `json:"initiated_by"`
+	CreatedAt                  time.Time  `json:"created_at"`
+	ExpiresAt                  time.Time  `json:"expires_at"`
+	SenderConfirmedAt          *time.Time `json:"sender_confirmed_at,omitempty"`
+	TravelerConfirmedAt        *time.Time `json:"traveler_confirmed_at,omitempty"`
+	InspectionAcknowledgedAt   *time.Time `json:"inspection_acknowledged_at,omitempty"`
+	ContentWarning             string     `json:"content_warning,omitempty"`
+	ContentWarningAcknowledged bool       `json:"content_warning_acknowledged"`
+	FailedAttempts             int        `json:"failed_attempts"`
+	CompletedAt                *time.Time `json:"completed_at,omitempty"`
+}
+
+type HandoverRequest struct {
+	UserID string `json:"user_id"`
+}
+
+type ConfirmHandoverRequest struct {
+	UserID string `json:"user_id"`
+	Token  string `json:"token"`
+}
+
+type InspectionAcknowledgementRequest struct {
+	UserID                     string `json:"user_id"`
+	ContentWarningAcknowledged bool   `json:"content_warning_acknowledged"`
+}
+
+var handovers = make(map[string]*Handover)
+
+func shipmentHandoverHandler(w http.ResponseWriter, r *http.Request) {
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+
+	step := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/shipments/"+shipmentID+"/handover"), "/")
+	switch step {
+	case "":
+	case "confirm":
+		handoverConfirmHandler(w, r, shipment)
+		return
+	case "inspection":
+		handoverInspectionHandler(w, r, shipment)
+		return
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		handover, exists := handovers[shipmentID]
+		if !exists {
+			http.Error(w, "Handover not started", http.StatusNotFound)
+			return
+		}
+
+		// The token is only shown to the party that generated it
+		view := *handover
+		view.Token = ""
+		view.QRPayload = ""
+		view.ContentWarning = contentWarning(shipmentID)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(view)
+
+	case "POST":
+		var req HandoverRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		role := shipmentRole(shipment, req.UserID)
+		if role == "" {
+			http.Error(w, "Only sender or traveler can start the handover", http.StatusForbidden)
+			return
+		}
+		if shipment.Status != "ACCEPTED" {
+			http.Error(w, "Handover requires an accepted shipment", http.StatusConflict)
+			return
+		}
+
+		token, err := generateCode(handoverTokenLength)
+		if err != nil {
+			http.Error(w, "Could not generate handover token", http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		handover := &Handover{
+			ShipmentID:     shipmentID,
+			Token:          token,
+			QRPayload:      fmt.Sprintf("bringee://handover?shipment=%s&token=%s", shipmentID, token),
+			InitiatedBy:    role,
+			CreatedAt:      now,
+			ExpiresAt:      now.Add(handoverTokenTTL),
+			ContentWarning: contentWarning(shipmentID),
+		}
+		// Regenerating an expired token keeps an inspection already done
+		if previous, exists := handovers[shipmentID]; exists {
+			handover.InspectionAcknowledgedAt = previous.InspectionAcknowledgedAt
+			handover.ContentWarningAcknowledged = previous.ContentWarningAcknowledged
+		}
+		// Generating the token counts as the initiator's confirmation
+		if role == roleSender {
+			handover.SenderConfirmedAt = &now
+		} else {
+			handover.TravelerConfirmedAt = &now
+		}
+		handovers[shipmentID] = handover
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(handover)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handoverConfirmHandler(w http.ResponseWriter, r *http.Request, shipment Shipment) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ConfirmHandoverRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	handover, exists := handovers[shipment.ID]
+	if !exists || handover.CompletedAt != nil || shipment.Status != "ACCEPTED" {
+		http.Error(w, "No open handover for this shipment", http.StatusConflict)
+		return
+	}
+	role := shipmentRole(shipment, req.UserID)
+	if role == "" || role == handover.InitiatedBy {
+		http.Error(w, "Handover must be confirmed by the other party", http.StatusForbidden)
+		return
+	}
+	if time.Now().After(handover.ExpiresAt) {
+		http.Error(w, "Handover token expired", http.StatusGone)
+		return
+	}
+	if handover.FailedAttempts >= maxHandoverTokenAttempts {
+		http.Error(w, "Too many invalid handover tokens, generate a new one", http.StatusTooManyRequests)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.ToUpper(strings.TrimSpace(req.Token))), []byte(handover.Token)) != 1 {
+		handover.FailedAttempts++
+		http.Error(w, "Invalid handover token", http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now()
+	if role == roleSender {
+		handover.SenderConfirmedAt = &now
+	} else {
+		handover.TravelerConfirmedAt = &now
+	}
+	completeHandover(w, shipment, handover)
+}
+
+func handoverInspectionHandler(w http.ResponseWriter, r *http.Request, shipment Shipment) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req InspectionAcknowledgementRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if shipmentRole(shipment, req.UserID) != roleTraveler {
+		http.Error(w, "Only the traveler can acknowledge the inspection", http.StatusForbidden)
+		return
+	}
+
+	handover, exists := handovers[shipment.ID]
+	if !exists || handover.CompletedAt != nil || shipment.Status != "ACCEPTED" {
+		http.Error(w, "No open handover for this shipment", http.StatusConflict)
+		return
+	}
+
+	// A photo warning must be explicitly acknowledged (spec 6.4.3)
+	handover.ContentWarning = contentWarning(shipment.ID)
+	if handover.ContentWarning != "" && !req.ContentWarningAcknowledged {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":           "Content warning must be acknowledged",
+			"content_warning": handover.ContentWarning,
+		})
+		return
+	}
+
+	now := time.Now()
+	handover.InspectionAcknowledgedAt = &now
+	handover.ContentWarningAcknowledged = handover.ContentWarning != ""
+	completeHandover(w, shipment, handover)
+}
+
+// completeHandover moves the shipment to HANDED_OVER once both parties have
+// confirmed and the inspection is acknowledged, then writes the handover.
+func completeHandover(w http.ResponseWriter, shipment Shipment, handover *Handover) {
+	if handover.SenderConfirmedAt != nil && handover.TravelerConfirmedAt != nil && handover.InspectionAcknowledgedAt != nil {
+		now := time.Now()
+		handover.CompletedAt = &now
+		previousStatus := shipment.Status
+		shipment.Status = "HANDED_OVER"
+		shipment.HandedOverAt = &now
+		saveShipmentWithEvent(shipment, EventShipmentStatusChanged, ShipmentEventData{PreviousStatus: previousStatus})
+	}
+
+	view := *handover
+	view.Token = ""
+	view.QRPayload = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
+
+// shipmentRole tells whether a user is the sender or the traveler of a
+// shipment, or neither.
+func shipmentRole(shipment Shipment, userID string) string {
+	switch {
+	case userID == "":
+		return ""
+	case userID == shipment.SenderID:
+		return roleSender
+	case shipment.TravelerID != nil && userID == *shipment.TravelerID:
+		return roleTraveler
+	}
+	return ""
+}
+
+// generateCode returns a random code from handoverTokenAlphabet.
+func generateCode(length int) (string, error) {
+	bytes := make([]byte, length)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	for i, b := range bytes {
+		bytes[i] = handoverTokenAlphabet[int(b)%len(handoverTokenAlphabet)]
+	}
+	return string(bytes), nil
+}
+
+type RefuseInspectionRequest struct {
+	UserID string `json:"user_id"`
+	Notes  string `json:"notes"`
+}
+
+// shipmentRefuseInspectionHandler implements "inspection refused" (spec
+// 6.2.3): the transaction is cancelled at once without consequences for the
+// traveler, any held payment is voided and an incident is recorded on the
+// sender's profile.
+func shipmentRefuseInspectionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RefuseInspectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+	if shipmentRole(shipment, req.UserID) != roleTraveler {
+		http.Error(w, "Only the traveler can refuse a shipment after inspection", http.StatusForbidden)
+		return
+	}
+	if shipment.Status != "ACCEPTED" {
+		http.Error(w, "Inspection can only be refused before the handover", http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	shipment.Status = "CANCELLED"
+	shipment.CancelledAt = &now
+	shipment.CancellationReason = "INSPECTION_REFUSED"
+	cancelInsurance(&shipment)
+	saveShipmentWithEvent(shipment, EventShipmentCancelled, ShipmentEventData{
+		CancelledBy:     req.UserID,
+		CancelledByRole: roleTraveler,
+		Reason:          "INSPECTION_REFUSED",
+	})
+	delete(handovers, shipmentID)
+
+	voidPayment(shipmentID, "INSPECTION_REFUSED")
+
+	if err := userService.RecordIncident(shipment.SenderID, UserIncident{
+		Type:       "INSPECTION_REFUSED",
+		ShipmentID: shipmentID,
+		Notes:      req.Notes,
+		ReportedBy: req.UserID,
+	}); err != nil {
+		log.Printf("recording incident for sender %s failed: %v", shipment.SenderID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shipment)
+}
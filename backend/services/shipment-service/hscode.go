@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// HSCodeCandidate is a tariff code proposed for an item description. The
+// sender confirms one of them before the customs estimate is requested.
+type HSCodeCandidate struct {
+	Code            string   `json:"code"`
+	Description     string   `json:"description"`
+	Confidence      float64  `json:"confidence"`
+	MatchedKeywords []string `json:"matched_keywords"`
+}
+
+type ClassifyItemRequest struct {
+	Description string `json:"description"`
+	Limit       int    `json:"limit"`
+}
+
+// HSCodeClassifier ranks HS codes for a free-text item description. A
+// provider API (Zonos, SimplyDuty) or a Vertex AI model can implement it.
+type HSCodeClassifier interface {
+	Classify(description string, limit int) []HSCodeCandidate
+}
+
+var hsCodeClassifier HSCodeClassifier = newLookupTableClassifier()
+
+const defaultClassifyLimit = 5
+
+type hsCodeEntry struct {
+	Code        string
+	Description string
+	Keywords    []string
+}
+
+// lookupTableClassifier matches description words against German and English
+// keywords of a small tariff table.
+type lookupTableClassifier struct {
+	entries []hsCodeEntry
+}
+
+func newLookupTableClassifier() *lookupTableClassifier {
+	return &lookupTableClassifier{entries: []hsCodeEntry{
+		{"847130", "Tragbare Datenverarbeitungsmaschinen (Laptops, Notebooks, Tablets)", []string{"laptop", "notebook", "tablet", "ipad", "macbook", "computer"}},
+		{"847160", "Ein- und Ausgabeeinheiten (Tastaturen, Mäuse, Drucker)", []string{"tastatur", "keyboard", "maus", "mouse", "drucker", "printer", "monitor"}},
+		{"851712", "Mobiltelefone und Smartphones", []string{"handy", "smartphone", "iphone", "mobiltelefon", "telefon", "phone"}},
+		{"851830", "Kopfhörer und Ohrhörer", []string{"kopfhörer", "headphones", "earbuds", "airpods", "headset"}},
+		{"850760", "Lithium-Ionen-Akkumulatoren", []string{"akku", "lithium", "batterie", "battery", "powerbank"}},
+		{"852580", "Kameras und Videokameras", []string{"kamera", "camera", "fotoapparat", "gopro", "webcam"}},
+		{"854370", "Sonstige elektrische Geräte und Zubehör", []string{"elektronik", "electronics", "zubehör", "accessories", "ladegerät", "charger", "kabel", "cable"}},
+		{"490199", "Bücher, Broschüren und ähnliche Drucke", []string{"buch", "bücher", "book", "books", "broschüre", "magazin"}},
+		{"490700", "Dokumente, Urkunden und Wertpapiere", []string{"dokument", "dokumente", "documents", "unterlagen", "urkunde", "papiere", "vertrag"}},
+		{"610910", "T-Shirts und Unterhemden aus Baumwolle, gewirkt", []string{"t-shirt", "tshirt", "shirt", "unterhemd"}},
+		{"620342", "Hosen aus Baumwolle für Männer", []string{"hose", "jeans", "trousers", "pants"}},
+		{"620442", "Kleider aus Baumwolle für Frauen", []string{"kleid", "dress"}},
+		{"621410", "Schals und Tücher aus Seide", []string{"schal", "tuch", "scarf", "accessoires"}},
+		{"640399", "Schuhe mit Oberteil aus Leder", []string{"schuhe", "schuh", "shoes", "stiefel", "boots", "sneaker"}},
+		{"420221", "Handtaschen mit Außenseite aus Leder", []string{"handtasche", "tasche", "handbag", "bag", "leder", "leather"}},
+		{"711319", "Schmuck aus Edelmetall", []string{"schmuck", "jewelry", "jewellery", "ring", "kette", "necklace", "armband", "gold", "silber"}},
+		{"910211", "Armbanduhren", []string{"uhr", "armbanduhr", "watch"}},
+		{"330300", "Parfüms und Duftwässer", []string{"parfüm", "parfum", "perfume", "duft"}},
+		{"330499", "Kosmetik und Hautpflegemittel", []string{"kosmetik", "cosmetics", "creme", "cream", "makeup", "pflege"}},
+		{"210690", "Lebensmittelzubereitungen", []string{"lebensmittel", "food", "essen", "gewürze", "spices", "süßigkeiten", "sweets"}},
+		{"090111", "Kaffee, nicht geröstet", []string{"kaffee", "coffee"}},
+		{"220421", "Wein in Behältnissen bis 2 l", []string{"wein", "wine"}},
+		{"950300", "Spielzeug", []string{"spielzeug", "toy", "toys", "puppe", "lego"}},
+		{"950450", "Videospielkonsolen und Spiele", []string{"konsole", "console", "playstation", "xbox", "nintendo", "videospiel"}},
+		{"300490", "Arzneimittel in Dosen", []string{"medikament", "medikamente", "medicine", "arznei", "tabletten", "pills"}},
+		{"920290", "Saiteninstrumente", []string{"gitarre", "guitar", "geige", "violin"}},
+	}}
+}
+
+func (c *lookupTableClassifier) Classify(description string, limit int) []HSCodeCandidate {
+	if limit <= 0 {
+		limit = defaultClassifyLimit
+	}
+	words := descriptionWords(description)
+
+	var candidates []HSCodeCandidate
+	for _, entry := range c.entries {
+		var matched []string
+		for _, keyword := range entry.Keywords {
+			if matchesKeyword(words, keyword) {
+				matched = append(matched, keyword)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+
+		// Each further keyword hit makes the candidate more likely, but a
+		// lookup table never reaches full certainty
+		score := float64(len(matched))
+		candidates = append(candidates, HSCodeCandidate{
+			Code:            entry.Code,
+			Description:     entry.Description,
+			Confidence:      math.Round(score/(score+1)*100) / 100,
+			MatchedKeywords: matched,
+		})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Confidence > candidates[j].Confidence
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	return candidates
+}
+
+func hsCodeClassifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ClassifyItemRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Description) == "" {
+		http.Error(w, "Description is required", http.StatusBadRequest)
+		return
+	}
+
+	candidates := hsCodeClassifier.Classify(req.Description, req.Limit)
+	if candidates == nil {
+		candidates = []HSCodeCandidate{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"candidates": candidates,
+		"total":      len(candidates),
+	})
+}
+
+func descriptionWords(description string) []string {
+	return strings.FieldsFunc(strings.ToLower(description), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-'
+	})
+}
+
+// inflectionSuffixes are the plural and case endings a keyword may carry
+// and still count as the same word, e.g. "ring" in "Ringe".
+var inflectionSuffixes = []string{"", "s", "e", "n", "en", "er", "es", "ern"}
+
+// matchesWord reports whether word is keyword with at most an inflection
+// ending, so "tablet" matches "Tablets" but not "Tabletten".
+func matchesWord(word, keyword string) bool {
+	if !strings.HasPrefix(word, keyword) {
+		return false
+	}
+	rest := word[len(keyword):]
+	for _, suffix := range inflectionSuffixes {
+		if rest == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesWholeWord reports whether any of words is keyword, inflected or not.
+func matchesWholeWord(words []string, keyword string) bool {
+	for _, word := range words {
+		if matchesWord(word, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesKeyword matches whole words, and also German compound words ending
+// in the keyword such as "Elektronikzubehör", as long as the keyword is long
+// enough to be specific and follows a word of its own ("ring" is in
+// "Ohrringe" but not in "string").
+func matchesKeyword(words []string, keyword string) bool {
+	for _, word := range words {
+		if matchesWord(word, keyword) {
+			return true
+		}
+		if len([]rune(keyword)) < 4 {
+			continue
+		}
+		for i := range word {
+			if len([]rune(word[:i])) >= 3 && matchesWord(word[i:], keyword) {
+				return true
+			}
+		}
+	}
+	return false
+}
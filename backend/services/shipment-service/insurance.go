@@ -0,0 +1,602 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	InsuranceBasic = "BASIC"
+	InsuranceTopUp = "TOP_UP"
+
+	CoverageQuoted    = "QUOTED"
+	CoverageActive    = "ACTIVE"
+	CoverageCancelled = "CANCELLED"
+
+	InsuranceClaimSubmitted = "SUBMITTED"
+	InsuranceClaimApproved  = "APPROVED"
+	InsuranceClaimRejected  = "REJECTED"
+	InsuranceClaimPaid      = "PAID"
+
+	LossDamage = "DAMAGE"
+	LossLost   = "LOSS"
+)
+
+// InsuranceProduct is a coverage option offered to the sender (spec 6.5.1).
+// The base coverage is included in every shipment, the top-up insures the
+// full declared value up to MaxCoverageUSD.
+type InsuranceProduct struct {
+	ID                 string   `json:"id"`
+	Name               string   `json:"name"`
+	BaseCoverageUSD    float64  `json:"base_coverage_usd"`
+	MaxCoverageUSD     float64  `json:"max_coverage_usd"`
+	TopUpRatePercent   float64  `json:"top_up_rate_percent"`
+	MinPremiumUSD      float64  `json:"min_premium_usd"`
+	DeductibleUSD      float64  `json:"deductible_usd"`
+	ExcludedCategories []string `json:"excluded_categories"`
+}
+
+type InsuranceQuoteRequest struct {
+	Product            string  `json:"product"`
+	DeclaredValueUSD   float64 `json:"declared_value_usd"`
+	ItemCategory       string  `json:"item_category"`
+	OriginCountry      string  `json:"origin_country"`
+	DestinationCountry string  `json:"destination_country"`
+}
+
+// InsuranceCoverage is recorded on the shipment. The policy is issued by the
+// insurer once a traveler accepted the shipment.
+type InsuranceCoverage struct {
+	Product          string     `json:"product"`
+	Insurer          string     `json:"insurer"`
+	Status           string     `json:"status"`
+	PolicyNumber     string     `json:"policy_number,omitempty"`
+	DeclaredValueUSD float64    `json:"declared_value_usd"`
+	CoverageUSD      float64    `json:"coverage_usd"`
+	PremiumUSD       float64    `json:"premium_usd"`
+	DeductibleUSD    float64    `json:"deductible_usd"`
+	Exclusions       []string   `json:"exclusions"`
+	ExclusionReason  string     `json:"exclusion_reason,omitempty"`
+	IssuedAt         *time.Time `json:"issued_at,omitempty"`
+}
+
+// InsuranceClaim is a loss reported to the insurer. It runs through
+// submission, evidence, assessment by the insurer and payout.
+// DeductedUSD was already refunded from escrow by damage claims for the
+// same shipment and is not paid twice.
+type InsuranceClaim struct {
+	ID             string            `json:"id"`
+	ShipmentID     string            `json:"shipment_id"`
+	PolicyNumber   string            `json:"policy_number"`
+	SubmittedBy    string            `json:"submitted_by"`
+	LossType       string            `json:"loss_type"`
+	Description    string            `json:"description"`
+	ClaimedUSD     float64           `json:"claimed_usd"`
+	Status         string            `json:"status"`
+	Evidence       []DisputeEvidence `json:"evidence"`
+	Assessment     *ClaimAssessment  `json:"assessment,omitempty"`
+	PayoutUSD      float64           `json:"payout_usd,omitempty"`
+	PayoutRef      string            `json:"payout_ref,omitempty"`
+	InsurerClaimID string            `json:"insurer_claim_id,omitempty"`
+	DeductedUSD    float64           `json:"deducted_usd,omitempty"`
+	CreatedAt      time.Time         `json:"created_at"`
+	PaidAt         *time.Time        `json:"paid_at,omitempty"`
+}
+
+type ClaimAssessment struct {
+	Approved    bool      `json:"approved"`
+	ApprovedUSD float64   `json:"approved_usd"`
+	Reason      string    `json:"reason"`
+	AssessedBy  string    `json:"assessed_by"`
+	AssessedAt  time.Time `json:"assessed_at"`
+}
+
+type SubmitInsuranceClaimRequest struct {
+	UserID      string  `json:"user_id"`
+	LossType    string  `json:"loss_type"`
+	Description string  `json:"description"`
+	ClaimedUSD  float64 `json:"claimed_usd"`
+}
+
+// Insurer is the adapter every insurance partner implements, so the partner
+// (e.g. Car Concept AG) can be switched by configuration.
+type Insurer interface {
+	Name() string
+	Products() []InsuranceProduct
+	Quote(req InsuranceQuoteRequest) (InsuranceCoverage, error)
+	IssuePolicy(shipment Shipment) (string, error)
+	SubmitClaim(claim InsuranceClaim) (string, error)
+	AssessClaim(claim InsuranceClaim, coverage InsuranceCoverage) (ClaimAssessment, error)
+	PayClaim(claim InsuranceClaim) (string, error)
+}
+
+var insurer Insurer = newInsurer(os.Getenv("INSURER_PROVIDER"))
+
+var insuranceClaims = make(map[string]*InsuranceClaim)
+
+func newInsurer(name string) Insurer {
+	switch strings.ToLower(name) {
+	case "", "local":
+		return newLocalInsurer()
+	default:
+		log.Printf("⚠️ Unknown insurer %q, falling back to local insurer", name)
+		return newLocalInsurer()
+	}
+}
+
+// localInsurer prices and assesses claims from a static product table. It
+// is meant for local development and tests.
+type localInsurer struct {
+	products map[string]InsuranceProduct
+}
+
+func newLocalInsurer() *localInsurer {
+	exclusions := []string{"cash", "jewelry", "perishables"}
+	return &localInsurer{
+		products: map[string]InsuranceProduct{
+			InsuranceBasic: {ID: InsuranceBasic, Name: "Basisschutz", BaseCoverageUSD: 100, MaxCoverageUSD: 100, ExcludedCategories: exclusions},
+			InsuranceTopUp: {ID: InsuranceTopUp, Name: "Höherversicherung", BaseCoverageUSD: 100, MaxCoverageUSD: 2500, TopUpRatePercent: 1.5, MinPremiumUSD: 2, DeductibleUSD: 10, ExcludedCategories: exclusions},
+		},
+	}
+}
+
+func (i *localInsurer) Name() string {
+	return "local"
+}
+
+func (i *localInsurer) Products() []InsuranceProduct {
+	products := []InsuranceProduct{}
+	for _, product := range i.products {
+		products = append(products, product)
+	}
+	sort.Slice(products, func(a, b int) bool { return products[a].MaxCoverageUSD < products[b].MaxCoverageUSD })
+	return products
+}
+
+func (i *localInsurer) Quote(req InsuranceQuoteRequest) (InsuranceCoverage, error) {
+	product, exists := i.products[strings.ToUpper(req.Product)]
+	if !exists {
+		return InsuranceCoverage{}, fmt.Errorf("unknown insurance product %q", req.Product)
+	}
+	if req.DeclaredValueUSD < 0 {
+		return InsuranceCoverage{}, fmt.Errorf("declared value must not be negative")
+	}
+
+	coverage := InsuranceCoverage{
+		Product:          product.ID,
+		Insurer:          i.Name(),
+		Status:           CoverageQuoted,
+		DeclaredValueUSD: roundCents(req.DeclaredValueUSD),
+		CoverageUSD:      math.Min(req.DeclaredValueUSD, product.MaxCoverageUSD),
+		DeductibleUSD:    product.DeductibleUSD,
+		Exclusions:       product.ExcludedCategories,
+	}
+	// Excluded goods are shipped uninsured rather than refused, so the
+	// sender must not pay for coverage that would never pay out
+	for _, category := range product.ExcludedCategories {
+		if req.ItemCategory != "" && strings.EqualFold(category, req.ItemCategory) {
+			coverage.CoverageUSD = 0
+			coverage.ExclusionReason = "Warenkategorie ist vom Versicherungsschutz ausgeschlossen"
+			return coverage, nil
+		}
+	}
+	// Only the value above the included base coverage costs a premium
+	if topUp := coverage.CoverageUSD - product.BaseCoverageUSD; topUp > 0 && product.TopUpRatePercent > 0 {
+		coverage.PremiumUSD = roundCents(math.Max(topUp*product.TopUpRatePercent/100, product.MinPremiumUSD))
+	}
+	coverage.CoverageUSD = roundCents(coverage.CoverageUSD)
+	return coverage, nil
+}
+
+func (i *localInsurer) IssuePolicy(shipment Shipment) (string, error) {
+	suffix, err := generateCode(4)
+	if err != nil {
+		return "", err
+	}
+	return "BRG-" + shipment.ID + "-" + suffix, nil
+}
+
+func (i *localInsurer) SubmitClaim(claim InsuranceClaim) (string, error) {
+	return "LOCAL-" + claim.ID, nil
+}
+
+func (i *localInsurer) AssessClaim(claim InsuranceClaim, coverage InsuranceCoverage) (ClaimAssessment, error) {
+	assessment := ClaimAssessment{AssessedBy: i.Name(), AssessedAt: time.Now()}
+	shipment := shipments[claim.ShipmentID]
+	for _, category := range coverage.Exclusions {
+		if strings.EqualFold(category, shipment.ItemCategory) {
+			assessment.Reason = "Warenkategorie ist vom Versicherungsschutz ausgeschlossen"
+			return assessment, nil
+		}
+	}
+	if len(claim.Evidence) == 0 {
+		assessment.Reason = "Keine Nachweise eingereicht"
+		return assessment, nil
+	}
+
+	approved := math.Min(claim.ClaimedUSD, coverage.CoverageUSD) - coverage.DeductibleUSD
+	if approved <= 0 {
+		assessment.Reason = "Schaden liegt unter der Selbstbeteiligung"
+		return assessment, nil
+	}
+	assessment.Approved = true
+	assessment.ApprovedUSD = roundCents(approved)
+	assessment.Reason = fmt.Sprintf("Erstattung bis zur Versicherungssumme von %.2f USD abzüglich %.2f USD Selbstbeteiligung", coverage.CoverageUSD, coverage.DeductibleUSD)
+	return assessment, nil
+}
+
+func (i *localInsurer) PayClaim(claim InsuranceClaim) (string, error) {
+	return "payout-" + strconv.FormatInt(time.Now().UnixNano(), 10), nil
+}
+
+// issueInsurancePolicy binds the quoted coverage when the shipment is
+// accepted. Excluded goods get no policy.
+func issueInsurancePolicy(shipment *Shipment) {
+	if shipment.Insurance == nil || shipment.Insurance.Status != CoverageQuoted || shipment.Insurance.ExclusionReason != "" {
+		return
+	}
+	policyNumber, err := insurer.IssuePolicy(*shipment)
+	if err != nil {
+		log.Printf("issuing insurance policy for shipment %s failed: %v", shipment.ID, err)
+		return
+	}
+	now := time.Now()
+	shipment.Insurance.Status = CoverageActive
+	shipment.Insurance.PolicyNumber = policyNumber
+	shipment.Insurance.IssuedAt = &now
+}
+
+// damageClaimAwardsUSD sums the refunds damage claims awarded for a
+// shipment.
+func damageClaimAwardsUSD(shipmentID string) float64 {
+	awarded := 0.0
+	for _, claim := range claims {
+		if claim.ShipmentID == shipmentID && claim.Decision != nil {
+			awarded += claim.Decision.AwardedUSD
+		}
+	}
+	return roundCents(awarded)
+}
+
+// cancelInsurance ends the coverage of a shipment that will not be
+// transported.
+func cancelInsurance(shipment *Shipment) {
+	if shipment.Insurance != nil {
+		shipment.Insurance.Status = CoverageCancelled
+	}
+}
+
+func insuranceProductsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	products := insurer.Products()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"insurer":  insurer.Name(),
+		"products": products,
+		"total":    len(products),
+	})
+}
+
+func insuranceQuoteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req InsuranceQuoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Product == "" {
+		req.Product = InsuranceBasic
+	}
+	coverage, err := insurer.Quote(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coverage)
+}
+
+// shipmentInsuranceClaimsHandler submits (POST) and lists (GET) the
+// insurance claims of a shipment.
+func shipmentInsuranceClaimsHandler(w http.ResponseWriter, r *http.Request) {
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if !requirePartyOrAdmin(w, r, shipment) {
+			return
+		}
+		shipmentClaims := []*InsuranceClaim{}
+		for _, claim := range insuranceClaims {
+			if claim.ShipmentID == shipmentID {
+				shipmentClaims = append(shipmentClaims, claim)
+			}
+		}
+		sort.Slice(shipmentClaims, func(i, j int) bool {
+			return shipmentClaims[i].CreatedAt.Before(shipmentClaims[j].CreatedAt)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"insurance_claims": shipmentClaims,
+			"total":            len(shipmentClaims),
+		})
+
+	case "POST":
+		var req SubmitInsuranceClaimRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if shipmentRole(shipment, req.UserID) != roleSender {
+			http.Error(w, "Only the sender can submit an insurance claim", http.StatusForbidden)
+			return
+		}
+		lossType := strings.ToUpper(req.LossType)
+		if lossType != LossDamage && lossType != LossLost {
+			http.Error(w, "Loss type must be DAMAGE or LOSS", http.StatusBadRequest)
+			return
+		}
+		if req.ClaimedUSD <= 0 || strings.TrimSpace(req.Description) == "" {
+			http.Error(w, "Description and a positive claimed amount are required", http.StatusBadRequest)
+			return
+		}
+		if shipment.Insurance == nil || shipment.Insurance.Status != CoverageActive {
+			http.Error(w, "Shipment has no active insurance policy", http.StatusConflict)
+			return
+		}
+		switch shipment.Status {
+		case "POSTED", "ACCEPTED", "CANCELLED":
+			http.Error(w, "Insurance covers the shipment only after the handover", http.StatusConflict)
+			return
+		}
+		for _, claim := range insuranceClaims {
+			if claim.ShipmentID == shipmentID && claim.Status != InsuranceClaimRejected {
+				http.Error(w, "An insurance claim for this shipment already exists", http.StatusConflict)
+				return
+			}
+		}
+		for _, claim := range claims {
+			if claim.ShipmentID == shipmentID && claim.Status == ClaimSubmitted {
+				http.Error(w, "A damage claim for this shipment is still under review", http.StatusConflict)
+				return
+			}
+		}
+
+		claim := &InsuranceClaim{
+			ID:           "inscl-" + strconv.FormatInt(time.Now().UnixNano(), 10),
+			ShipmentID:   shipmentID,
+			PolicyNumber: shipment.Insurance.PolicyNumber,
+			SubmittedBy:  req.UserID,
+			LossType:     lossType,
+			Description:  req.Description,
+			ClaimedUSD:   roundCents(req.ClaimedUSD),
+			Status:       InsuranceClaimSubmitted,
+			Evidence:     []DisputeEvidence{},
+			CreatedAt:    time.Now(),
+		}
+		insurerClaimID, err := insurer.SubmitClaim(*claim)
+		if err != nil {
+			log.Printf("submitting insurance claim for shipment %s failed: %v", shipmentID, err)
+			http.Error(w, "Insurer unavailable, please try again later", http.StatusBadGateway)
+			return
+		}
+		claim.InsurerClaimID = insurerClaimID
+		insuranceClaims[claim.ID] = claim
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(claim)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// insuranceClaimsHandler is the admin queue, optionally filtered by
+// ?status=.
+func insuranceClaimsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	status := strings.ToUpper(r.URL.Query().Get("status"))
+	list := []*InsuranceClaim{}
+	for _, claim := range insuranceClaims {
+		if status == "" || claim.Status == status {
+			list = append(list, claim)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"insurance_claims": list,
+		"total":            len(list),
+	})
+}
+
+func insuranceClaimHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/insurance-claims/"), "/")
+	claimID, action, _ := strings.Cut(rest, "/")
+
+	claim, exists := insuranceClaims[claimID]
+	if !exists {
+		http.Error(w, "Insurance claim not found", http.StatusNotFound)
+		return
+	}
+
+	if action == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requirePartyOrAdmin(w, r, shipments[claim.ShipmentID]) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(claim)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shipment := shipments[claim.ShipmentID]
+	switch action {
+	case "evidence":
+		if claim.Status != InsuranceClaimSubmitted {
+			http.Error(w, "Claim already assessed", http.StatusConflict)
+			return
+		}
+		insuranceClaimEvidenceHandler(w, r, claim)
+		return
+
+	case "assess":
+		if !requireAdmin(w, r) {
+			return
+		}
+		if claim.Status != InsuranceClaimSubmitted {
+			http.Error(w, "Claim already assessed", http.StatusConflict)
+			return
+		}
+		assessment, err := insurer.AssessClaim(*claim, *shipment.Insurance)
+		if err != nil {
+			log.Printf("assessing insurance claim %s failed: %v", claim.ID, err)
+			http.Error(w, "Insurer unavailable, please try again later", http.StatusBadGateway)
+			return
+		}
+		// Whatever damage claims refunded from escrow for this shipment
+		// is not paid again by the insurer
+		if deducted := damageClaimAwardsUSD(claim.ShipmentID); assessment.Approved && deducted > 0 {
+			claim.DeductedUSD = deducted
+			assessment.ApprovedUSD = roundCents(assessment.ApprovedUSD - deducted)
+			if assessment.ApprovedUSD <= 0 {
+				assessment.Approved = false
+				assessment.ApprovedUSD = 0
+				assessment.Reason = "Schaden wurde bereits aus der Zahlung erstattet"
+			}
+		}
+		claim.Assessment = &assessment
+		if assessment.Approved {
+			claim.Status = InsuranceClaimApproved
+		} else {
+			claim.Status = InsuranceClaimRejected
+		}
+
+	case "payout":
+		if !requireAdmin(w, r) {
+			return
+		}
+		if claim.Status != InsuranceClaimApproved {
+			http.Error(w, "Only approved claims can be paid out", http.StatusConflict)
+			return
+		}
+		payoutRef, err := insurer.PayClaim(*claim)
+		if err != nil {
+			log.Printf("paying insurance claim %s failed: %v", claim.ID, err)
+			http.Error(w, "Insurer unavailable, please try again later", http.StatusBadGateway)
+			return
+		}
+		now := time.Now()
+		claim.Status = InsuranceClaimPaid
+		claim.PayoutUSD = claim.Assessment.ApprovedUSD
+		claim.PayoutRef = payoutRef
+		claim.PaidAt = &now
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(claim)
+}
+
+// insuranceClaimEvidenceHandler stores photos or documents of the loss,
+// which sender and traveler can both contribute.
+func insuranceClaimEvidenceHandler(w http.ResponseWriter, r *http.Request, claim *InsuranceClaim) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxEvidenceBytes+1<<20)
+	if err := r.ParseMultipartForm(maxEvidenceBytes); err != nil {
+		http.Error(w, "Invalid multipart upload or file too large", http.StatusBadRequest)
+		return
+	}
+
+	userID := r.FormValue("user_id")
+	if shipmentRole(shipments[claim.ShipmentID], userID) == "" {
+		http.Error(w, "Only sender or traveler can upload evidence", http.StatusForbidden)
+		return
+	}
+	if len(claim.Evidence) >= maxEvidencePerParty {
+		http.Error(w, fmt.Sprintf("At most %d evidence files per claim", maxEvidencePerParty), http.StatusConflict)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Missing file field", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxEvidenceBytes+1))
+	if err != nil || len(data) == 0 || len(data) > maxEvidenceBytes {
+		http.Error(w, "Invalid evidence file", http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(data)
+	extension, allowed := allowedEvidenceTypes[contentType]
+	if !allowed {
+		http.Error(w, "Unsupported file type, use JPEG, PNG, WebP or PDF", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	evidenceID := "evidence-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	evidence := DisputeEvidence{
+		ID:          evidenceID,
+		UploadedBy:  userID,
+		Description: r.FormValue("description"),
+		BlobKey:     "insurance-claims/" + claim.ID + "/" + evidenceID + extension,
+		FileName:    filepath.Base(header.Filename),
+		ContentType: contentType,
+		UploadedAt:  time.Now(),
+	}
+	if err := blobStorage.Put(evidence.BlobKey, data); err != nil {
+		log.Printf("storing evidence for insurance claim %s failed: %v", claim.ID, err)
+		http.Error(w, "Could not store evidence", http.StatusInternalServerError)
+		return
+	}
+	claim.Evidence = append(claim.Evidence, evidence)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(evidence)
+}
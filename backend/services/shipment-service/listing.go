@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"bringee.com/listing"
+)
+
+var shipmentSortKeys = listing.SortKeys[Shipment]{
+	"created_at":              func(s Shipment) string { return listing.TimeKey(s.CreatedAt) },
+	"estimated_delivery_date": func(s Shipment) string { return listing.TimeKey(s.EstimatedDeliveryDate) },
+	"item_value_usd":          func(s Shipment) string { return listing.NumberKey(s.ItemValueUSD) },
+	"agreed_fee_usd":          func(s Shipment) string { return listing.NumberKey(s.AgreedFeeUSD) },
+	"status":                  func(s Shipment) string { return s.Status },
+}
+
+// listShipments answers GET /api/v1/shipments. Filters: status (comma
+// separated), sender_id, traveler_id, from, to, origin_country,
+// destination_country, category, created_after/created_before,
+// delivery_after/delivery_before, min_value/max_value, min_fee/max_fee and
+// the free-text search q.
+func listShipments(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query, err := listing.ParseQuery(values, shipmentSortKeys, "-created_at")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := listing.Filter{Values: values}
+	statuses := filter.Set("status")
+	categories := filter.Set("category")
+	createdAfter, createdBefore := filter.Time("created_after"), filter.Time("created_before")
+	deliveryAfter, deliveryBefore := filter.Time("delivery_after"), filter.Time("delivery_before")
+	minValue, maxValue := filter.Number("min_value"), filter.Number("max_value")
+	minFee, maxFee := filter.Number("min_fee"), filter.Number("max_fee")
+	if filter.Err != nil {
+		http.Error(w, filter.Err.Error(), http.StatusBadRequest)
+		return
+	}
+	senderID, travelerID := values.Get("sender_id"), values.Get("traveler_id")
+	from, to, q := values.Get("from"), values.Get("to"), values.Get("q")
+
+	matches := make([]Shipment, 0, len(shipments))
+	for _, shipment := range shipments {
+		switch {
+		case !listing.InSet(statuses, shipment.Status), !listing.InSet(categories, shipment.ItemCategory):
+		case senderID != "" && shipment.SenderID != senderID:
+		case travelerID != "" && (shipment.TravelerID == nil || *shipment.TravelerID != travelerID):
+		case !listing.ContainsText(from, shipment.FromLocation), !listing.ContainsText(to, shipment.ToLocation):
+		case !countryMatches(values.Get("origin_country"), shipment.OriginCountry):
+		case !countryMatches(values.Get("destination_country"), shipment.DestinationCountry):
+		case !listing.InTimeRange(shipment.CreatedAt, createdAfter, createdBefore):
+		case !listing.InTimeRange(shipment.EstimatedDeliveryDate, deliveryAfter, deliveryBefore):
+		case !listing.InRange(shipment.ItemValueUSD, minValue, maxValue), !listing.InRange(shipment.AgreedFeeUSD, minFee, maxFee):
+		case !listing.ContainsText(q, shipment.ID, shipment.ItemDescription, shipment.ItemCategory, shipment.RecipientName,
+			shipment.FromLocation, shipment.ToLocation):
+		default:
+			matches = append(matches, shipment)
+		}
+	}
+
+	page, next := listing.Paginate(matches, query, shipmentSortKeys, func(s Shipment) string { return s.ID })
+	listing.WritePage(w, "shipments", page, len(matches), query, next)
+}
+
+func countryMatches(filter, country string) bool {
+	return filter == "" || strings.EqualFold(filter, country)
+}
+
+var bidSortKeys = listing.SortKeys[ShipmentBid]{
+	"created_at": func(b ShipmentBid) string { return listing.TimeKey(b.CreatedAt) },
+	"price":      func(b ShipmentBid) string { return listing.NumberKey(b.Price) },
+}
+
+// listBids answers GET /api/v1/bids. Filters: shipment_id, carrier_id,
+// min_price/max_price, created_after/created_before and q.
+func listBids(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query, err := listing.ParseQuery(values, bidSortKeys, "-created_at")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := listing.Filter{Values: values}
+	minPrice, maxPrice := filter.Number("min_price"), filter.Number("max_price")
+	createdAfter, createdBefore := filter.Time("created_after"), filter.Time("created_before")
+	if filter.Err != nil {
+		http.Error(w, filter.Err.Error(), http.StatusBadRequest)
+		return
+	}
+	shipmentID, carrierID, q := values.Get("shipment_id"), values.Get("carrier_id"), values.Get("q")
+
+	matches := make([]ShipmentBid, 0, len(shipmentBids))
+	for _, bid := range shipmentBids {
+		switch {
+		case shipmentID != "" && bid.ShipmentID != shipmentID:
+		case carrierID != "" && bid.CarrierID != carrierID:
+		case !listing.InRange(bid.Price, minPrice, maxPrice):
+		case !listing.InTimeRange(bid.CreatedAt, createdAfter, createdBefore):
+		case !listing.ContainsText(q, bid.ID, bid.Message):
+		default:
+			matches = append(matches, bid)
+		}
+	}
+
+	page, next := listing.Paginate(matches, query, bidSortKeys, func(b ShipmentBid) string { return b.ID })
+	listing.WritePage(w, "bids", page, len(matches), query, next)
+}
+
+var statusSortKeys = listing.SortKeys[ShipmentStatus]{
+	"timestamp": func(s ShipmentStatus) string { return listing.TimeKey(s.Timestamp) },
+	"status":    func(s ShipmentStatus) string { return s.Status },
+}
+
+// listStatuses answers GET /api/v1/status. Filters: shipment_id, status
+// (comma separated), location, created_after/created_before and q.
+func listStatuses(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query, err := listing.ParseQuery(values, statusSortKeys, "-timestamp")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := listing.Filter{Values: values}
+	statuses := filter.Set("status")
+	createdAfter, createdBefore := filter.Time("created_after"), filter.Time("created_before")
+	if filter.Err != nil {
+		http.Error(w, filter.Err.Error(), http.StatusBadRequest)
+		return
+	}
+	shipmentID, location, q := values.Get("shipment_id"), values.Get("location"), values.Get("q")
+
+	var matches []ShipmentStatus
+	for id, history := range shipmentStatusHistory {
+		if shipmentID != "" && id != shipmentID {
+			continue
+		}
+		for _, status := range history {
+			switch {
+			case !listing.InSet(statuses, status.Status):
+			case !listing.ContainsText(location, status.Location):
+			case !listing.InTimeRange(status.Timestamp, createdAfter, createdBefore):
+			case !listing.ContainsText(q, status.Description, status.Location):
+			default:
+				matches = append(matches, status)
+			}
+		}
+	}
+	if matches == nil {
+		matches = []ShipmentStatus{}
+	}
+
+	page, next := listing.Paginate(matches, query, statusSortKeys, func(s ShipmentStatus) string { return s.ID })
+	listing.WritePage(w, "statuses", page, len(matches), query, next)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type EmailAttachment struct {
+	FileName    string
+	ContentType string
+	Data        []byte
+}
+
+type Email struct {
+	To          []string
+	Subject     string
+	Body        string
+	Attachments []EmailAttachment
+}
+
+// Mailer sends transactional emails such as offline handover receipts.
+type Mailer interface {
+	Send(email Email) error
+}
+
+var mailer Mailer = newMailer(os.Getenv("MAILER"))
+
+// newMailer selects the mailer named by MAILER. "smtp" delivers through the
+// server in SMTP_ADDR (host:port), authenticating with SMTP_USERNAME and
+// SMTP_PASSWORD if set, and sends from MAIL_FROM.
+func newMailer(name string) Mailer {
+	switch strings.ToLower(name) {
+	case "", "log":
+		return logMailer{}
+	case "smtp":
+		addr, from := os.Getenv("SMTP_ADDR"), os.Getenv("MAIL_FROM")
+		if addr == "" || from == "" {
+			log.Printf("⚠️ SMTP_ADDR and MAIL_FROM are required for the smtp mailer, falling back to log mailer")
+			return logMailer{}
+		}
+		return newSMTPMailer(addr, from, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	default:
+		log.Printf("⚠️ Unknown mailer %q, falling back to log mailer", name)
+		return logMailer{}
+	}
+}
+
+// smtpMailer sends emails as MIME messages with the attachments base64
+// encoded. net/smtp upgrades to STARTTLS when the server offers it.
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newSMTPMailer(addr, from, username, password string) *smtpMailer {
+	mailer := &smtpMailer{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer
+}
+
+func (m *smtpMailer) Send(email Email) error {
+	message, err := m.message(email)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, email.To, message)
+}
+
+func (m *smtpMailer) message(email Email) ([]byte, error) {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	text, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64Lines(text, []byte(email.Body))
+
+	for _, attachment := range email.Attachments {
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {attachment.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.FileName})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		writeBase64Lines(part, attachment.Data)
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", m.from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(email.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", parts.Boundary())
+	message.Write(body.Bytes())
+	return message.Bytes(), nil
+}
+
+// writeBase64Lines writes data base64 encoded in lines of 76 characters,
+// the maximum MIME allows.
+func writeBase64Lines(w io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
+
+// logMailer logs emails and keeps their attachments in blob storage so they
+// can be inspected during local development.
+type logMailer struct{}
+
+func (logMailer) Send(email Email) error {
+	prefix := "mail/" + strconv.FormatInt(time.Now().UnixNano(), 10) + "/"
+	for _, attachment := range email.Attachments {
+		if err := blobStorage.Put(prefix+attachment.FileName, attachment.Data); err != nil {
+			return err
+		}
+	}
+	log.Printf("✉️ email to %v: %s (%d attachments stored under %s)", email.To, email.Subject, len(email.Attachments), prefix)
+	return nil
+}
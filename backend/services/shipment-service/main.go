@@ -9,6 +9,7 @@ import (
 	"time"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type Shipment struct {
@@ -31,6 +32,29 @@ type Shipment struct {
 	FromLocation          string    `json:"from_location"`
 	ToLocation            string    `json:"to_location"`
 	EstimatedDeliveryDate time.Time `json:"estimated_delivery_date"`
+	SuggestedFee          *PriceSuggestion `json:"suggested_fee,omitempty"`
+	OriginCountry         string    `json:"origin_country"`
+	DestinationCountry    string    `json:"destination_country"`
+	HSCode                string    `json:"hs_code,omitempty"`
+	Currency              string    `json:"currency"`
+	CustomsEstimate       *LandedCostEstimate `json:"customs_estimate,omitempty"`
+	CustomsEstimateUnavailable bool `json:"customs_estimate_unavailable"`
+	CustomsEstimateError  string    `json:"customs_estimate_error,omitempty"`
+	HandedOverAt          *time.Time `json:"handed_over_at,omitempty"`
+	CancelledAt           *time.Time `json:"cancelled_at,omitempty"`
+	CancellationReason    string    `json:"cancellation_reason,omitempty"`
+	ExtraFeesUSD          float64   `json:"extra_fees_usd,omitempty"`
+	ItemCategory          string    `json:"item_category,omitempty"`
+	Screening             *ScreeningResult `json:"screening,omitempty"`
+	PlannedHandoverAt     *time.Time `json:"planned_handover_at,omitempty"`
+	Insurance             *InsuranceCoverage `json:"insurance,omitempty"`
+	WeightKg              float64   `json:"weight_kg,omitempty"`
+	VolumeLiters          float64   `json:"volume_liters,omitempty"`
+	TripID                string    `json:"trip_id,omitempty"`
+	Origin                *Address  `json:"origin,omitempty"`
+	Destination           *Address  `json:"destination,omitempty"`
+	Delayed               bool      `json:"delayed"`
+	DelayedSince          *time.Time `json:"delayed_since,omitempty"`
 }
 
 type CreateShipmentRequest struct {
@@ -38,26 +62,41 @@ type CreateShipmentRequest struct {
 	RecipientAddress string  `json:"recipient_address"`
 	RecipientPhone   string  `json:"recipient_phone"`
 	ItemDescription  string  `json:"item_description"`
+	ItemCategory     string  `json:"item_category"`
 	ItemValueUSD     float64 `json:"item_value_usd"`
 	FromLocation     string  `json:"from_location"`
 	ToLocation       string  `json:"to_location"`
 	EstimatedDeliveryDate time.Time `json:"estimated_delivery_date"`
+	PlannedHandoverAt *time.Time `json:"planned_handover_at"`
+	OriginCountry    string  `json:"origin_country"`
+	DestinationCountry string `json:"destination_country"`
+	HSCode           string  `json:"hs_code"`
+	Currency         string  `json:"currency"`
+	InsuranceProduct string  `json:"insurance_product"`
+	WeightKg         float64 `json:"weight_kg"`
+	VolumeLiters     float64 `json:"volume_liters"`
+	// Structured addresses take precedence over the free-text fields
+	Origin           *Address `json:"origin"`
+	Destination      *Address `json:"destination"`
 }
 
 type AcceptShipmentRequest struct {
 	TravelerID string `json:"traveler_id"`
 	AgreedFee  float64 `json:"agreed_fee"`
+	PlannedHandoverAt *time.Time `json:"planned_handover_at"`
+	TripID     string `json:"trip_id"`
 }
 
-type UpdateShipmentStatusRequest struct {
-	Status string `json:"status"`
+type UpdateShipmentRequest struct {
+	RecipientName    string `json:"recipient_name"`
+	RecipientAddress string `json:"recipient_address"`
+	RecipientPhone   string `json:"recipient_phone"`
+	ItemDescription  string `json:"item_description"`
+	ItemCategory     string `json:"item_category"`
 }
 
-type ShipmentStatusUpdate struct {
-	ShipmentID string    `json:"shipment_id"`
-	Status     string    `json:"status"`
-	Timestamp  time.Time `json:"timestamp"`
-	Notes      string    `json:"notes,omitempty"`
+type UpdateShipmentStatusRequest struct {
+	Status string `json:"status"`
 }
 
 type HealthResponse struct {
@@ -82,13 +121,29 @@ type ShipmentStatus struct {
 	Status      string    `json:"status"`
 	Description string    `json:"description"`
 	Location    string    `json:"location"`
+	Area        string    `json:"area,omitempty"`
 	Timestamp   time.Time `json:"timestamp"`
 }
 
 // In-memory storage for demo purposes
 // In production, this would be a database
 var shipments = make(map[string]Shipment)
-var shipmentStatusHistory = make(map[string][]ShipmentStatusUpdate)
+var shipmentStatusHistory = make(map[string][]ShipmentStatus)
+
+// storeMu guards the in-memory maps of this service. Every request holds it
+// (see withStoreLock), and background sweeps take it before they touch a
+// shipment, so the maps are never read and written at the same time.
+var storeMu sync.Mutex
+
+// withStoreLock runs each request with storeMu held.
+func withStoreLock(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storeMu.Lock()
+		defer storeMu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+var shipmentBids = make(map[string]ShipmentBid)
 
 func main() {
 	log.Println("🚀 Starting Bringee Shipment Service...")
@@ -100,6 +155,13 @@ func main() {
 
 	// Initialize some demo shipments
 	initializeDemoShipments()
+	
+	go newOutboxRelay(outbox, eventBroker).Run()
+	go webhooks.Run()
+	go locations.Run()
+	go runDelayMonitor()
+	go runDeliveryAttemptExpiry()
+	go runPaymentRelease()
 
 	http.HandleFunc("/", handler)
 	http.HandleFunc("/health", healthHandler)
@@ -107,9 +169,33 @@ func main() {
 	http.HandleFunc("/api/v1/shipments/", shipmentHandler)
 	http.HandleFunc("/api/v1/bids", bidsHandler)
 	http.HandleFunc("/api/v1/status", statusHandler)
+	http.HandleFunc("/api/v1/pricing/suggest", pricingSuggestHandler)
+	http.HandleFunc("/api/v1/customs/estimate", customsEstimateHandler)
+	http.HandleFunc("/api/v1/customs/classify", hsCodeClassifyHandler)
+	http.HandleFunc("/api/v1/screening", screeningHandler)
+	http.HandleFunc("/api/v1/admin/restricted-items", restrictedItemsHandler)
+	http.HandleFunc("/api/v1/admin/restricted-items/", restrictedItemHandler)
+	http.HandleFunc("/api/v1/disputes", disputesHandler)
+	http.HandleFunc("/api/v1/disputes/", disputeHandler)
+	http.HandleFunc("/api/v1/claims", claimsHandler)
+	http.HandleFunc("/api/v1/claims/", claimHandler)
+	http.HandleFunc("/api/v1/insurance/products", insuranceProductsHandler)
+	http.HandleFunc("/api/v1/insurance/quote", insuranceQuoteHandler)
+	http.HandleFunc("/api/v1/insurance-claims", insuranceClaimsHandler)
+	http.HandleFunc("/api/v1/insurance-claims/", insuranceClaimHandler)
+	http.HandleFunc("/api/v1/geocode", geocodeHandler)
+	http.HandleFunc("/api/v1/search/shipments", shipmentSearchHandler)
+	http.HandleFunc("/api/v1/trips", tripsHandler)
+	http.HandleFunc("/api/v1/trips/", tripHandler)
+	http.HandleFunc("/api/v1/track/", recipientTrackingHandler)
+	http.HandleFunc("/api/v1/admin/outbox", outboxHandler)
+	http.HandleFunc("/api/v1/admin/webhooks", webhooksHandler)
+	http.HandleFunc("/api/v1/admin/webhooks/", webhookHandler)
+	http.HandleFunc("/api/v1/admin/webhook-dead-letters", webhookDeadLettersHandler)
+	http.HandleFunc("/api/v1/admin/webhook-dead-letters/", webhookDeadLetterHandler)
 	
 	log.Printf("📡 Listening on port %s", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), withStoreLock(http.DefaultServeMux)))
 }
 
 func initializeDemoShipments() {
@@ -136,6 +222,9 @@ func initializeDemoShipments() {
 		FromLocation:          "München",
 		ToLocation:            "Berlin",
 		EstimatedDeliveryDate: now.AddDate(0, 0, 2),
+		OriginCountry:         "DE",
+		DestinationCountry:    "DE",
+		Currency:              "EUR",
 	}
 	shipments["1"] = shipment1
 	
@@ -161,6 +250,9 @@ func initializeDemoShipments() {
 		FromLocation:          "Frankfurt",
 		ToLocation:            "München",
 		EstimatedDeliveryDate: now.AddDate(0, 0, -2),
+		OriginCountry:         "DE",
+		DestinationCountry:    "DE",
+		Currency:              "EUR",
 	}
 	shipments["2"] = shipment2
 	
@@ -185,8 +277,38 @@ func initializeDemoShipments() {
 		FromLocation:          "Düsseldorf",
 		ToLocation:            "Hamburg",
 		EstimatedDeliveryDate: now.AddDate(0, 0, 1),
+		OriginCountry:         "DE",
+		DestinationCountry:    "DE",
+		Currency:              "EUR",
 	}
 	shipments["3"] = shipment3
+	
+	// Demo shipments carry the same structured addresses as new ones
+	for id, shipment := range shipments {
+		shipment.Origin, _ = resolveAddress(nil, shipment.FromLocation)
+		shipment.Destination, _ = resolveAddress(nil, shipment.RecipientAddress)
+		shipments[id] = shipment
+		indexShipment(shipment)
+		recordStatusChange(shipment)
+	}
+	
+	// Demo bids on the open shipment
+	shipmentBids["bid-001"] = ShipmentBid{
+		ID:         "bid-001",
+		ShipmentID: "1",
+		CarrierID:  "carrier-001",
+		Price:      22.00,
+		Message:    "Kann morgen transportieren",
+		CreatedAt:  now.Add(-2 * time.Hour),
+	}
+	shipmentBids["bid-002"] = ShipmentBid{
+		ID:         "bid-002",
+		ShipmentID: "1",
+		CarrierID:  "carrier-002",
+		Price:      20.00,
+		Message:    "Sofort verfügbar",
+		CreatedAt:  now.Add(-1 * time.Hour),
+	}
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
@@ -199,15 +321,99 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		"status": "running",
 		"endpoints": []string{
 			"GET /health",
-			"GET /api/v1/shipments",
+			"GET /api/v1/shipments?status=&sender_id=&traveler_id=&from=&to=&created_after=&created_before=&delivery_after=&delivery_before=&min_value=&max_value=&min_fee=&max_fee=&q=&sort=&limit=&cursor=",
 			"POST /api/v1/shipments",
 			"GET /api/v1/shipments/{id}",
+			"PUT /api/v1/shipments/{id}",
 			"PUT /api/v1/shipments/{id}/accept",
 			"PUT /api/v1/shipments/{id}/status",
-			"GET /api/v1/bids",
+			"GET /api/v1/shipments/{id}/photos",
+			"POST /api/v1/shipments/{id}/photos",
+			"GET /api/v1/shipments/{id}/photos/{photoId}",
+			"GET /api/v1/shipments/{id}/handover",
+			"POST /api/v1/shipments/{id}/handover",
+			"POST /api/v1/shipments/{id}/handover/confirm",
+			"POST /api/v1/shipments/{id}/handover/inspection",
+			"POST /api/v1/shipments/{id}/refuse-inspection",
+			"GET /api/v1/shipments/{id}/payment",
+			"GET /api/v1/shipments/{id}/cancellation?user_id=",
+			"POST /api/v1/shipments/{id}/cancellation",
+			"GET /api/v1/shipments/{id}/delivery-attempts",
+			"POST /api/v1/shipments/{id}/delivery-attempts",
+			"GET /api/v1/shipments/{id}/failed-delivery",
+			"POST /api/v1/shipments/{id}/failed-delivery",
+			"GET /api/v1/shipments/{id}/technical-failure",
+			"POST /api/v1/shipments/{id}/technical-failure",
+			"GET /api/v1/shipments/{id}/technical-failure/{caseId}/pdf",
+			"POST /api/v1/shipments/{id}/reconcile-offline",
+			"GET /api/v1/shipments/{id}/receipt?event=handover|delivery",
+			"GET /api/v1/shipments/{id}/disputes",
+			"POST /api/v1/shipments/{id}/disputes",
+			"GET /api/v1/disputes",
+			"GET /api/v1/disputes/{id}",
+			"POST /api/v1/disputes/{id}/messages",
+			"POST /api/v1/disputes/{id}/evidence",
+			"POST /api/v1/disputes/{id}/propose",
+			"POST /api/v1/disputes/{id}/accept",
+			"POST /api/v1/disputes/{id}/escalate",
+			"POST /api/v1/disputes/{id}/assign",
+			"POST /api/v1/disputes/{id}/decision",
+			"GET /api/v1/shipments/{id}/claims",
+			"POST /api/v1/shipments/{id}/claims",
+			"GET /api/v1/claims",
+			"GET /api/v1/claims/{id}",
+			"POST /api/v1/claims/{id}/items/{index}/photos",
+			"POST /api/v1/claims/{id}/decision",
+			"GET /api/v1/insurance/products",
+			"POST /api/v1/insurance/quote",
+			"GET /api/v1/shipments/{id}/insurance-claims",
+			"POST /api/v1/shipments/{id}/insurance-claims",
+			"GET /api/v1/insurance-claims",
+			"GET /api/v1/insurance-claims/{id}",
+			"POST /api/v1/insurance-claims/{id}/evidence",
+			"POST /api/v1/insurance-claims/{id}/assess",
+			"POST /api/v1/insurance-claims/{id}/payout",
+			"GET /api/v1/shipments/{id}/trips",
+			"GET /api/v1/shipments/{id}/locations?user_id=&since=",
+			"POST /api/v1/shipments/{id}/locations",
+			"GET /api/v1/shipments/{id}/locations/stream?user_id=",
+			"PUT /api/v1/shipments/{id}/locations/privacy",
+			"GET /api/v1/shipments/{id}/eta",
+			"GET /api/v1/shipments/{id}/recipient-tracking?user_id=",
+			"POST /api/v1/shipments/{id}/recipient-tracking",
+			"DELETE /api/v1/shipments/{id}/recipient-tracking?user_id=",
+			"GET /api/v1/track/{token}",
+			"GET /api/v1/trips?traveler_id=&status=",
+			"POST /api/v1/trips",
+			"GET /api/v1/trips/{id}",
+			"PUT /api/v1/trips/{id}",
+			"DELETE /api/v1/trips/{id}?user_id=",
+			"GET /api/v1/trips/{id}/matches",
+			"POST /api/v1/geocode",
+			"GET /api/v1/search/shipments?pickup=lat,lng&pickup_radius_km=&dropoff=lat,lng&dropoff_radius_km=&route=lat,lng&route=lat,lng&corridor_km=&limit=&offset=",
+			"POST /api/v1/search/shipments",
+			"GET /api/v1/bids?shipment_id=&carrier_id=&min_price=&max_price=&created_after=&created_before=&q=&sort=&limit=&cursor=",
 			"POST /api/v1/bids",
-			"GET /api/v1/status",
+			"GET /api/v1/status?shipment_id=&status=&location=&created_after=&created_before=&q=&sort=&limit=&cursor=",
 			"POST /api/v1/status",
+			"POST /api/v1/pricing/suggest",
+			"POST /api/v1/customs/estimate",
+			"POST /api/v1/customs/classify",
+			"POST /api/v1/screening",
+			"GET /api/v1/admin/restricted-items",
+			"POST /api/v1/admin/restricted-items",
+			"PUT /api/v1/admin/restricted-items/{id}",
+			"DELETE /api/v1/admin/restricted-items/{id}",
+			"GET /api/v1/admin/outbox?status=",
+			"GET /api/v1/admin/webhooks",
+			"POST /api/v1/admin/webhooks",
+			"GET /api/v1/admin/webhooks/{id}",
+			"PUT /api/v1/admin/webhooks/{id}",
+			"DELETE /api/v1/admin/webhooks/{id}",
+			"GET /api/v1/admin/webhooks/{id}/deliveries?status=",
+			"POST /api/v1/admin/webhooks/{id}/test",
+			"GET /api/v1/admin/webhook-dead-letters?subscription_id=",
+			"POST /api/v1/admin/webhook-dead-letters/{id}/redeliver",
 		},
 	}
 	
@@ -230,17 +436,7 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 func shipmentsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		// Return all shipments
-		shipmentList := make([]Shipment, 0, len(shipments))
-		for _, shipment := range shipments {
-			shipmentList = append(shipmentList, shipment)
-		}
-		
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"shipments": shipmentList,
-			"total":     len(shipmentList),
-		})
+		listShipments(w, r)
 		
 	case "POST":
 		// Create new shipment
@@ -250,6 +446,45 @@ func shipmentsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		
+		if err := resolveShipmentAddresses(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		normalizeCustomsFields(&req)
+		if req.WeightKg < 0 || req.VolumeLiters < 0 {
+			http.Error(w, "Weight and volume must not be negative", http.StatusBadRequest)
+			return
+		}
+		if !supportedCurrencies[req.Currency] {
+			http.Error(w, "Unsupported currency", http.StatusBadRequest)
+			return
+		}
+		
+		screening := restrictedItemScreener.Screen(req.DestinationCountry, req.ItemDescription, req.ItemCategory)
+		if screening.Decision == ScreeningBlock {
+			writeScreeningBlocked(w, screening)
+			return
+		}
+		
+		if req.InsuranceProduct == "" {
+			req.InsuranceProduct = InsuranceBasic
+		}
+		coverage, err := insurer.Quote(InsuranceQuoteRequest{
+			Product:            req.InsuranceProduct,
+			DeclaredValueUSD:   req.ItemValueUSD,
+			ItemCategory:       req.ItemCategory,
+			OriginCountry:      req.OriginCountry,
+			DestinationCountry: req.DestinationCountry,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		
+		// Suggest a fee range before the shipment enters the map so it
+		// does not count towards its own route demand
+		suggestion := priceSuggester.Suggest(req)
+		
 		// Generate shipment ID
 		shipmentID := strconv.FormatInt(time.Now().Unix(), 10)
 		
@@ -273,9 +508,30 @@ func shipmentsHandler(w http.ResponseWriter, r *http.Request) {
 			FromLocation:          req.FromLocation,
 			ToLocation:            req.ToLocation,
 			EstimatedDeliveryDate: req.EstimatedDeliveryDate,
+			PlannedHandoverAt:     req.PlannedHandoverAt,
+			SuggestedFee:          &suggestion,
+			OriginCountry:         req.OriginCountry,
+			DestinationCountry:    req.DestinationCountry,
+			HSCode:                req.HSCode,
+			Currency:              req.Currency,
+			ItemCategory:          req.ItemCategory,
+			Screening:             &screening,
+			Insurance:             &coverage,
+			WeightKg:              req.WeightKg,
+			VolumeLiters:          req.VolumeLiters,
+			Origin:                req.Origin,
+			Destination:           req.Destination,
 		}
 		
-		shipments[shipmentID] = shipment
+		// Until a fee is agreed, duties are estimated with the suggested fee.
+		// Routes the provider cannot estimate are posted marked as such.
+		estimateShipmentDuties(&shipment, suggestion.RecommendedFeeUSD)
+		
+		saveShipmentWithEvent(shipment, EventShipmentPosted, ShipmentEventData{
+			FromLocation: shipment.FromLocation,
+			ToLocation:   shipment.ToLocation,
+		})
+		indexShipment(shipment)
 		
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
@@ -287,9 +543,72 @@ func shipmentsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func shipmentHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract shipment ID from URL path
-	// This is a simplified implementation
-	shipmentID := "1" // Mock ID for demo
+	shipmentID, action := shipmentPathParts(r.URL.Path)
+	
+	// Handle sub-routes like /api/v1/shipments/{id}/accept
+	switch action {
+	case "":
+	case "accept":
+		shipmentAcceptHandler(w, r)
+		return
+	case "status":
+		shipmentStatusHandler(w, r)
+		return
+	case "photos":
+		shipmentPhotosHandler(w, r)
+		return
+	case "handover":
+		shipmentHandoverHandler(w, r)
+		return
+	case "refuse-inspection":
+		shipmentRefuseInspectionHandler(w, r)
+		return
+	case "payment":
+		shipmentPaymentHandler(w, r)
+		return
+	case "delivery-attempts":
+		shipmentDeliveryAttemptsHandler(w, r)
+		return
+	case "failed-delivery":
+		shipmentFailedDeliveryHandler(w, r)
+		return
+	case "technical-failure":
+		shipmentTechnicalFailureHandler(w, r)
+		return
+	case "reconcile-offline":
+		shipmentReconcileOfflineHandler(w, r)
+		return
+	case "receipt":
+		shipmentReceiptHandler(w, r)
+		return
+	case "disputes":
+		shipmentDisputesHandler(w, r)
+		return
+	case "claims":
+		shipmentClaimsHandler(w, r)
+		return
+	case "cancellation":
+		shipmentCancellationHandler(w, r)
+		return
+	case "insurance-claims":
+		shipmentInsuranceClaimsHandler(w, r)
+		return
+	case "trips":
+		shipmentTripsHandler(w, r)
+		return
+	case "locations":
+		shipmentLocationsHandler(w, r)
+		return
+	case "eta":
+		shipmentETAHandler(w, r)
+		return
+	case "recipient-tracking":
+		shipmentRecipientTrackingHandler(w, r)
+		return
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
 	
 	switch r.Method {
 	case "GET":
@@ -301,22 +620,78 @@ func shipmentHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		
 	case "PUT":
-		// Handle sub-routes like /api/v1/shipments/{id}/accept
-		path := r.URL.Path
-		if strings.HasSuffix(path, "/accept") {
-			shipmentAcceptHandler(w, r)
+		shipmentUpdateHandler(w, r)
+		
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// shipmentPathParts splits /api/v1/shipments/{id}/{action}/... into its ID
+// and the first segment of the optional action.
+func shipmentPathParts(path string) (string, string) {
+	rest := strings.Trim(strings.TrimPrefix(path, "/api/v1/shipments/"), "/")
+	id, rest, _ := strings.Cut(rest, "/")
+	action, _, _ := strings.Cut(rest, "/")
+	return id, action
+}
+
+func shipmentUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var req UpdateShipmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+	if shipment.Status != "POSTED" {
+		http.Error(w, "Only posted shipments can be updated", http.StatusConflict)
+		return
+	}
+	
+	screening := restrictedItemScreener.Screen(shipment.DestinationCountry, req.ItemDescription, req.ItemCategory)
+	if screening.Decision == ScreeningBlock {
+		writeScreeningBlocked(w, screening)
+		return
+	}
+	
+	if strings.TrimSpace(req.RecipientAddress) != "" {
+		destination, err := resolveAddress(nil, req.RecipientAddress)
+		if err != nil {
+			http.Error(w, "invalid drop-off address: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		if strings.HasSuffix(path, "/status") {
-			shipmentStatusHandler(w, r)
+		if destination.Country == "" {
+			destination.Country = shipment.DestinationCountry
+		}
+		// Customs and screening were done for the destination country
+		if destination.Country != shipment.DestinationCountry {
+			http.Error(w, "Recipient address must stay in the destination country", http.StatusConflict)
 			return
 		}
-		
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		shipment.Destination = destination
+		shipment.ToLocation = destination.City
+		if destination.Street != "" {
+			req.RecipientAddress = destination.Formatted
+		}
 	}
+	
+	shipment.RecipientName = req.RecipientName
+	shipment.RecipientAddress = req.RecipientAddress
+	shipment.RecipientPhone = req.RecipientPhone
+	shipment.ItemDescription = req.ItemDescription
+	shipment.ItemCategory = req.ItemCategory
+	shipment.Screening = &screening
+	
+	saveShipmentWithEvent(shipment, EventShipmentUpdated, ShipmentEventData{})
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shipment)
 }
 
 func shipmentAcceptHandler(w http.ResponseWriter, r *http.Request) {
@@ -331,16 +706,33 @@ func shipmentAcceptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	shipmentID := "1" // Mock ID for demo
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
 	if shipment, exists := shipments[shipmentID]; exists {
+		if shipment.Status != "POSTED" {
+			http.Error(w, "Only posted shipments can be accepted", http.StatusConflict)
+			return
+		}
+		if req.TripID != "" {
+			if err := checkTripCapacity(req.TripID, req.TravelerID, shipment); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			shipment.TripID = req.TripID
+		}
 		now := time.Now()
 		shipment.TravelerID = &req.TravelerID
 		shipment.AgreedFeeUSD = req.AgreedFee
 		shipment.Status = "ACCEPTED"
 		shipment.AcceptedAt = &now
 		shipment.BringeeCommissionUSD = req.AgreedFee * 0.1 // 10% commission
+		if req.PlannedHandoverAt != nil {
+			shipment.PlannedHandoverAt = req.PlannedHandoverAt
+		}
+		estimateShipmentDuties(&shipment, req.AgreedFee)
+		issueInsurancePolicy(&shipment)
 		
-		shipments[shipmentID] = shipment
+		saveShipmentWithEvent(shipment, EventShipmentAccepted, ShipmentEventData{AgreedFeeUSD: shipment.AgreedFeeUSD})
+		holdPayment(shipment)
 		
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(shipment)
@@ -361,16 +753,38 @@ func shipmentStatusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	shipmentID := "1" // Mock ID for demo
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
 	if shipment, exists := shipments[shipmentID]; exists {
+		if _, known := statusDescriptions[req.Status]; !known {
+			http.Error(w, "Unknown status "+req.Status, http.StatusBadRequest)
+			return
+		}
+		// Delivering would release the payment the dispute is holding
+		if dispute := openDispute(shipmentID); dispute != nil {
+			http.Error(w, "Shipment has an open dispute "+dispute.ID+", use the dispute endpoints", http.StatusConflict)
+			return
+		}
+		if !statusTransitionAllowed(shipment.Status, req.Status) {
+			http.Error(w, "Shipment in status "+shipment.Status+" cannot be set to "+req.Status+statusEndpointHint[req.Status], http.StatusConflict)
+			return
+		}
+		
+		previousStatus := shipment.Status
 		shipment.Status = req.Status
 		
 		if req.Status == "DELIVERED" {
 			now := time.Now()
 			shipment.DeliveredAt = &now
+			saveShipmentWithEvent(shipment, EventShipmentDelivered, ShipmentEventData{AgreedFeeUSD: shipment.AgreedFeeUSD})
+		} else {
+			saveShipmentWithEvent(shipment, EventShipmentStatusChanged, ShipmentEventData{PreviousStatus: previousStatus})
 		}
+		// A delivery attempt still waiting is settled by the new status
+		expireDeliveryAttempts(shipmentID)
 		
-		shipments[shipmentID] = shipment
+		if req.Status == "DELIVERED" {
+			scheduleRelease(shipmentID, *shipment.DeliveredAt)
+		}
 		
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(shipment)
@@ -382,42 +796,29 @@ func shipmentStatusHandler(w http.ResponseWriter, r *http.Request) {
 func bidsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		// Mock bid data
-		bids := []ShipmentBid{
-			{
-				ID:         "bid-001",
-				ShipmentID: "ship-003",
-				CarrierID:  "carrier-001",
-				Price:      22.00,
-				Message:    "Kann morgen transportieren",
-				CreatedAt:  time.Now().Add(-2 * time.Hour),
-			},
-			{
-				ID:         "bid-002",
-				ShipmentID: "ship-003",
-				CarrierID:  "carrier-002",
-				Price:      20.00,
-				Message:    "Sofort verfügbar",
-				CreatedAt:  time.Now().Add(-1 * time.Hour),
-			},
-		}
-		
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"bids": bids,
-			"total": len(bids),
-		})
+		listBids(w, r)
 		
 	case "POST":
-		// Mock bid creation
 		var bid ShipmentBid
 		if err := json.NewDecoder(r.Body).Decode(&bid); err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 		
-		bid.ID = "bid-" + strconv.FormatInt(time.Now().Unix(), 10)
+		shipment, exists := shipments[bid.ShipmentID]
+		if !exists {
+			http.Error(w, "Shipment not found", http.StatusNotFound)
+			return
+		}
+		
+		bid.ID = "bid-" + strconv.FormatInt(time.Now().UnixNano(), 10)
 		bid.CreatedAt = time.Now()
+		shipmentBids[bid.ID] = bid
+		recordShipmentEvent(shipment, EventBidPlaced, ShipmentEventData{
+			BidID:       bid.ID,
+			BidderID:    bid.CarrierID,
+			BidPriceUSD: bid.Price,
+		})
 		
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
@@ -431,50 +832,32 @@ func bidsHandler(w http.ResponseWriter, r *http.Request) {
 func statusHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		// Mock status history
-		statuses := []ShipmentStatus{
-			{
-				ID:          "status-001",
-				ShipmentID:  "ship-001",
-				Status:      "created",
-				Description: "Sendung erstellt",
-				Location:    "Berlin",
-				Timestamp:   time.Now().AddDate(0, 0, -1),
-			},
-			{
-				ID:          "status-002",
-				ShipmentID:  "ship-001",
-				Status:      "accepted",
-				Description: "Von Transporteur angenommen",
-				Location:    "Berlin",
-				Timestamp:   time.Now().Add(-12 * time.Hour),
-			},
-			{
-				ID:          "status-003",
-				ShipmentID:  "ship-001",
-				Status:      "in_transit",
-				Description: "Unterwegs nach München",
-				Location:    "Nürnberg",
-				Timestamp:   time.Now().Add(-6 * time.Hour),
-			},
-		}
-		
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"statuses": statuses,
-			"total":    len(statuses),
-		})
+		listStatuses(w, r)
 		
 	case "POST":
-		// Mock status update
+		// Free status notes, e.g. a traveler reporting the current location
 		var status ShipmentStatus
 		if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 		
-		status.ID = "status-" + strconv.FormatInt(time.Now().Unix(), 10)
+		shipment, exists := shipments[status.ShipmentID]
+		if !exists {
+			http.Error(w, "Shipment not found", http.StatusNotFound)
+			return
+		}
+		if status.Status == "" {
+			status.Status = shipment.Status
+		}
+		if status.Location == "" {
+			status.Location = lastKnownArea(shipment.ID)
+		}
+		status.Area = statusArea(shipment, status.Status)
+		
+		status.ID = "status-" + strconv.FormatInt(time.Now().UnixNano(), 10)
 		status.Timestamp = time.Now()
+		shipmentStatusHistory[shipment.ID] = append(shipmentStatusHistory[shipment.ID], status)
 		
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
@@ -485,6 +868,73 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// statusTransitions are the changes the status endpoint makes. Handover,
+// cancellation, failed deliveries and disputes have endpoints of their own
+// that check who may make the change and settle the payment.
+var statusTransitions = map[string][]string{
+	"HANDED_OVER": {"IN_TRANSIT"},
+	"IN_TRANSIT":  {"DELIVERED"},
+}
+
+// statusEndpointHint points callers to the endpoint for statuses the status
+// endpoint does not set.
+var statusEndpointHint = map[string]string{
+	"HANDED_OVER":         ", use the handover endpoints",
+	"CANCELLED":           ", use the cancellation endpoint",
+	"FAILED_DELIVERY":     ", use the delivery attempt endpoints",
+	"RETURNING_TO_SENDER": ", use the delivery attempt endpoints",
+	"DISPUTED":            ", use the dispute endpoints",
+}
+
+func statusTransitionAllowed(from, to string) bool {
+	for _, allowed := range statusTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+var statusDescriptions = map[string]string{
+	"POSTED":              "Sendung erstellt",
+	"ACCEPTED":            "Von Transporteur angenommen",
+	"HANDED_OVER":         "An Transporteur übergeben",
+	"IN_TRANSIT":          "Unterwegs",
+	"DELIVERED":           "Zugestellt",
+	"FAILED_DELIVERY":     "Zustellung fehlgeschlagen",
+	"RETURNING_TO_SENDER": "Rücksendung an Absender",
+	"DISPUTED":            "Streitfall eröffnet",
+	"CANCELLED":           "Sendung storniert",
+	"REFUNDED":            "Streitfall entschieden, Betrag erstattet",
+	"SETTLED":             "Streitfall entschieden",
+}
+
+// recordStatusChange appends the shipment's current status to its status
+// history, located near the traveler's last reported position, else at the
+// origin until the parcel is delivered.
+func recordStatusChange(shipment Shipment) {
+	location := lastKnownArea(shipment.ID)
+	switch {
+	case shipment.Status == "DELIVERED":
+		location = shipment.ToLocation
+	case location == "":
+		location = shipment.FromLocation
+	}
+	description, ok := statusDescriptions[shipment.Status]
+	if !ok {
+		description = shipment.Status
+	}
+	shipmentStatusHistory[shipment.ID] = append(shipmentStatusHistory[shipment.ID], ShipmentStatus{
+		ID:          "status-" + strconv.FormatInt(time.Now().UnixNano(), 10),
+		ShipmentID:  shipment.ID,
+		Status:      shipment.Status,
+		Description: description,
+		Location:    location,
+		Area:        statusArea(shipment, shipment.Status),
+		Timestamp:   time.Now(),
+	})
+}
+
 func stringPtr(s string) *string {
 	return &s
 }
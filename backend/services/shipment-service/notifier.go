@@ -0,0 +1,29 @@
+package main
+
+import "log"
+
+// Notification is a message for one party of a shipment. Recipients have no
+// account, so they are addressed by phone number.
+type Notification struct {
+	ShipmentID string `json:"shipment_id"`
+	UserID     string `json:"user_id,omitempty"`
+	Phone      string `json:"phone,omitempty"`
+	Message    string `json:"message"`
+}
+
+// Notifier delivers notifications to senders, travelers and recipients.
+type Notifier interface {
+	Notify(n Notification)
+}
+
+var notifier Notifier = logNotifier{}
+
+type logNotifier struct{}
+
+func (logNotifier) Notify(n Notification) {
+	to := n.UserID
+	if to == "" {
+		to = n.Phone
+	}
+	log.Printf("📨 notify %s about shipment %s: %s", to, n.ShipmentID, n.Message)
+}
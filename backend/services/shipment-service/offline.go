@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OfflineHandover = "HANDOVER"
+	OfflineDelivery = "DELIVERY"
+
+	offlineCodeLength = 8
+	offlineCodeTTL    = 7 * 24 * time.Hour
+	// Reconciled events may not be backdated before the case was opened by
+	// more than this, to allow for clock drift on the reporting phone
+	offlineBackdateSlack = time.Hour
+)
+
+// OfflineConfirmation is a "technical failure" case (spec 6.2.2). Both
+// parties receive a PDF with a one-time code by email; the code is confirmed
+// verbally on site and the event is reconciled once a phone is back online.
+type OfflineConfirmation struct {
+	ID              string     `json:"id"`
+	ShipmentID      string     `json:"shipment_id"`
+	Event           string     `json:"event"`
+	ReportedBy      string     `json:"reported_by"`
+	Code            string     `json:"-"`
+	ReceiptBlobKey  string     `json:"receipt_blob_key"`
+	CreatedAt       time.Time  `json:"created_at"`
+	ExpiresAt       time.Time  `json:"expires_at"`
+	ReconciledAt    *time.Time `json:"reconciled_at,omitempty"`
+	ReconciledBy    string     `json:"reconciled_by,omitempty"`
+	EventOccurredAt *time.Time `json:"event_occurred_at,omitempty"`
+}
+
+type TechnicalFailureRequest struct {
+	UserID string `json:"user_id"`
+	Event  string `json:"event"`
+}
+
+type ReconcileOfflineRequest struct {
+	UserID     string    `json:"user_id"`
+	Code       string    `json:"code"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+var offlineConfirmations = make(map[string][]*OfflineConfirmation)
+
+func shipmentTechnicalFailureHandler(w http.ResponseWriter, r *http.Request) {
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+
+	// GET /api/v1/shipments/{id}/technical-failure/{caseId}/pdf?user_id=
+	// downloads the receipt, which carries the one-time code
+	if rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/shipments/"+shipmentID+"/technical-failure"), "/"); rest != "" {
+		caseID, file, _ := strings.Cut(rest, "/")
+		if file != "pdf" || r.Method != "GET" {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if shipmentRole(shipment, r.URL.Query().Get("user_id")) == "" {
+			http.Error(w, "Only sender or traveler can download the receipt", http.StatusForbidden)
+			return
+		}
+		offlineReceiptHandler(w, shipmentID, caseID)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if shipmentRole(shipment, r.URL.Query().Get("user_id")) == "" {
+			http.Error(w, "Only sender or traveler can list technical failure cases", http.StatusForbidden)
+			return
+		}
+		cases := offlineConfirmations[shipmentID]
+		if cases == nil {
+			cases = []*OfflineConfirmation{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"cases": cases,
+			"total": len(cases),
+		})
+
+	case "POST":
+		var req TechnicalFailureRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if shipmentRole(shipment, req.UserID) == "" {
+			http.Error(w, "Only sender or traveler can report a technical failure", http.StatusForbidden)
+			return
+		}
+		req.Event = strings.ToUpper(req.Event)
+		if err := offlineEventAllowed(shipment, req.Event); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		code, err := generateCode(offlineCodeLength)
+		if err != nil {
+			http.Error(w, "Could not generate confirmation code", http.StatusInternalServerError)
+			return
+		}
+
+		now := time.Now()
+		confirmation := &OfflineConfirmation{
+			ID:         "offline-" + strconv.FormatInt(now.UnixNano(), 10),
+			ShipmentID: shipmentID,
+			Event:      req.Event,
+			ReportedBy: req.UserID,
+			Code:       code,
+			CreatedAt:  now,
+			ExpiresAt:  now.Add(offlineCodeTTL),
+		}
+
+		receipt := technicalFailureReceipt(shipment, confirmation).Bytes()
+		confirmation.ReceiptBlobKey = "shipments/" + shipmentID + "/" + confirmation.ID + ".pdf"
+		if err := blobStorage.Put(confirmation.ReceiptBlobKey, receipt); err != nil {
+			log.Printf("storing receipt for shipment %s failed: %v", shipmentID, err)
+			http.Error(w, "Could not store receipt", http.StatusInternalServerError)
+			return
+		}
+		offlineConfirmations[shipmentID] = append(offlineConfirmations[shipmentID], confirmation)
+
+		emailReceipt(shipment, confirmation, receipt)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(confirmation)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// shipmentReconcileOfflineHandler validates the one-time code and records
+// the offline event at the time it actually happened.
+func shipmentReconcileOfflineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ReconcileOfflineRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+	if shipmentRole(shipment, req.UserID) == "" {
+		http.Error(w, "Only sender or traveler can reconcile a confirmation", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	var confirmation *OfflineConfirmation
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+	for _, candidate := range offlineConfirmations[shipmentID] {
+		if candidate.ReconciledAt == nil && now.Before(candidate.ExpiresAt) &&
+			subtle.ConstantTimeCompare([]byte(candidate.Code), []byte(code)) == 1 {
+			confirmation = candidate
+			break
+		}
+	}
+	if confirmation == nil {
+		http.Error(w, "Invalid or expired confirmation code", http.StatusUnauthorized)
+		return
+	}
+	// The code proves that both parties met, so the party who reported the
+	// failure cannot redeem it alone
+	if req.UserID == confirmation.ReportedBy {
+		http.Error(w, "The confirmation must be reconciled by the other party", http.StatusForbidden)
+		return
+	}
+	if err := offlineEventAllowed(shipment, confirmation.Event); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	occurredAt := req.OccurredAt
+	if occurredAt.IsZero() {
+		occurredAt = confirmation.CreatedAt
+	}
+	if occurredAt.After(now) || occurredAt.Before(confirmation.CreatedAt.Add(-offlineBackdateSlack)) {
+		http.Error(w, "Occurrence time must lie between the failure report and now", http.StatusBadRequest)
+		return
+	}
+
+	response := map[string]interface{}{}
+	previousStatus := shipment.Status
+	switch confirmation.Event {
+	case OfflineHandover:
+		handover := &Handover{
+			ShipmentID:          shipmentID,
+			InitiatedBy:         shipmentRole(shipment, confirmation.ReportedBy),
+			CreatedAt:           confirmation.CreatedAt,
+			ExpiresAt:           confirmation.ExpiresAt,
+			SenderConfirmedAt:   &occurredAt,
+			TravelerConfirmedAt: &occurredAt,
+			ContentWarning:      contentWarning(shipmentID),
+		}
+		// The code only proves that both parties met. The traveler's
+		// inspection must still be acknowledged explicitly, either before
+		// the failure or afterwards via the handover inspection endpoint.
+		if previous, exists := handovers[shipmentID]; exists {
+			handover.InspectionAcknowledgedAt = previous.InspectionAcknowledgedAt
+			handover.ContentWarningAcknowledged = previous.ContentWarningAcknowledged
+		}
+		handovers[shipmentID] = handover
+		if handover.InspectionAcknowledgedAt != nil {
+			handover.CompletedAt = &occurredAt
+			shipment.Status = "HANDED_OVER"
+			shipment.HandedOverAt = &occurredAt
+			saveShipmentWithEvent(shipment, EventShipmentStatusChanged, ShipmentEventData{PreviousStatus: previousStatus})
+		} else {
+			response["inspection_required"] = true
+		}
+		view := *handover
+		view.Token = ""
+		view.QRPayload = ""
+		response["handover"] = view
+	case OfflineDelivery:
+		shipment.Status = "DELIVERED"
+		shipment.DeliveredAt = &occurredAt
+		saveShipmentWithEvent(shipment, EventShipmentDelivered, ShipmentEventData{AgreedFeeUSD: shipment.AgreedFeeUSD})
+		scheduleRelease(shipmentID, occurredAt)
+	}
+
+	confirmation.ReconciledAt = &now
+	confirmation.ReconciledBy = req.UserID
+	confirmation.EventOccurredAt = &occurredAt
+
+	response["confirmation"] = confirmation
+	response["shipment"] = shipment
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// shipmentReceiptHandler renders a PDF receipt for a completed handover or
+// delivery, e.g. GET /api/v1/shipments/{id}/receipt?event=delivery&user_id=.
+func shipmentReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+	if shipmentRole(shipment, r.URL.Query().Get("user_id")) == "" {
+		http.Error(w, "Only sender or traveler can download the receipt", http.StatusForbidden)
+		return
+	}
+
+	var doc *pdfDocument
+	switch strings.ToUpper(r.URL.Query().Get("event")) {
+	case OfflineHandover:
+		if shipment.HandedOverAt == nil {
+			http.Error(w, "Shipment has not been handed over", http.StatusConflict)
+			return
+		}
+		doc = shipmentReceipt(shipment, "Übergabebestätigung", "Übergeben am", *shipment.HandedOverAt)
+	case OfflineDelivery:
+		if shipment.DeliveredAt == nil {
+			http.Error(w, "Shipment has not been delivered", http.StatusConflict)
+			return
+		}
+		doc = shipmentReceipt(shipment, "Zustellbestätigung", "Zugestellt am", *shipment.DeliveredAt)
+	default:
+		http.Error(w, "Event must be handover or delivery", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="bringee-%s-%s.pdf"`, shipmentID, strings.ToLower(r.URL.Query().Get("event"))))
+	w.Write(doc.Bytes())
+}
+
+func offlineReceiptHandler(w http.ResponseWriter, shipmentID, caseID string) {
+	for _, confirmation := range offlineConfirmations[shipmentID] {
+		if confirmation.ID != caseID {
+			continue
+		}
+		data, err := blobStorage.Get(confirmation.ReceiptBlobKey)
+		if err != nil {
+			log.Printf("reading receipt %s failed: %v", confirmation.ReceiptBlobKey, err)
+			http.Error(w, "Could not read receipt", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write(data)
+		return
+	}
+	http.Error(w, "Technical failure case not found", http.StatusNotFound)
+}
+
+func offlineEventAllowed(shipment Shipment, event string) error {
+	switch event {
+	case OfflineHandover:
+		if shipment.Status != "ACCEPTED" {
+			return fmt.Errorf("handover requires an accepted shipment")
+		}
+	case OfflineDelivery:
+		if shipment.Status != "IN_TRANSIT" && shipment.Status != "HANDED_OVER" {
+			return fmt.Errorf("delivery requires a shipment in transit")
+		}
+	default:
+		return fmt.Errorf("event must be HANDOVER or DELIVERY")
+	}
+	return nil
+}
+
+func shipmentReceipt(shipment Shipment, title, timeLabel string, at time.Time) *pdfDocument {
+	doc := &pdfDocument{}
+	doc.Heading("Bringee - " + title)
+	doc.Blank()
+	writeShipmentDetails(doc, shipment)
+	doc.Field(timeLabel, at.Format("02.01.2006 15:04 MST"))
+	return doc
+}
+
+func technicalFailureReceipt(shipment Shipment, confirmation *OfflineConfirmation) *pdfDocument {
+	event := "Übergabe"
+	if confirmation.Event == OfflineDelivery {
+		event = "Zustellung"
+	}
+
+	doc := &pdfDocument{}
+	doc.Heading("Bringee - Technisches Versagen bei der " + event)
+	doc.Blank()
+	writeShipmentDetails(doc, shipment)
+	doc.Field("Fall-ID", confirmation.ID)
+	doc.Field("Gemeldet am", confirmation.CreatedAt.Format("02.01.2006 15:04 MST"))
+	doc.Blank()
+	doc.Heading("Bestätigungscode: " + confirmation.Code)
+	doc.Blank()
+	doc.Text("Anleitung:")
+	doc.Text("1. Nennen Sie sich gegenseitig den obigen Bestätigungscode mündlich.")
+	doc.Text("2. Stimmt der Code überein, kann die " + event + " erfolgen.")
+	doc.Text("3. Sobald eine App wieder verfügbar ist, den Code unter \"Offline-Bestätigung\" eingeben.")
+	doc.Text("Der Code ist einmalig gültig bis " + confirmation.ExpiresAt.Format("02.01.2006") + ".")
+	return doc
+}
+
+func writeShipmentDetails(doc *pdfDocument, shipment Shipment) {
+	doc.Field("Sendung", shipment.ID)
+	doc.Field("Route", shipment.FromLocation+" -> "+shipment.ToLocation)
+	doc.Field("Artikel", shipment.ItemDescription)
+	doc.Field("Warenwert", fmt.Sprintf("%.2f USD", shipment.ItemValueUSD))
+	doc.Field("Transportgebühr", fmt.Sprintf("%.2f USD", shipment.AgreedFeeUSD))
+	doc.Field("Empfänger", shipment.RecipientName)
+	doc.Field("Absender-ID", shipment.SenderID)
+	if shipment.TravelerID != nil {
+		doc.Field("Transporteur-ID", *shipment.TravelerID)
+	}
+}
+
+// emailReceipt sends the receipt to sender and traveler, one message each so
+// neither learns the other's address. Addresses come from user-service; a
+// party whose address cannot be looked up is skipped and can still download
+// the receipt.
+func emailReceipt(shipment Shipment, confirmation *OfflineConfirmation, receipt []byte) {
+	userIDs := []string{shipment.SenderID}
+	if shipment.TravelerID != nil {
+		userIDs = append(userIDs, *shipment.TravelerID)
+	}
+	for _, userID := range userIDs {
+		profile, err := userService.GetUser(userID)
+		if err != nil || profile.Email == "" {
+			log.Printf("no email address for user %s, receipt for shipment %s not sent to them: %v", userID, shipment.ID, err)
+			continue
+		}
+
+		err = mailer.Send(Email{
+			To:      []string{profile.Email},
+			Subject: fmt.Sprintf("Bringee Sendung %s: Bestätigungscode für die Offline-Bestätigung", shipment.ID),
+			Body:    "Im Anhang finden Sie die Transaktionsdetails und den einmaligen Bestätigungscode.",
+			Attachments: []EmailAttachment{{
+				FileName:    confirmation.ID + ".pdf",
+				ContentType: "application/pdf",
+				Data:        receipt,
+			}},
+		})
+		if err != nil {
+			log.Printf("emailing receipt for shipment %s to user %s failed: %v", shipment.ID, userID, err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// pdfDocument renders a single A4 page of plain text lines. It only needs
+// the standard Helvetica font, so no external library is required.
+type pdfDocument struct {
+	lines []pdfLine
+}
+
+type pdfLine struct {
+	text string
+	size int
+	bold bool
+}
+
+func (d *pdfDocument) Heading(text string) {
+	d.lines = append(d.lines, pdfLine{text: text, size: 16, bold: true})
+}
+
+func (d *pdfDocument) Text(text string) {
+	d.lines = append(d.lines, pdfLine{text: text, size: 11})
+}
+
+func (d *pdfDocument) Field(label, value string) {
+	d.lines = append(d.lines, pdfLine{text: label + ": " + value, size: 11})
+}
+
+func (d *pdfDocument) Blank() {
+	d.lines = append(d.lines, pdfLine{size: 11})
+}
+
+// Bytes serialises the document, computing the cross-reference table.
+func (d *pdfDocument) Bytes() []byte {
+	var content bytes.Buffer
+	y := 800
+	for _, line := range d.lines {
+		if y < 60 {
+			break
+		}
+		if line.text != "" {
+			font := "F1"
+			if line.bold {
+				font = "F2"
+			}
+			fmt.Fprintf(&content, "BT /%s %d Tf 50 %d Td (%s) Tj ET\n", font, line.size, y, pdfEscape(line.text))
+		}
+		y -= line.size + 8
+	}
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Contents 4 0 R /Resources << /Font << /F1 5 0 R /F2 6 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// pdfEscape converts text to WinAnsi bytes so German umlauts render, and
+// escapes the characters that delimit PDF strings.
+func pdfEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '€':
+			b.WriteString(`\200`)
+		case r < 0x80:
+			b.WriteRune(r)
+		case r <= 0xFF:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxPhotoBytes    = 10 << 20
+	maxPhotosPerItem = 5
+)
+
+// photoUploadStatuses are the statuses in which the sender may still add
+// photos: once the item is handed over they would no longer show its state
+// at handover.
+var photoUploadStatuses = map[string]bool{
+	"POSTED":   true,
+	"ACCEPTED": true,
+}
+
+var allowedPhotoTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// ShipmentPhoto is a picture of the unpacked item taken by the sender at
+// handover (spec 6.4.3).
+type ShipmentPhoto struct {
+	ID          string         `json:"id"`
+	ShipmentID  string         `json:"shipment_id"`
+	BlobKey     string         `json:"blob_key"`
+	FileName    string         `json:"file_name"`
+	ContentType string         `json:"content_type"`
+	SizeBytes   int64          `json:"size_bytes"`
+	UploadedAt  time.Time      `json:"uploaded_at"`
+	Analysis    *ImageAnalysis `json:"analysis,omitempty"`
+}
+
+// ImageAnalysis compares the objects detected on a photo with the item
+// description and the restricted items catalogue.
+type ImageAnalysis struct {
+	Analyzer        string   `json:"analyzer"`
+	DetectedLabels  []string `json:"detected_labels"`
+	Mismatch        bool     `json:"mismatch"`
+	ProhibitedMatch string   `json:"prohibited_match,omitempty"`
+	Warning         string   `json:"warning,omitempty"`
+}
+
+// BlobStorage stores uploaded files. The local filesystem implementation is
+// used in development; Cloud Storage implements the same interface.
+type BlobStorage interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+}
+
+// ImageAnalyzer detects objects on an image. Google Cloud Vision implements
+// it in production; the stub below derives labels from the file name.
+type ImageAnalyzer interface {
+	Name() string
+	DetectLabels(fileName string, data []byte) ([]string, error)
+}
+
+var blobStorage BlobStorage = newLocalBlobStorage(os.Getenv("BLOB_STORAGE_DIR"))
+var imageAnalyzer ImageAnalyzer = stubImageAnalyzer{}
+var shipmentPhotos = make(map[string][]ShipmentPhoto)
+
+type localBlobStorage struct {
+	dir string
+}
+
+func newLocalBlobStorage(dir string) *localBlobStorage {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "bringee-blobs")
+	}
+	return &localBlobStorage{dir: dir}
+}
+
+func (s *localBlobStorage) Put(key string, data []byte) error {
+	path := filepath.Join(s.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o640)
+}
+
+func (s *localBlobStorage) Get(key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(key)))
+}
+
+type stubImageAnalyzer struct{}
+
+func (stubImageAnalyzer) Name() string {
+	return "stub"
+}
+
+// DetectLabels treats the words of the file name as detected objects, so
+// "laptop.jpg" yields "laptop" and "IMG_0042.jpg" yields nothing.
+func (stubImageAnalyzer) DetectLabels(fileName string, data []byte) ([]string, error) {
+	base := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	var labels []string
+	for _, word := range descriptionWords(base) {
+		if len(word) >= 3 && strings.IndexFunc(word, func(r rune) bool { return r >= '0' && r <= '9' }) < 0 && word != "img" {
+			labels = append(labels, word)
+		}
+	}
+	return labels, nil
+}
+
+func shipmentPhotosHandler(w http.ResponseWriter, r *http.Request) {
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+
+	// GET /api/v1/shipments/{id}/photos/{photoId} returns the image itself
+	if photoID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/shipments/"+shipmentID+"/photos"), "/"); photoID != "" {
+		shipmentPhotoHandler(w, r, shipmentID, photoID)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		photos := shipmentPhotos[shipmentID]
+		if photos == nil {
+			photos = []ShipmentPhoto{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"photos":          photos,
+			"total":           len(photos),
+			"content_warning": contentWarning(shipmentID),
+		})
+
+	case "POST":
+		if !photoUploadStatuses[shipment.Status] {
+			http.Error(w, "Photos can only be added before handover", http.StatusConflict)
+			return
+		}
+		if len(shipmentPhotos[shipmentID]) >= maxPhotosPerItem {
+			http.Error(w, fmt.Sprintf("At most %d photos per shipment", maxPhotosPerItem), http.StatusConflict)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxPhotoBytes+1<<20)
+		if err := r.ParseMultipartForm(maxPhotoBytes); err != nil {
+			http.Error(w, "Invalid multipart upload or photo too large", http.StatusBadRequest)
+			return
+		}
+		if shipmentRole(shipment, r.FormValue("user_id")) != roleSender {
+			http.Error(w, "Only the sender can add photos", http.StatusForbidden)
+			return
+		}
+		file, header, err := r.FormFile("photo")
+		if err != nil {
+			http.Error(w, "Missing photo field", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		if header.Size > maxPhotoBytes {
+			http.Error(w, "Photo too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(file, maxPhotoBytes+1))
+		if err != nil || len(data) == 0 || len(data) > maxPhotoBytes {
+			http.Error(w, "Invalid photo", http.StatusBadRequest)
+			return
+		}
+
+		// Trust the content, not the client supplied header
+		contentType := http.DetectContentType(data)
+		extension, allowed := allowedPhotoTypes[contentType]
+		if !allowed {
+			http.Error(w, "Unsupported photo type, use JPEG, PNG or WebP", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		photoID := "photo-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		photo := ShipmentPhoto{
+			ID:          photoID,
+			ShipmentID:  shipmentID,
+			BlobKey:     "shipments/" + shipmentID + "/" + photoID + extension,
+			FileName:    filepath.Base(header.Filename),
+			ContentType: contentType,
+			SizeBytes:   int64(len(data)),
+			UploadedAt:  time.Now(),
+		}
+		if err := blobStorage.Put(photo.BlobKey, data); err != nil {
+			log.Printf("storing photo for shipment %s failed: %v", shipmentID, err)
+			http.Error(w, "Could not store photo", http.StatusInternalServerError)
+			return
+		}
+		photo.Analysis = analyzePhoto(shipment, photo.FileName, data)
+
+		shipmentPhotos[shipmentID] = append(shipmentPhotos[shipmentID], photo)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(photo)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func shipmentPhotoHandler(w http.ResponseWriter, r *http.Request, shipmentID, photoID string) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	for _, photo := range shipmentPhotos[shipmentID] {
+		if photo.ID != photoID {
+			continue
+		}
+		data, err := blobStorage.Get(photo.BlobKey)
+		if err != nil {
+			log.Printf("reading photo %s failed: %v", photo.BlobKey, err)
+			http.Error(w, "Could not read photo", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", photo.ContentType)
+		io.Copy(w, bytes.NewReader(data))
+		return
+	}
+	http.Error(w, "Photo not found", http.StatusNotFound)
+}
+
+// analyzePhoto runs the image analyzer and compares its labels with the item
+// description. Analyzer failures never block the upload.
+func analyzePhoto(shipment Shipment, fileName string, data []byte) *ImageAnalysis {
+	labels, err := imageAnalyzer.DetectLabels(fileName, data)
+	if err != nil {
+		log.Printf("image analysis for shipment %s failed: %v", shipment.ID, err)
+		return nil
+	}
+
+	analysis := &ImageAnalysis{Analyzer: imageAnalyzer.Name(), DetectedLabels: labels}
+	if len(labels) == 0 {
+		return analysis
+	}
+	detected := strings.Join(labels, " ")
+
+	screening := restrictedItemScreener.Screen(shipment.DestinationCountry, detected, "")
+	if screening.Decision != ScreeningAllow {
+		analysis.ProhibitedMatch = screening.Reasons[0].Name
+		analysis.Warning = fmt.Sprintf("Auf dem Foto wurde möglicherweise ein eingeschränkter Gegenstand erkannt: %s", analysis.ProhibitedMatch)
+	}
+
+	// Labels and description disagree if they classify into different HS
+	// chapters and share no words
+	if !sharesWord(labels, descriptionWords(shipment.ItemDescription)) &&
+		!sharesHSChapter(hsCodeClassifier.Classify(detected, 0), hsCodeClassifier.Classify(shipment.ItemDescription, 0)) {
+		analysis.Mismatch = true
+		if analysis.Warning == "" {
+			analysis.Warning = fmt.Sprintf("Das Foto (%s) passt möglicherweise nicht zur Beschreibung \"%s\". Bitte Inhalt sorgfältig prüfen.", detected, shipment.ItemDescription)
+		}
+	}
+	return analysis
+}
+
+// contentWarning returns the first photo warning of a shipment so the
+// traveler sees it before confirming the handover.
+func contentWarning(shipmentID string) string {
+	for _, photo := range shipmentPhotos[shipmentID] {
+		if photo.Analysis != nil && photo.Analysis.Warning != "" {
+			return photo.Analysis.Warning
+		}
+	}
+	return ""
+}
+
+func sharesWord(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sharesHSChapter(a, b []HSCodeCandidate) bool {
+	if len(a) == 0 || len(b) == 0 {
+		// Nothing to compare against, do not raise a false alarm
+		return true
+	}
+	for _, x := range a {
+		for _, y := range b {
+			if x.Code[:2] == y.Code[:2] {
+				return true
+			}
+		}
+	}
+	return false
+}
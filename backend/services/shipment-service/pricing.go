@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PriceSuggestion is a non-binding fee range shown to the sender before a
+// shipment is posted. Sender and traveler are free to agree on any price.
+// Reason is the factor that moved the fee the most.
+type PriceSuggestion struct {
+	MinFeeUSD         float64  `json:"min_fee_usd"`
+	MaxFeeUSD         float64  `json:"max_fee_usd"`
+	RecommendedFeeUSD float64  `json:"recommended_fee_usd"`
+	Reason            string   `json:"reason"`
+	Factors           []string `json:"factors"`
+	ComparableCount   int      `json:"comparable_count"`
+}
+
+// PriceSuggester suggests a transport fee for a shipment request.
+// The heuristic implementation below runs locally; a Vertex AI backed
+// implementation can be swapped in without touching the handlers.
+type PriceSuggester interface {
+	Suggest(req CreateShipmentRequest) PriceSuggestion
+}
+
+var priceSuggester PriceSuggester = heuristicPriceSuggester{}
+
+const (
+	baseFeeUSD           = 15.0
+	valueFeeRate         = 0.02
+	maxValueSurchargeUSD = 60.0
+	urgentLeadTime       = 48 * time.Hour
+	relaxedLeadTime      = 14 * 24 * time.Hour
+	supplyWindow         = 30 * 24 * time.Hour
+)
+
+// heuristicPriceSuggester derives a fee from accepted shipments on the same
+// route and adjusts it for item value, lead time and traveler supply.
+type heuristicPriceSuggester struct{}
+
+func (heuristicPriceSuggester) Suggest(req CreateShipmentRequest) PriceSuggestion {
+	now := time.Now()
+
+	var fees []float64
+	travelers := make(map[string]bool)
+	openDemand := 0
+	for _, shipment := range shipments {
+		if !sameRoute(shipment, req) {
+			continue
+		}
+		if shipment.Status == "POSTED" {
+			openDemand++
+		}
+		if shipment.AcceptedAt != nil && shipment.AgreedFeeUSD > 0 {
+			fees = append(fees, shipment.AgreedFeeUSD)
+		}
+		if shipment.TravelerID != nil && shipment.AcceptedAt != nil && now.Sub(*shipment.AcceptedAt) <= supplyWindow {
+			travelers[*shipment.TravelerID] = true
+		}
+	}
+
+	// Announced trips are supply as well, even before they carry anything
+	for travelerID := range activeTripTravelers(req.FromLocation, req.ToLocation, supplyWindow) {
+		travelers[travelerID] = true
+	}
+
+	// Each factor remembers how many dollars it moved the fee, so the
+	// reason can name the one that mattered most
+	var factors []string
+	var impacts []float64
+	addFactor := func(factor string, impactUSD float64) {
+		factors = append(factors, factor)
+		impacts = append(impacts, math.Abs(impactUSD))
+	}
+
+	// Start from the route history if there is any, otherwise from the base fee
+	fee := baseFeeUSD
+	if len(fees) > 0 {
+		fee = median(fees)
+		addFactor("Preis basiert auf angenommenen Sendungen dieser Route", fee-baseFeeUSD)
+	} else {
+		addFactor("Keine Vergleichsdaten für diese Route", 0)
+	}
+
+	// Higher declared values mean more responsibility for the traveler
+	valueSurcharge := math.Min(req.ItemValueUSD*valueFeeRate, maxValueSurchargeUSD)
+	if valueSurcharge >= 5 {
+		addFactor("Hoher Warenwert", valueSurcharge)
+	}
+	fee += valueSurcharge
+
+	if !req.EstimatedDeliveryDate.IsZero() {
+		leadTime := req.EstimatedDeliveryDate.Sub(now)
+		switch {
+		case leadTime < urgentLeadTime:
+			addFactor("Kurzfristige Zustellung", fee*0.25)
+			fee *= 1.25
+		case leadTime > relaxedLeadTime:
+			addFactor("Flexibler Zustelltermin", fee*0.1)
+			fee *= 0.9
+		}
+	}
+
+	switch supply := len(travelers); {
+	case openDemand > supply+1:
+		addFactor("Hohe Nachfrage auf dieser Route", fee*0.2)
+		fee *= 1.2
+	case supply == 0:
+		addFactor("Geringe Verfügbarkeit von Transporteuren", fee*0.1)
+		fee *= 1.1
+	case supply > openDemand+1:
+		addFactor("Viele Transporteure auf dieser Route", fee*0.1)
+		fee *= 0.9
+	}
+
+	dominant := 0
+	for i, impact := range impacts {
+		if impact > impacts[dominant] {
+			dominant = i
+		}
+	}
+
+	fee = roundFee(fee)
+	return PriceSuggestion{
+		MinFeeUSD:         roundFee(fee * 0.85),
+		MaxFeeUSD:         roundFee(fee * 1.15),
+		RecommendedFeeUSD: fee,
+		Reason:            factors[dominant],
+		Factors:           factors,
+		ComparableCount:   len(fees),
+	}
+}
+
+func pricingSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req CreateShipmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// Compare routes in the normalized spelling when the places are known,
+	// a suggestion for an unknown place is still useful
+	normalized := req
+	if resolveShipmentAddresses(&normalized) == nil {
+		req = normalized
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(priceSuggester.Suggest(req))
+}
+
+func sameRoute(shipment Shipment, req CreateShipmentRequest) bool {
+	return strings.EqualFold(strings.TrimSpace(shipment.FromLocation), strings.TrimSpace(req.FromLocation)) &&
+		strings.EqualFold(strings.TrimSpace(shipment.ToLocation), strings.TrimSpace(req.ToLocation))
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func roundFee(fee float64) float64 {
+	return math.Round(fee*2) / 2
+}
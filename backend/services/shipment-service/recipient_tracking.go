@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Tracking links keep working this long after the shipment was delivered
+// or cancelled, then the recipient's view of it ends.
+const recipientTrackingAfterCompletion = 14 * 24 * time.Hour
+
+// RecipientTrackingLink lets the recipient, who has no account, follow a
+// shipment. Only a hash of the token is stored, the token itself is shown
+// once when the sender creates or rotates the link.
+type RecipientTrackingLink struct {
+	ShipmentID     string     `json:"shipment_id"`
+	Token          string     `json:"token,omitempty"`
+	TrackingPath   string     `json:"tracking_path,omitempty"`
+	TokenHash      string     `json:"-"`
+	Active         bool       `json:"active"`
+	CreatedAt      time.Time  `json:"created_at"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+	LastAccessedAt *time.Time `json:"last_accessed_at,omitempty"`
+	AccessCount    int        `json:"access_count"`
+}
+
+// RecipientTrackingView is what the public endpoint reveals: no sender or
+// traveler data, no addresses, fees or confirmation code, and the parcel's
+// position only as the nearest city.
+type RecipientTrackingView struct {
+	RecipientName     string                   `json:"recipient_name"`
+	ItemDescription   string                   `json:"item_description"`
+	FromCity          string                   `json:"from_city"`
+	ToCity            string                   `json:"to_city"`
+	Status            string                   `json:"status"`
+	StatusDescription string                   `json:"status_description"`
+	Delayed           bool                     `json:"delayed"`
+	ETA               *RecipientETA            `json:"eta,omitempty"`
+	CurrentArea       string                   `json:"current_area,omitempty"`
+	LastSeenAt        *time.Time               `json:"last_seen_at,omitempty"`
+	DeliveredAt       *time.Time               `json:"delivered_at,omitempty"`
+	History           []RecipientStatusHistory `json:"history"`
+}
+
+type RecipientETA struct {
+	EstimatedArrival time.Time `json:"estimated_arrival"`
+	Earliest         time.Time `json:"earliest"`
+	Latest           time.Time `json:"latest"`
+	Confidence       float64   `json:"confidence"`
+}
+
+type RecipientStatusHistory struct {
+	Status      string    `json:"status"`
+	Description string    `json:"description"`
+	Area        string    `json:"area,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+type RecipientTrackingRequest struct {
+	UserID string `json:"user_id"`
+}
+
+var (
+	recipientLinks      = make(map[string]*RecipientTrackingLink)
+	recipientTokenIndex = make(map[string]string)
+)
+
+func hashTrackingToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRecipientToken creates the shipment's tracking link, or rotates it:
+// the previous token stops working immediately.
+func issueRecipientToken(shipmentID string) RecipientTrackingLink {
+	revokeRecipientToken(shipmentID)
+
+	token := "trk_" + randomHex(24)
+	link := &RecipientTrackingLink{
+		ShipmentID: shipmentID,
+		TokenHash:  hashTrackingToken(token),
+		Active:     true,
+		CreatedAt:  time.Now(),
+	}
+	recipientLinks[shipmentID] = link
+	recipientTokenIndex[link.TokenHash] = shipmentID
+
+	view := *link
+	view.Token = token
+	view.TrackingPath = "/api/v1/track/" + token
+	return view
+}
+
+func revokeRecipientToken(shipmentID string) {
+	link, exists := recipientLinks[shipmentID]
+	if !exists || !link.Active {
+		return
+	}
+	now := time.Now()
+	link.Active = false
+	link.RevokedAt = &now
+	delete(recipientTokenIndex, link.TokenHash)
+}
+
+// shipmentRecipientTrackingHandler lets the sender inspect (GET ?user_id=),
+// create or rotate (POST) and revoke (DELETE ?user_id=) the recipient's
+// tracking link.
+func shipmentRecipientTrackingHandler(w http.ResponseWriter, r *http.Request) {
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+
+	userID := r.URL.Query().Get("user_id")
+	var req RecipientTrackingRequest
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		userID = req.UserID
+	}
+	if shipmentRole(shipment, userID) != roleSender {
+		http.Error(w, "Only the sender can manage the recipient's tracking link", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		link, exists := recipientLinks[shipmentID]
+		if !exists {
+			http.Error(w, "No tracking link issued", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(link)
+
+	case "POST":
+		if !recipientTrackingOpen(shipment, time.Now()) {
+			http.Error(w, "Tracking links can no longer be issued for this shipment", http.StatusConflict)
+			return
+		}
+		link := issueRecipientToken(shipmentID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(link)
+
+	case "DELETE":
+		if _, exists := recipientLinks[shipmentID]; !exists {
+			http.Error(w, "No tracking link issued", http.StatusNotFound)
+			return
+		}
+		revokeRecipientToken(shipmentID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// recipientTrackingOpen reports whether the recipient may still follow the
+// shipment at now.
+func recipientTrackingOpen(shipment Shipment, now time.Time) bool {
+	completedAt := shipment.DeliveredAt
+	if completedAt == nil {
+		completedAt = shipment.CancelledAt
+	}
+	return completedAt == nil || now.Before(completedAt.Add(recipientTrackingAfterCompletion))
+}
+
+// recipientTrackingHandler is the public GET /api/v1/track/{token}. The
+// token is the only credential, so unknown, revoked and expired tokens all
+// answer the same 404.
+func recipientTrackingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/track/"), "/")
+	shipmentID, exists := recipientTokenIndex[hashTrackingToken(token)]
+	var shipment Shipment
+	if exists {
+		shipment, exists = shipments[shipmentID]
+	}
+	now := time.Now()
+	if !exists || !recipientTrackingOpen(shipment, now) {
+		http.Error(w, "Tracking link not found", http.StatusNotFound)
+		return
+	}
+
+	link := recipientLinks[shipmentID]
+	link.LastAccessedAt = &now
+	link.AccessCount++
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	json.NewEncoder(w).Encode(recipientTrackingView(shipment, now))
+}
+
+// addressCity is the city of a geocoded address. Unresolved addresses are
+// the customer's free text and may hold more than the city.
+func addressCity(address *Address) string {
+	if !address.hasCoordinates() {
+		return ""
+	}
+	return address.City
+}
+
+// statusArea locates a status history entry no closer than a city: the
+// drop-off city once delivered, else the city near the traveler's latest
+// ping, else the pickup city.
+func statusArea(shipment Shipment, status string) string {
+	if status == "DELIVERED" {
+		return addressCity(shipment.Destination)
+	}
+	if area := lastKnownArea(shipment.ID); area != "" {
+		return area
+	}
+	return addressCity(shipment.Origin)
+}
+
+func recipientTrackingView(shipment Shipment, now time.Time) RecipientTrackingView {
+	view := RecipientTrackingView{
+		RecipientName:     shipment.RecipientName,
+		ItemDescription:   shipment.ItemDescription,
+		FromCity:          addressCity(shipment.Origin),
+		ToCity:            addressCity(shipment.Destination),
+		Status:            shipment.Status,
+		StatusDescription: statusDescriptions[shipment.Status],
+		Delayed:           shipment.Delayed,
+		DeliveredAt:       shipment.DeliveredAt,
+		History:           []RecipientStatusHistory{},
+	}
+
+	if etaStatuses[shipment.Status] {
+		eta := computeETA(shipment, now)
+		view.ETA = &RecipientETA{
+			EstimatedArrival: eta.EstimatedArrival,
+			Earliest:         eta.Earliest,
+			Latest:           eta.Latest,
+			Confidence:       eta.Confidence,
+		}
+	}
+	if trackableStatuses[shipment.Status] {
+		if ping, ok := locations.latest(shipment.ID); ok {
+			coarse := coarsenPing(ping)
+			view.CurrentArea = coarse.Area
+			view.LastSeenAt = &coarse.Timestamp
+		}
+	}
+
+	// Notes and locations posted by the traveler are free text, the
+	// recipient only gets the standard description and the area of each
+	// status
+	for _, status := range shipmentStatusHistory[shipment.ID] {
+		description, ok := statusDescriptions[status.Status]
+		if !ok {
+			description = status.Status
+		}
+		view.History = append(view.History, RecipientStatusHistory{
+			Status:      status.Status,
+			Description: description,
+			Area:        status.Area,
+			Timestamp:   status.Timestamp,
+		})
+	}
+	return view
+}
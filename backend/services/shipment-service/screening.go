@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ScreeningAllow = "ALLOW"
+	ScreeningWarn  = "WARN"
+	ScreeningBlock = "BLOCK"
+)
+
+// RestrictedItem is a catalogue entry for goods that are prohibited (BLOCK)
+// or need extra care (WARN). An empty Countries list applies everywhere.
+type RestrictedItem struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Keywords   []string  `json:"keywords"`
+	Categories []string  `json:"categories"`
+	Countries  []string  `json:"countries"`
+	Level      string    `json:"level"`
+	Reason     string    `json:"reason"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type ScreeningReason struct {
+	ItemID    string `json:"item_id"`
+	Name      string `json:"name"`
+	Level     string `json:"level"`
+	Reason    string `json:"reason"`
+	MatchedOn string `json:"matched_on"`
+}
+
+type ScreeningResult struct {
+	Decision  string            `json:"decision"`
+	Reasons   []ScreeningReason `json:"reasons"`
+	CheckedAt time.Time         `json:"checked_at"`
+}
+
+type ScreeningRequest struct {
+	DestinationCountry string `json:"destination_country"`
+	ItemDescription    string `json:"item_description"`
+	ItemCategory       string `json:"item_category"`
+}
+
+// restrictedItemCatalogue holds the catalogue managed through the admin API.
+// It is seeded from RESTRICTED_ITEMS_FILE if set, otherwise from defaults.
+type restrictedItemCatalogue struct {
+	mu    sync.RWMutex
+	items map[string]RestrictedItem
+}
+
+var restrictedItemScreener = newRestrictedItemCatalogue(os.Getenv("RESTRICTED_ITEMS_FILE"))
+
+func newRestrictedItemCatalogue(path string) *restrictedItemCatalogue {
+	items := defaultRestrictedItems()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			var fileItems []RestrictedItem
+			if err = json.Unmarshal(data, &fileItems); err == nil {
+				items = fileItems
+			}
+		}
+		if err != nil {
+			log.Printf("⚠️ Could not load restricted items from %s, using defaults: %v", path, err)
+		}
+	}
+
+	catalogue := &restrictedItemCatalogue{items: make(map[string]RestrictedItem)}
+	now := time.Now()
+	for _, item := range items {
+		item.UpdatedAt = now
+		catalogue.items[item.ID] = normalizeRestrictedItem(item)
+	}
+	return catalogue
+}
+
+func defaultRestrictedItems() []RestrictedItem {
+	return []RestrictedItem{
+		{ID: "explosives", Name: "Feuerwerk und Explosivstoffe", Keywords: []string{"feuerwerk", "fireworks", "böller", "sprengstoff", "explosive", "munition", "ammunition"}, Categories: []string{"explosives"}, Level: ScreeningBlock, Reason: "Explosive Stoffe sind vom Transport ausgeschlossen"},
+		{ID: "weapons", Name: "Waffen", Keywords: []string{"waffe", "weapon", "pistole", "gewehr", "gun", "messer", "knife"}, Categories: []string{"weapons"}, Level: ScreeningBlock, Reason: "Waffen dürfen nicht transportiert werden"},
+		{ID: "narcotics", Name: "Betäubungsmittel", Keywords: []string{"drogen", "drugs", "cannabis", "marihuana", "kokain"}, Categories: []string{"narcotics"}, Level: ScreeningBlock, Reason: "Betäubungsmittel sind verboten"},
+		{ID: "flammables", Name: "Entzündliche Flüssigkeiten und Gase", Keywords: []string{"benzin", "gasoline", "feuerzeuggas", "spraydose", "aerosol", "gaskartusche"}, Categories: []string{"dangerous_goods"}, Level: ScreeningBlock, Reason: "Gefahrgut darf nicht im Reisegepäck transportiert werden"},
+		{ID: "cash", Name: "Bargeld und Wertpapiere", Keywords: []string{"bargeld", "cash", "geldscheine", "banknotes"}, Categories: []string{"cash"}, Level: ScreeningBlock, Reason: "Bargeld wird nicht transportiert"},
+		{ID: "lithium-batteries", Name: "Lithium-Batterien", Keywords: []string{"lithium", "akku", "powerbank", "batterie", "batteries"}, Categories: []string{"batteries"}, Level: ScreeningWarn, Reason: "Lithium-Batterien nur im Handgepäck und mit Kapazitätsgrenzen"},
+		{ID: "medicine", Name: "Arzneimittel", Keywords: []string{"medikament", "medikamente", "medicine", "arznei", "tabletten"}, Categories: []string{"medicine"}, Level: ScreeningWarn, Reason: "Arzneimittel können Einfuhrbeschränkungen unterliegen"},
+		{ID: "food", Name: "Lebensmittel", Keywords: []string{"lebensmittel", "food", "fleisch", "meat", "käse", "cheese", "milch"}, Categories: []string{"food"}, Level: ScreeningWarn, Reason: "Tierische Lebensmittel unterliegen Einfuhrbeschränkungen"},
+		{ID: "alcohol-uk", Name: "Alkohol (Großbritannien)", Keywords: []string{"wein", "wine", "bier", "beer", "schnaps", "spirits", "alkohol"}, Categories: []string{"alcohol"}, Countries: []string{"GB"}, Level: ScreeningWarn, Reason: "Alkohol ist in Großbritannien zoll- und steuerpflichtig"},
+		{ID: "alcohol-tr", Name: "Alkohol (Türkei)", Keywords: []string{"wein", "wine", "bier", "beer", "schnaps", "spirits", "alkohol"}, Categories: []string{"alcohol"}, Countries: []string{"TR"}, Level: ScreeningBlock, Reason: "Einfuhr von Alkohol per Privatsendung ist nicht erlaubt"},
+	}
+}
+
+// Screen checks an item description and declared category against all
+// catalogue entries that apply to the destination country.
+func (c *restrictedItemCatalogue) Screen(destinationCountry, description, category string) ScreeningResult {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	destinationCountry = strings.ToUpper(strings.TrimSpace(destinationCountry))
+	category = strings.ToLower(strings.TrimSpace(category))
+	words := screeningWords(description)
+
+	result := ScreeningResult{Decision: ScreeningAllow, Reasons: []ScreeningReason{}, CheckedAt: time.Now()}
+	for _, item := range c.items {
+		if !appliesToCountry(item, destinationCountry) {
+			continue
+		}
+
+		matchedOn := ""
+		for _, itemCategory := range item.Categories {
+			if category != "" && itemCategory == category {
+				matchedOn = "category:" + category
+				break
+			}
+		}
+		if matchedOn == "" {
+			// Unlike HS codes, compounds are not searched: a "Wasserpistole"
+			// or "Entfernungsmesser" must not be blocked as a weapon
+			for _, keyword := range item.Keywords {
+				if matchesWholeWord(words, keyword) {
+					matchedOn = "description:" + keyword
+					break
+				}
+			}
+		}
+		if matchedOn == "" {
+			continue
+		}
+
+		result.Reasons = append(result.Reasons, ScreeningReason{
+			ItemID:    item.ID,
+			Name:      item.Name,
+			Level:     item.Level,
+			Reason:    item.Reason,
+			MatchedOn: matchedOn,
+		})
+		if item.Level == ScreeningBlock {
+			result.Decision = ScreeningBlock
+		} else if result.Decision == ScreeningAllow {
+			result.Decision = ScreeningWarn
+		}
+	}
+
+	sort.Slice(result.Reasons, func(i, j int) bool {
+		return result.Reasons[i].ItemID < result.Reasons[j].ItemID
+	})
+	return result
+}
+
+// screeningWords are the description words plus each part of hyphenated
+// words, so "Lithium-Ionen-Akku" is screened for "lithium" and "akku" as
+// well. The classifier only finds the last part of such a word, screening
+// must find every part.
+func screeningWords(description string) []string {
+	words := descriptionWords(description)
+	for _, word := range words {
+		if !strings.Contains(word, "-") {
+			continue
+		}
+		for _, part := range strings.Split(word, "-") {
+			if part != "" {
+				words = append(words, part)
+			}
+		}
+	}
+	return words
+}
+
+func appliesToCountry(item RestrictedItem, country string) bool {
+	if len(item.Countries) == 0 {
+		return true
+	}
+	for _, c := range item.Countries {
+		if c == country {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeRestrictedItem(item RestrictedItem) RestrictedItem {
+	item.Level = strings.ToUpper(item.Level)
+	for i, keyword := range item.Keywords {
+		item.Keywords[i] = strings.ToLower(strings.TrimSpace(keyword))
+	}
+	for i, category := range item.Categories {
+		item.Categories[i] = strings.ToLower(strings.TrimSpace(category))
+	}
+	for i, country := range item.Countries {
+		item.Countries[i] = strings.ToUpper(strings.TrimSpace(country))
+	}
+	return item
+}
+
+func validRestrictedItem(item RestrictedItem) bool {
+	if item.Name == "" || (len(item.Keywords) == 0 && len(item.Categories) == 0) {
+		return false
+	}
+	return item.Level == ScreeningBlock || item.Level == ScreeningWarn
+}
+
+func writeScreeningBlocked(w http.ResponseWriter, screening ScreeningResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":     "Shipment contains prohibited items",
+		"screening": screening,
+	})
+}
+
+func screeningHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ScreeningRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.DestinationCountry == "" {
+		req.DestinationCountry = defaultCountry
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(restrictedItemScreener.Screen(req.DestinationCountry, req.ItemDescription, req.ItemCategory))
+}
+
+func restrictedItemsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	catalogue := restrictedItemScreener
+
+	switch r.Method {
+	case "GET":
+		catalogue.mu.RLock()
+		items := make([]RestrictedItem, 0, len(catalogue.items))
+		for _, item := range catalogue.items {
+			items = append(items, item)
+		}
+		catalogue.mu.RUnlock()
+		sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"items": items,
+			"total": len(items),
+		})
+
+	case "POST":
+		var item RestrictedItem
+		if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		item = normalizeRestrictedItem(item)
+		if !validRestrictedItem(item) {
+			http.Error(w, "Name, level (BLOCK or WARN) and keywords or categories are required", http.StatusBadRequest)
+			return
+		}
+		if item.ID == "" {
+			item.ID = "item-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		}
+		item.UpdatedAt = time.Now()
+
+		catalogue.mu.Lock()
+		if _, exists := catalogue.items[item.ID]; exists {
+			catalogue.mu.Unlock()
+			http.Error(w, "Restricted item already exists", http.StatusConflict)
+			return
+		}
+		catalogue.items[item.ID] = item
+		catalogue.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(item)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func restrictedItemHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	catalogue := restrictedItemScreener
+	itemID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/restricted-items/"), "/")
+
+	switch r.Method {
+	case "GET":
+		catalogue.mu.RLock()
+		item, exists := catalogue.items[itemID]
+		catalogue.mu.RUnlock()
+		if !exists {
+			http.Error(w, "Restricted item not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(item)
+
+	case "PUT":
+		var item RestrictedItem
+		if err := json.NewDecoder(r.Body).Decode(&item); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		item = normalizeRestrictedItem(item)
+		if !validRestrictedItem(item) {
+			http.Error(w, "Name, level (BLOCK or WARN) and keywords or categories are required", http.StatusBadRequest)
+			return
+		}
+		item.ID = itemID
+		item.UpdatedAt = time.Now()
+
+		catalogue.mu.Lock()
+		if _, exists := catalogue.items[itemID]; !exists {
+			catalogue.mu.Unlock()
+			http.Error(w, "Restricted item not found", http.StatusNotFound)
+			return
+		}
+		catalogue.items[itemID] = item
+		catalogue.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(item)
+
+	case "DELETE":
+		catalogue.mu.Lock()
+		_, exists := catalogue.items[itemID]
+		delete(catalogue.items, itemID)
+		catalogue.mu.Unlock()
+		if !exists {
+			http.Error(w, "Restricted item not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// requireAdmin guards admin endpoints with the ADMIN_TOKEN shared secret.
+// Without a configured token the admin endpoints stay closed.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if isAdmin(r) {
+		return true
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+func isAdmin(r *http.Request) bool {
+	token := os.Getenv("ADMIN_TOKEN")
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) == 1
+}
+
+// requirePartyOrAdmin guards the case files of a shipment (disputes,
+// claims): only its sender or traveler, named by ?user_id=, and admins may
+// read them.
+func requirePartyOrAdmin(w http.ResponseWriter, r *http.Request, shipment Shipment) bool {
+	if shipmentRole(shipment, r.URL.Query().Get("user_id")) != "" || isAdmin(r) {
+		return true
+	}
+	http.Error(w, "Only sender, traveler or an admin can view this", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScreen(t *testing.T) {
+	catalogue := newRestrictedItemCatalogue("")
+
+	tests := []struct {
+		name        string
+		country     string
+		description string
+		category    string
+		decision    string
+		itemIDs     []string
+	}{
+		{name: "harmless", country: "DE", description: "Bücher und Kleidung", decision: ScreeningAllow, itemIDs: []string{}},
+		{name: "keyword", country: "DE", description: "Ein Messer", decision: ScreeningBlock, itemIDs: []string{"weapons"}},
+		{name: "case and punctuation", country: "DE", description: "FEUERWERK!", decision: ScreeningBlock, itemIDs: []string{"explosives"}},
+		{name: "category", country: "DE", description: "Geschenk", category: "Weapons", decision: ScreeningBlock, itemIDs: []string{"weapons"}},
+		{name: "compound is not a keyword", country: "DE", description: "Wasserpistole", decision: ScreeningAllow, itemIDs: []string{}},
+		{name: "hyphenated compound", country: "DE", description: "Silvester-Feuerwerk", decision: ScreeningBlock, itemIDs: []string{"explosives"}},
+		{name: "hyphenated battery", country: "DE", description: "Lithium-Ionen-Akku", decision: ScreeningWarn, itemIDs: []string{"lithium-batteries"}},
+		{name: "hyphen without keyword", country: "DE", description: "T-Shirt", decision: ScreeningAllow, itemIDs: []string{}},
+		{name: "several warnings", country: "DE", description: "Käse und eine Powerbank", decision: ScreeningWarn, itemIDs: []string{"food", "lithium-batteries"}},
+		{name: "block wins over warn", country: "DE", description: "Akku und Munition", decision: ScreeningBlock, itemIDs: []string{"explosives", "lithium-batteries"}},
+		{name: "country rule elsewhere", country: "DE", description: "Wein", decision: ScreeningAllow, itemIDs: []string{}},
+		{name: "country warning", country: "gb", description: "Wein", decision: ScreeningWarn, itemIDs: []string{"alcohol-uk"}},
+		{name: "country block", country: "TR", description: "Wein", decision: ScreeningBlock, itemIDs: []string{"alcohol-tr"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := catalogue.Screen(tt.country, tt.description, tt.category)
+			itemIDs := []string{}
+			for _, reason := range result.Reasons {
+				itemIDs = append(itemIDs, reason.ItemID)
+			}
+			if result.Decision != tt.decision || !reflect.DeepEqual(itemIDs, tt.itemIDs) {
+				t.Errorf("%s %v, want %s %v", result.Decision, itemIDs, tt.decision, tt.itemIDs)
+			}
+		})
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Location privacy modes, chosen by the traveler per shipment. In coarse
+// mode the sender only sees the position snapped to a 0.1° (~10 km) grid
+// and the nearest known city.
+const (
+	LocationPrecise = "PRECISE"
+	LocationCoarse  = "COARSE"
+)
+
+const (
+	maxLocationBatch        = 500
+	maxLocationClockSkew    = 5 * time.Minute
+	coarseGridPerDegree     = 10
+	coarseAreaMaxKm         = 50
+	locationPruneTick       = 10 * time.Minute
+	locationStreamHeartbeat = 15 * time.Second
+)
+
+// LocationPing is a position reported by the traveler's phone. Timestamp is
+// when the phone took the fix, which for offline uploads can be hours
+// before ReceivedAt.
+type LocationPing struct {
+	Lat        float64   `json:"lat"`
+	Lng        float64   `json:"lng"`
+	AccuracyM  float64   `json:"accuracy_m,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+	ReceivedAt time.Time `json:"received_at"`
+	Area       string    `json:"area,omitempty"`
+}
+
+type LocationUploadRequest struct {
+	TravelerID string         `json:"traveler_id"`
+	Pings      []LocationPing `json:"pings"`
+}
+
+type LocationPrivacyRequest struct {
+	TravelerID string `json:"traveler_id"`
+	Mode       string `json:"mode"`
+}
+
+// RejectedPing explains why a ping of an upload was dropped; Index refers
+// to the position in the uploaded batch.
+type RejectedPing struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+// trackableStatuses are the statuses in which the parcel is with the
+// traveler, so pings are accepted.
+var trackableStatuses = map[string]bool{
+	"HANDED_OVER":         true,
+	"IN_TRANSIT":          true,
+	"RETURNING_TO_SENDER": true,
+}
+
+// locationTracker stores the pings per shipment, sorted by Timestamp, and
+// fans new positions out to live streams. Pings older than retention are
+// pruned, and at most maxPings are kept per shipment.
+type locationTracker struct {
+	mu          sync.Mutex
+	pings       map[string][]LocationPing
+	privacy     map[string]string
+	subscribers map[string]map[chan LocationPing]bool
+	retention   time.Duration
+	maxPings    int
+}
+
+var locations = newLocationTracker()
+
+// newLocationTracker reads LOCATION_RETENTION_HOURS (default 72) and
+// LOCATION_MAX_PINGS (default 2000).
+func newLocationTracker() *locationTracker {
+	tracker := &locationTracker{
+		pings:       make(map[string][]LocationPing),
+		privacy:     make(map[string]string),
+		subscribers: make(map[string]map[chan LocationPing]bool),
+		retention:   72 * time.Hour,
+		maxPings:    2000,
+	}
+	if hours, err := strconv.Atoi(os.Getenv("LOCATION_RETENTION_HOURS")); err == nil && hours > 0 {
+		tracker.retention = time.Duration(hours) * time.Hour
+	}
+	if max, err := strconv.Atoi(os.Getenv("LOCATION_MAX_PINGS")); err == nil && max > 0 {
+		tracker.maxPings = max
+	}
+	return tracker
+}
+
+// add merges a batch into the shipment's history. Pings with a timestamp
+// already stored are duplicates from a retried upload and are skipped.
+// Only pings newer than the previous latest position reach live streams.
+func (t *locationTracker) add(shipmentID string, batch []LocationPing) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history := t.pings[shipmentID]
+	var previous time.Time
+	if len(history) > 0 {
+		previous = history[len(history)-1].Timestamp
+	}
+	seen := make(map[int64]bool, len(history))
+	for _, ping := range history {
+		seen[ping.Timestamp.UnixNano()] = true
+	}
+
+	added := 0
+	for _, ping := range batch {
+		if seen[ping.Timestamp.UnixNano()] {
+			continue
+		}
+		seen[ping.Timestamp.UnixNano()] = true
+		history = append(history, ping)
+		added++
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].Timestamp.Before(history[j].Timestamp) })
+	t.pings[shipmentID] = t.trimLocked(history, time.Now())
+
+	for _, ping := range t.pings[shipmentID] {
+		if !ping.Timestamp.After(previous) {
+			continue
+		}
+		for ch := range t.subscribers[shipmentID] {
+			select {
+			case ch <- ping:
+			default:
+				// A slow stream skips positions rather than blocking uploads
+			}
+		}
+	}
+	return added
+}
+
+func (t *locationTracker) trimLocked(history []LocationPing, now time.Time) []LocationPing {
+	cutoff := now.Add(-t.retention)
+	start := sort.Search(len(history), func(i int) bool { return !history[i].Timestamp.Before(cutoff) })
+	if len(history)-start > t.maxPings {
+		start = len(history) - t.maxPings
+	}
+	return history[start:]
+}
+
+func (t *locationTracker) history(shipmentID string, since *time.Time) []LocationPing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := []LocationPing{}
+	for _, ping := range t.pings[shipmentID] {
+		if since == nil || ping.Timestamp.After(*since) {
+			result = append(result, ping)
+		}
+	}
+	return result
+}
+
+func (t *locationTracker) latest(shipmentID string) (LocationPing, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	history := t.pings[shipmentID]
+	if len(history) == 0 {
+		return LocationPing{}, false
+	}
+	return history[len(history)-1], true
+}
+
+// privacyMode defaults to coarse, travelers opt in to precise sharing.
+func (t *locationTracker) privacyMode(shipmentID string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if mode, ok := t.privacy[shipmentID]; ok {
+		return mode
+	}
+	return LocationCoarse
+}
+
+func (t *locationTracker) setPrivacyMode(shipmentID, mode string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.privacy[shipmentID] = mode
+}
+
+func (t *locationTracker) subscribe(shipmentID string) chan LocationPing {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ch := make(chan LocationPing, 16)
+	if t.subscribers[shipmentID] == nil {
+		t.subscribers[shipmentID] = make(map[chan LocationPing]bool)
+	}
+	t.subscribers[shipmentID][ch] = true
+	return ch
+}
+
+func (t *locationTracker) unsubscribe(shipmentID string, ch chan LocationPing) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.subscribers[shipmentID], ch)
+	if len(t.subscribers[shipmentID]) == 0 {
+		delete(t.subscribers, shipmentID)
+	}
+}
+
+// Run prunes expired pings, so delivered shipments do not keep their
+// traveler's movements beyond the retention period.
+func (t *locationTracker) Run() {
+	for {
+		time.Sleep(locationPruneTick)
+
+		now := time.Now()
+		t.mu.Lock()
+		for shipmentID, history := range t.pings {
+			if history = t.trimLocked(history, now); len(history) == 0 {
+				delete(t.pings, shipmentID)
+			} else {
+				t.pings[shipmentID] = history
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// validatePing checks a ping of an upload received at now.
+func validatePing(ping LocationPing, now time.Time, retention time.Duration) error {
+	switch {
+	case ping.Lat < -90 || ping.Lat > 90 || ping.Lng < -180 || ping.Lng > 180:
+		return fmt.Errorf("coordinates out of range")
+	case ping.AccuracyM < 0:
+		return fmt.Errorf("accuracy must not be negative")
+	case ping.Timestamp.IsZero():
+		return fmt.Errorf("timestamp is required")
+	case ping.Timestamp.After(now.Add(maxLocationClockSkew)):
+		return fmt.Errorf("timestamp is in the future")
+	case ping.Timestamp.Before(now.Add(-retention)):
+		return fmt.Errorf("timestamp is older than the retention period")
+	}
+	return nil
+}
+
+// nearestPlace is the gazetteer city closest to point, if one lies within
+// coarseAreaMaxKm.
+func nearestPlace(point GeoPoint) (gazetteerPlace, bool) {
+	var nearest gazetteerPlace
+	best := math.Inf(1)
+	for _, place := range gazetteerPlaces {
+		if km := haversineKm(point, GeoPoint{Lat: place.Lat, Lng: place.Lng}); km < best {
+			nearest, best = place, km
+		}
+	}
+	return nearest, best <= coarseAreaMaxKm
+}
+
+// coarsenPing strips what coarse mode does not share with the sender.
+func coarsenPing(ping LocationPing) LocationPing {
+	coarse := LocationPing{
+		Lat:        math.Round(ping.Lat*coarseGridPerDegree) / coarseGridPerDegree,
+		Lng:        math.Round(ping.Lng*coarseGridPerDegree) / coarseGridPerDegree,
+		Timestamp:  ping.Timestamp.Truncate(time.Minute),
+		ReceivedAt: ping.ReceivedAt.Truncate(time.Minute),
+	}
+	if place, ok := nearestPlace(GeoPoint{Lat: ping.Lat, Lng: ping.Lng}); ok {
+		coarse.Area = place.City
+	}
+	return coarse
+}
+
+// pingForRole returns the ping as the given role may see it.
+func pingForRole(ping LocationPing, role, mode string) LocationPing {
+	if role == roleSender && mode == LocationCoarse {
+		return coarsenPing(ping)
+	}
+	if place, ok := nearestPlace(GeoPoint{Lat: ping.Lat, Lng: ping.Lng}); ok {
+		ping.Area = place.City
+	}
+	return ping
+}
+
+// lastKnownArea names the city near the traveler's latest ping, used to
+// locate status history entries.
+func lastKnownArea(shipmentID string) string {
+	ping, ok := locations.latest(shipmentID)
+	if !ok {
+		return ""
+	}
+	place, ok := nearestPlace(GeoPoint{Lat: ping.Lat, Lng: ping.Lng})
+	if !ok {
+		return ""
+	}
+	return place.City
+}
+
+// shipmentLocationsHandler serves /api/v1/shipments/{id}/locations: the
+// traveler uploads pings (POST), sender and traveler read the history
+// (GET ?user_id=&since=), follow it live (GET /stream?user_id=) and the
+// traveler sets the privacy mode (PUT /privacy).
+func shipmentLocationsHandler(w http.ResponseWriter, r *http.Request) {
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/shipments/"+shipmentID+"/locations"), "/") {
+	case "":
+	case "stream":
+		shipmentLocationStreamHandler(w, r, shipment)
+		return
+	case "privacy":
+		shipmentLocationPrivacyHandler(w, r, shipment)
+		return
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		role := shipmentRole(shipment, r.URL.Query().Get("user_id"))
+		if role == "" {
+			http.Error(w, "Only sender or traveler can see the shipment's location", http.StatusForbidden)
+			return
+		}
+		var since *time.Time
+		if value := r.URL.Query().Get("since"); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "since must be an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			since = &t
+		}
+
+		mode := locations.privacyMode(shipmentID)
+		history := locations.history(shipmentID, since)
+		for i := range history {
+			history[i] = pingForRole(history[i], role, mode)
+		}
+		response := map[string]interface{}{
+			"shipment_id":  shipmentID,
+			"privacy_mode": mode,
+			"locations":    history,
+		}
+		if len(history) > 0 {
+			response["latest"] = history[len(history)-1]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+
+	case "POST":
+		var req LocationUploadRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if shipmentRole(shipment, req.TravelerID) != roleTraveler {
+			http.Error(w, "Only the assigned traveler can report locations", http.StatusForbidden)
+			return
+		}
+		if !trackableStatuses[shipment.Status] {
+			http.Error(w, fmt.Sprintf("Locations cannot be reported for shipments in status %s", shipment.Status), http.StatusConflict)
+			return
+		}
+		if len(req.Pings) == 0 || len(req.Pings) > maxLocationBatch {
+			http.Error(w, fmt.Sprintf("An upload must contain between 1 and %d pings", maxLocationBatch), http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		valid := make([]LocationPing, 0, len(req.Pings))
+		rejected := []RejectedPing{}
+		for i, ping := range req.Pings {
+			if err := validatePing(ping, now, locations.retention); err != nil {
+				rejected = append(rejected, RejectedPing{Index: i, Reason: err.Error()})
+				continue
+			}
+			valid = append(valid, LocationPing{
+				Lat:        ping.Lat,
+				Lng:        ping.Lng,
+				AccuracyM:  ping.AccuracyM,
+				Timestamp:  ping.Timestamp,
+				ReceivedAt: now,
+			})
+		}
+		accepted := locations.add(shipmentID, valid)
+		refreshDelay(shipmentID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"accepted":   accepted,
+			"duplicates": len(valid) - accepted,
+			"rejected":   rejected,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func shipmentLocationPrivacyHandler(w http.ResponseWriter, r *http.Request, shipment Shipment) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req LocationPrivacyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if shipmentRole(shipment, req.TravelerID) != roleTraveler {
+		http.Error(w, "Only the assigned traveler can change location sharing", http.StatusForbidden)
+		return
+	}
+	mode := strings.ToUpper(req.Mode)
+	if mode != LocationPrecise && mode != LocationCoarse {
+		http.Error(w, "Mode must be PRECISE or COARSE", http.StatusBadRequest)
+		return
+	}
+	locations.setPrivacyMode(shipment.ID, mode)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"shipment_id":  shipment.ID,
+		"privacy_mode": mode,
+	})
+}
+
+// shipmentLocationStreamHandler streams positions as server-sent events:
+// the latest known position first, then every new one, with comment
+// heartbeats keeping proxies from closing an idle connection.
+func shipmentLocationStreamHandler(w http.ResponseWriter, r *http.Request, shipment Shipment) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	role := shipmentRole(shipment, r.URL.Query().Get("user_id"))
+	if role == "" {
+		http.Error(w, "Only sender or traveler can see the shipment's location", http.StatusForbidden)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := locations.subscribe(shipment.ID)
+	defer locations.unsubscribe(shipment.ID, ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(ping LocationPing) {
+		data, _ := json.Marshal(pingForRole(ping, role, locations.privacyMode(shipment.ID)))
+		fmt.Fprintf(w, "event: location\ndata: %s\n\n", data)
+		flusher.Flush()
+	}
+	if ping, ok := locations.latest(shipment.ID); ok {
+		send(ping)
+	} else {
+		flusher.Flush()
+	}
+
+	// From here on the stream only reads the location tracker, which has a
+	// lock of its own, so other requests need not wait for it to end
+	storeMu.Unlock()
+	defer storeMu.Lock()
+
+	heartbeat := time.NewTicker(locationStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ping := <-ch:
+			send(ping)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
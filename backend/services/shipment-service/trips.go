@@ -0,0 +1,557 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	TripActive    = "ACTIVE"
+	TripCancelled = "CANCELLED"
+
+	// Weights of the match score, they add up to 1
+	routeMatchWeight  = 0.5
+	dateMatchWeight   = 0.3
+	ratingMatchWeight = 0.2
+
+	// Score used when the traveler rating cannot be fetched
+	unknownRatingScore = 0.5
+	// A traveler demoted for late cancellations (spec 6.5.2) ranks with
+	// this share of the score
+	demotedScoreFactor = 0.5
+	maxMatches         = 20
+)
+
+// Trip is a journey a traveler announces, e.g. Frankfurt to München on
+// Friday with 5 kg to spare. Senders' shipments are matched against it.
+type Trip struct {
+	ID                 string    `json:"id"`
+	TravelerID         string    `json:"traveler_id"`
+	Origin             string    `json:"origin"`
+	Destination        string    `json:"destination"`
+	DepartureFrom      time.Time `json:"departure_from"`
+	DepartureTo        time.Time `json:"departure_to"`
+	ArrivalFrom        time.Time `json:"arrival_from"`
+	ArrivalTo          time.Time `json:"arrival_to"`
+	CapacityKg         float64   `json:"capacity_kg"`
+	CapacityLiters     float64   `json:"capacity_liters,omitempty"`
+	AcceptedCategories []string  `json:"accepted_categories"`
+	Notes              string    `json:"notes,omitempty"`
+	Status             string    `json:"status"`
+	RemainingKg        float64   `json:"remaining_kg"`
+	RemainingLiters    float64   `json:"remaining_liters,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+type TripRequest struct {
+	TravelerID         string     `json:"traveler_id"`
+	Origin             string     `json:"origin"`
+	Destination        string     `json:"destination"`
+	DepartureFrom      time.Time  `json:"departure_from"`
+	DepartureTo        time.Time  `json:"departure_to"`
+	ArrivalFrom        *time.Time `json:"arrival_from"`
+	ArrivalTo          *time.Time `json:"arrival_to"`
+	CapacityKg         float64    `json:"capacity_kg"`
+	CapacityLiters     float64    `json:"capacity_liters"`
+	AcceptedCategories []string   `json:"accepted_categories"`
+	Notes              string     `json:"notes"`
+}
+
+// TripMatch is one proposal of the matching engine. Either Shipment or Trip
+// is set, depending on the direction of the query.
+type TripMatch struct {
+	Shipment       *MatchedShipment `json:"shipment,omitempty"`
+	Trip           *Trip            `json:"trip,omitempty"`
+	Score          float64          `json:"score"`
+	RouteScore     float64          `json:"route_score"`
+	DateScore      float64          `json:"date_score"`
+	TravelerRating float64          `json:"traveler_rating,omitempty"`
+	Reasons        []string         `json:"reasons"`
+}
+
+// MatchedShipment is what a traveler sees of a shipment before accepting it.
+// Recipient details and the delivery confirmation code stay with the sender,
+// and locations are reduced to the city.
+type MatchedShipment struct {
+	ID                    string           `json:"id"`
+	FromCity              string           `json:"from_city"`
+	ToCity                string           `json:"to_city"`
+	OriginCountry         string           `json:"origin_country"`
+	DestinationCountry    string           `json:"destination_country"`
+	ItemDescription       string           `json:"item_description"`
+	ItemCategory          string           `json:"item_category,omitempty"`
+	ItemValueUSD          float64          `json:"item_value_usd"`
+	WeightKg              float64          `json:"weight_kg,omitempty"`
+	VolumeLiters          float64          `json:"volume_liters,omitempty"`
+	EstimatedDeliveryDate time.Time        `json:"estimated_delivery_date"`
+	SuggestedFee          *PriceSuggestion `json:"suggested_fee,omitempty"`
+}
+
+func newMatchedShipment(shipment Shipment) *MatchedShipment {
+	matched := &MatchedShipment{
+		ID:                    shipment.ID,
+		OriginCountry:         shipment.OriginCountry,
+		DestinationCountry:    shipment.DestinationCountry,
+		ItemDescription:       shipment.ItemDescription,
+		ItemCategory:          shipment.ItemCategory,
+		ItemValueUSD:          shipment.ItemValueUSD,
+		WeightKg:              shipment.WeightKg,
+		VolumeLiters:          shipment.VolumeLiters,
+		EstimatedDeliveryDate: shipment.EstimatedDeliveryDate,
+		SuggestedFee:          shipment.SuggestedFee,
+	}
+	if shipment.Origin != nil {
+		matched.FromCity = shipment.Origin.City
+	}
+	if shipment.Destination != nil {
+		matched.ToCity = shipment.Destination.City
+	}
+	return matched
+}
+
+// In-memory storage for demo purposes
+var trips = make(map[string]Trip)
+
+func tripFromRequest(req TripRequest) (Trip, error) {
+	trip := Trip{
+		TravelerID:         strings.TrimSpace(req.TravelerID),
+		Origin:             strings.TrimSpace(req.Origin),
+		Destination:        strings.TrimSpace(req.Destination),
+		DepartureFrom:      req.DepartureFrom,
+		DepartureTo:        req.DepartureTo,
+		CapacityKg:         req.CapacityKg,
+		CapacityLiters:     req.CapacityLiters,
+		AcceptedCategories: req.AcceptedCategories,
+		Notes:              req.Notes,
+	}
+	// Use the gazetteer spelling where the place is known, so routes compare
+	// equal to the normalized shipment locations
+	for _, location := range []*string{&trip.Origin, &trip.Destination} {
+		if address, err := geocoder.Geocode(*location); err == nil {
+			*location = address.City
+		}
+	}
+	if trip.DepartureTo.IsZero() {
+		trip.DepartureTo = trip.DepartureFrom
+	}
+	// Without an arrival window the traveler arrives on the day of departure
+	trip.ArrivalFrom = trip.DepartureFrom
+	trip.ArrivalTo = trip.DepartureTo.Add(24 * time.Hour)
+	if req.ArrivalFrom != nil {
+		trip.ArrivalFrom = *req.ArrivalFrom
+	}
+	if req.ArrivalTo != nil {
+		trip.ArrivalTo = *req.ArrivalTo
+	}
+	if trip.AcceptedCategories == nil {
+		trip.AcceptedCategories = []string{}
+	}
+
+	switch {
+	case trip.TravelerID == "" || trip.Origin == "" || trip.Destination == "":
+		return Trip{}, fmt.Errorf("traveler_id, origin and destination are required")
+	case trip.DepartureFrom.IsZero():
+		return Trip{}, fmt.Errorf("departure_from is required")
+	case trip.DepartureTo.Before(trip.DepartureFrom) || trip.ArrivalTo.Before(trip.ArrivalFrom):
+		return Trip{}, fmt.Errorf("time windows must not end before they start")
+	case trip.ArrivalTo.Before(trip.DepartureFrom):
+		return Trip{}, fmt.Errorf("arrival must not be before departure")
+	case trip.CapacityKg <= 0:
+		return Trip{}, fmt.Errorf("capacity_kg must be positive")
+	case trip.CapacityLiters < 0:
+		return Trip{}, fmt.Errorf("capacity_liters must not be negative")
+	}
+	return trip, nil
+}
+
+// tripLoad sums weight and volume of the shipments accepted on a trip.
+func tripLoad(tripID string) (float64, float64) {
+	var kg, liters float64
+	for _, shipment := range shipments {
+		if shipment.TripID == tripID && shipment.Status != "CANCELLED" && shipment.Status != "POSTED" {
+			kg += shipment.WeightKg
+			liters += shipment.VolumeLiters
+		}
+	}
+	return kg, liters
+}
+
+func withRemainingCapacity(trip Trip) Trip {
+	kg, liters := tripLoad(trip.ID)
+	trip.RemainingKg = math.Max(roundCents(trip.CapacityKg-kg), 0)
+	trip.RemainingLiters = math.Max(roundCents(trip.CapacityLiters-liters), 0)
+	return trip
+}
+
+func tripsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		travelerID := r.URL.Query().Get("traveler_id")
+		status := strings.ToUpper(r.URL.Query().Get("status"))
+		list := []Trip{}
+		for _, trip := range trips {
+			if (travelerID == "" || trip.TravelerID == travelerID) && (status == "" || trip.Status == status) {
+				list = append(list, withRemainingCapacity(trip))
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].DepartureFrom.Before(list[j].DepartureFrom) })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"trips": list,
+			"total": len(list),
+		})
+
+	case "POST":
+		var req TripRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		trip, err := tripFromRequest(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if trip.DepartureTo.Before(time.Now()) {
+			http.Error(w, "Trip departs in the past", http.StatusBadRequest)
+			return
+		}
+
+		trip.ID = "trip-" + randomHex(8)
+		trip.Status = TripActive
+		trip.CreatedAt = time.Now()
+		trip.UpdatedAt = trip.CreatedAt
+		trips[trip.ID] = trip
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(withRemainingCapacity(trip))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// tripHandler serves /api/v1/trips/{id} and /api/v1/trips/{id}/matches.
+// Changes are only allowed to the traveler of the trip.
+func tripHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/trips/"), "/")
+	tripID, action, _ := strings.Cut(rest, "/")
+
+	trip, exists := trips[tripID]
+	if !exists {
+		http.Error(w, "Trip not found", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+	case "matches":
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		matches := matchShipmentsForTrip(withRemainingCapacity(trip))
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"trip_id": trip.ID,
+			"matches": matches,
+			"total":   len(matches),
+		})
+		return
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withRemainingCapacity(trip))
+
+	case "PUT":
+		var req TripRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.TravelerID != trip.TravelerID {
+			http.Error(w, "Only the traveler can change the trip", http.StatusForbidden)
+			return
+		}
+		if trip.Status != TripActive {
+			http.Error(w, "Only active trips can be changed", http.StatusConflict)
+			return
+		}
+		updated, err := tripFromRequest(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updated.ID = trip.ID
+		updated.Status = trip.Status
+		updated.CreatedAt = trip.CreatedAt
+		updated.UpdatedAt = time.Now()
+		if kg, _ := tripLoad(trip.ID); kg > updated.CapacityKg {
+			http.Error(w, "Capacity is below the accepted shipments", http.StatusConflict)
+			return
+		}
+		trips[trip.ID] = updated
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withRemainingCapacity(updated))
+
+	case "DELETE":
+		if r.URL.Query().Get("user_id") != trip.TravelerID {
+			http.Error(w, "Only the traveler can cancel the trip", http.StatusForbidden)
+			return
+		}
+		// Accepted shipments stay with the traveler, the trip is only
+		// withdrawn from matching
+		trip.Status = TripCancelled
+		trip.UpdatedAt = time.Now()
+		trips[trip.ID] = trip
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(withRemainingCapacity(trip))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// shipmentTripsHandler proposes trips for a posted shipment.
+func shipmentTripsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	shipmentID, _ := shipmentPathParts(r.URL.Path)
+	shipment, exists := shipments[shipmentID]
+	if !exists {
+		http.Error(w, "Shipment not found", http.StatusNotFound)
+		return
+	}
+
+	matches := matchTripsForShipment(shipment)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"shipment_id": shipment.ID,
+		"matches":     matches,
+		"total":       len(matches),
+	})
+}
+
+func matchShipmentsForTrip(trip Trip) []TripMatch {
+	matches := []TripMatch{}
+	if trip.Status != TripActive {
+		return matches
+	}
+	standing := travelerRating(trip.TravelerID)
+	for _, shipment := range shipments {
+		if shipment.Status != "POSTED" || shipment.SenderID == trip.TravelerID {
+			continue
+		}
+		if match, ok := matchTrip(trip, shipment, standing); ok {
+			match.Shipment = newMatchedShipment(shipment)
+			matches = append(matches, match)
+		}
+	}
+	return rankMatches(matches)
+}
+
+func matchTripsForShipment(shipment Shipment) []TripMatch {
+	matches := []TripMatch{}
+	if shipment.Status != "POSTED" {
+		return matches
+	}
+	standings := make(map[string]travelerStanding)
+	for _, trip := range trips {
+		if trip.Status != TripActive || trip.TravelerID == shipment.SenderID {
+			continue
+		}
+		standing, cached := standings[trip.TravelerID]
+		if !cached {
+			standing = travelerRating(trip.TravelerID)
+			if standing.Known {
+				standings[trip.TravelerID] = standing
+			}
+		}
+		if match, ok := matchTrip(withRemainingCapacity(trip), shipment, standing); ok {
+			t := withRemainingCapacity(trip)
+			match.Trip = &t
+			matches = append(matches, match)
+		}
+	}
+	return rankMatches(matches)
+}
+
+func rankMatches(matches []TripMatch) []TripMatch {
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	if len(matches) > maxMatches {
+		matches = matches[:maxMatches]
+	}
+	return matches
+}
+
+// matchTrip checks the hard constraints (route, timing, capacity, category)
+// and scores a compatible pair by route fit, date window and rating.
+func matchTrip(trip Trip, shipment Shipment, standing travelerStanding) (TripMatch, bool) {
+	if trip.DepartureTo.Before(time.Now()) {
+		return TripMatch{}, false
+	}
+	origin := locationFit(trip.Origin, shipment.FromLocation)
+	destination := locationFit(trip.Destination, shipment.ToLocation)
+	if origin == 0 || destination == 0 {
+		return TripMatch{}, false
+	}
+	if shipment.WeightKg > trip.RemainingKg || (trip.CapacityLiters > 0 && shipment.VolumeLiters > trip.RemainingLiters) {
+		return TripMatch{}, false
+	}
+	if !acceptsCategory(trip, shipment.ItemCategory) {
+		return TripMatch{}, false
+	}
+	if shipment.PlannedHandoverAt != nil && shipment.PlannedHandoverAt.After(trip.DepartureTo) {
+		return TripMatch{}, false
+	}
+
+	reasons := []string{}
+	routeScore := (origin + destination) / 2
+	if routeScore == 1 {
+		reasons = append(reasons, "Route stimmt überein")
+	} else {
+		reasons = append(reasons, "Route passt ungefähr")
+	}
+
+	// The trip should arrive before the shipment's delivery date
+	dateScore := 1.0
+	if deadline := shipment.EstimatedDeliveryDate; !deadline.IsZero() {
+		switch {
+		case trip.ArrivalFrom.After(deadline):
+			return TripMatch{}, false
+		case trip.ArrivalTo.After(deadline):
+			dateScore = 0.5
+			reasons = append(reasons, "Ankunft möglicherweise nach dem Zustelltermin")
+		default:
+			reasons = append(reasons, "Ankunft vor dem Zustelltermin")
+		}
+	}
+
+	ratingScore := unknownRatingScore
+	if standing.Known {
+		ratingScore = standing.Rating / 5
+		if standing.Rating >= 4.5 && !standing.Demoted {
+			reasons = append(reasons, "Sehr gut bewerteter Transporteur")
+		}
+	}
+	if shipment.WeightKg == 0 {
+		reasons = append(reasons, "Gewicht der Sendung unbekannt")
+	}
+
+	score := routeMatchWeight*routeScore + dateMatchWeight*dateScore + ratingMatchWeight*ratingScore
+	if standing.Demoted {
+		score *= demotedScoreFactor
+	}
+	match := TripMatch{
+		Score:      math.Round(score*1000) / 1000,
+		RouteScore: routeScore,
+		DateScore:  dateScore,
+		Reasons:    reasons,
+	}
+	if standing.Known {
+		match.TravelerRating = standing.Rating
+	}
+	return match, true
+}
+
+// locationFit compares free-text locations: 1 for the same place, 0.8 when
+// one contains the other (a street address in the trip's city), else 0.
+func locationFit(tripLocation, shipmentLocation string) float64 {
+	a := strings.ToLower(strings.TrimSpace(tripLocation))
+	b := strings.ToLower(strings.TrimSpace(shipmentLocation))
+	switch {
+	case a == "" || b == "":
+		return 0
+	case a == b:
+		return 1
+	case strings.Contains(a, b) || strings.Contains(b, a):
+		return 0.8
+	}
+	return 0
+}
+
+func acceptsCategory(trip Trip, category string) bool {
+	if len(trip.AcceptedCategories) == 0 || category == "" {
+		return true
+	}
+	for _, accepted := range trip.AcceptedCategories {
+		if strings.EqualFold(accepted, category) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTripCapacity makes sure a shipment accepted on a trip belongs to the
+// trip's traveler and still fits into it.
+func checkTripCapacity(tripID, travelerID string, shipment Shipment) error {
+	trip, exists := trips[tripID]
+	switch {
+	case !exists:
+		return fmt.Errorf("trip %s not found", tripID)
+	case trip.TravelerID != travelerID:
+		return fmt.Errorf("trip %s belongs to another traveler", tripID)
+	case trip.Status != TripActive:
+		return fmt.Errorf("trip %s is not active", tripID)
+	}
+	trip = withRemainingCapacity(trip)
+	if shipment.WeightKg > trip.RemainingKg || (trip.CapacityLiters > 0 && shipment.VolumeLiters > trip.RemainingLiters) {
+		return fmt.Errorf("shipment does not fit into the remaining capacity of trip %s", tripID)
+	}
+	return nil
+}
+
+// travelerStanding is what matching needs to know about a traveler.
+// Known is false if user-service could not be asked.
+type travelerStanding struct {
+	Rating  float64
+	Known   bool
+	Demoted bool
+}
+
+// travelerRating looks up the rating of a traveler and whether a ranking
+// demotion for late cancellations is still running.
+func travelerRating(travelerID string) travelerStanding {
+	profile, err := userService.GetUser(travelerID)
+	if err != nil {
+		return travelerStanding{}
+	}
+	return travelerStanding{
+		Rating:  profile.Rating,
+		Known:   true,
+		Demoted: profile.RankingDemotedUntil != nil && time.Now().Before(*profile.RankingDemotedUntil),
+	}
+}
+
+// activeTripTravelers returns the travelers with an active trip on the
+// route that departs within the window, the supply side for pricing.
+func activeTripTravelers(from, to string, window time.Duration) map[string]bool {
+	travelers := make(map[string]bool)
+	now := time.Now()
+	for _, trip := range trips {
+		if trip.Status != TripActive || trip.DepartureTo.Before(now) || trip.DepartureFrom.After(now.Add(window)) {
+			continue
+		}
+		if locationFit(trip.Origin, from) > 0 && locationFit(trip.Destination, to) > 0 {
+			travelers[trip.TravelerID] = true
+		}
+	}
+	return travelers
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// UserIncident is recorded on a user's profile in user-service, e.g. when a
+// sender refuses the inspection of their item.
+type UserIncident struct {
+	Type       string `json:"type"`
+	ShipmentID string `json:"shipment_id"`
+	Notes      string `json:"notes,omitempty"`
+	ReportedBy string `json:"reported_by"`
+	// Penalties are applied to the user's profile, e.g. RANKING_DEMOTION
+	// for DemotionDays after a late traveler cancellation.
+	Penalties    []string `json:"penalties,omitempty"`
+	DemotionDays int      `json:"demotion_days,omitempty"`
+}
+
+// UserProfile is the part of a user-service profile shipment-service needs.
+type UserProfile struct {
+	ID                 string  `json:"id"`
+	Email              string  `json:"email"`
+	FirstName          string  `json:"first_name"`
+	LastName           string  `json:"last_name"`
+	Rating             float64 `json:"rating"`
+	CompletedShipments int     `json:"completed_shipments"`
+	// RankingDemotedUntil is set while a late-cancellation penalty lowers
+	// the traveler in the ranking.
+	RankingDemotedUntil *time.Time `json:"ranking_demoted_until,omitempty"`
+}
+
+var errUserServiceNotConfigured = errors.New("user-service not configured")
+
+// UserServiceClient is the synchronous interface to user-service.
+type UserServiceClient interface {
+	GetUser(userID string) (UserProfile, error)
+	RecordIncident(userID string, incident UserIncident) error
+}
+
+var userService UserServiceClient = newUserServiceClient(os.Getenv("USER_SERVICE_URL"), os.Getenv("SERVICE_TOKEN"))
+
+func newUserServiceClient(baseURL, serviceToken string) UserServiceClient {
+	if baseURL == "" {
+		return logUserServiceClient{}
+	}
+	return &httpUserServiceClient{
+		baseURL:      strings.TrimSuffix(baseURL, "/"),
+		serviceToken: serviceToken,
+		client:       &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// httpUserServiceClient authenticates writes with the SERVICE_TOKEN shared
+// secret user-service expects in X-Service-Token.
+type httpUserServiceClient struct {
+	baseURL      string
+	serviceToken string
+	client       *http.Client
+}
+
+func (c *httpUserServiceClient) GetUser(userID string) (UserProfile, error) {
+	resp, err := c.client.Get(c.baseURL + "/api/v1/users/" + url.PathEscape(userID))
+	if err != nil {
+		return UserProfile{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return UserProfile{}, fmt.Errorf("user-service returned %s", resp.Status)
+	}
+
+	var profile UserProfile
+	if err := json.NewDecoder(resp.Body).Decode(&profile); err != nil {
+		return UserProfile{}, err
+	}
+	return profile, nil
+}
+
+func (c *httpUserServiceClient) RecordIncident(userID string, incident UserIncident) error {
+	body, err := json.Marshal(incident)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", c.baseURL+"/api/v1/users/"+url.PathEscape(userID)+"/incidents", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Service-Token", c.serviceToken)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("user-service returned %s", resp.Status)
+	}
+	return nil
+}
+
+// logUserServiceClient is used when USER_SERVICE_URL is not configured.
+type logUserServiceClient struct{}
+
+func (logUserServiceClient) GetUser(userID string) (UserProfile, error) {
+	return UserProfile{}, errUserServiceNotConfigured
+}
+
+func (logUserServiceClient) RecordIncident(userID string, incident UserIncident) error {
+	log.Printf("incident %s for user %s on shipment %s (user-service not configured)", incident.Type, userID, incident.ShipmentID)
+	return nil
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WebhookDeliveryPending   = "PENDING"
+	WebhookDeliveryDelivered = "DELIVERED"
+	WebhookDeliveryDead      = "DEAD"
+	// A test delivery that failed, test deliveries are not retried
+	WebhookDeliveryFailed = "FAILED"
+
+	EventWebhookTest = "WebhookTest"
+
+	maxWebhookAttempts     = 8
+	webhookRetryBackoff    = 10 * time.Second
+	webhookDispatchTick    = time.Second
+	maxWebhookResponseBody = 1024
+	// Subscriptions are sent to in parallel, at most this many at once
+	maxWebhookWorkers = 8
+	// Delivered deliveries are kept this long for the delivery log
+	webhookDeliveryRetention = 7 * 24 * time.Hour
+)
+
+// webhookEventTypes are the event types a subscription can choose from. No
+// event types means all of them.
+var webhookEventTypes = map[string]bool{
+	EventShipmentPosted:         true,
+	EventBidPlaced:              true,
+	EventShipmentAccepted:       true,
+	EventShipmentStatusChanged:  true,
+	EventShipmentUpdated:        true,
+	EventShipmentDelivered:      true,
+	EventShipmentCancelled:      true,
+	EventShipmentDelayed:        true,
+	EventShipmentBackOnSchedule: true,
+	EventDisputeOpened:          true,
+	EventDisputeResolved:        true,
+}
+
+// WebhookSubscription is a partner endpoint that receives shipment events.
+// The secret is only returned when the subscription is created.
+type WebhookSubscription struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"event_types"`
+	Secret     string    `json:"secret,omitempty"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery is one event sent to one subscription, with every attempt.
+type WebhookDelivery struct {
+	ID             string           `json:"id"`
+	SubscriptionID string           `json:"subscription_id"`
+	Event          DomainEvent      `json:"event"`
+	Status         string           `json:"status"`
+	Attempts       []WebhookAttempt `json:"attempts"`
+	NextAttemptAt  *time.Time       `json:"next_attempt_at,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+	DeliveredAt    *time.Time       `json:"delivered_at,omitempty"`
+}
+
+type WebhookAttempt struct {
+	At           time.Time `json:"at"`
+	StatusCode   int       `json:"status_code,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	ResponseBody string    `json:"response_body,omitempty"`
+	DurationMs   int64     `json:"duration_ms"`
+}
+
+type WebhookSubscriptionRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Secret     string   `json:"secret"`
+	Active     *bool    `json:"active"`
+}
+
+// webhookRegistry holds the subscriptions and their deliveries. Deliveries
+// are created together with the outbox entry, so a partner gets every event
+// that was stored.
+type webhookRegistry struct {
+	mu            sync.Mutex
+	subscriptions map[string]*WebhookSubscription
+	deliveries    []*WebhookDelivery
+	// sending holds the subscriptions a worker is currently sending to
+	sending map[string]bool
+	workers chan struct{}
+	client  *http.Client
+}
+
+var webhooks = &webhookRegistry{
+	subscriptions: make(map[string]*WebhookSubscription),
+	sending:       make(map[string]bool),
+	workers:       make(chan struct{}, maxWebhookWorkers),
+	client:        &http.Client{Timeout: 10 * time.Second},
+}
+
+// enqueue creates a delivery for every active subscription of the event
+// type.
+func (reg *webhookRegistry) enqueue(event DomainEvent) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	for _, subscription := range reg.subscriptions {
+		if subscription.Active && subscription.wants(event.Type) {
+			reg.deliveries = append(reg.deliveries, newWebhookDelivery(subscription.ID, event))
+		}
+	}
+}
+
+func (s *WebhookSubscription) wants(eventType string) bool {
+	if len(s.EventTypes) == 0 {
+		return true
+	}
+	for _, wanted := range s.EventTypes {
+		if wanted == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func newWebhookDelivery(subscriptionID string, event DomainEvent) *WebhookDelivery {
+	now := time.Now()
+	return &WebhookDelivery{
+		ID:             "whd-" + randomHex(8),
+		SubscriptionID: subscriptionID,
+		Event:          event,
+		Status:         WebhookDeliveryPending,
+		Attempts:       []WebhookAttempt{},
+		NextAttemptAt:  &now,
+		CreatedAt:      now,
+	}
+}
+
+// Run sends due deliveries until the process stops. Each subscription gets
+// its own worker, so a slow partner endpoint only holds up its own
+// deliveries, which still arrive in order.
+func (reg *webhookRegistry) Run() {
+	for {
+		time.Sleep(webhookDispatchTick)
+
+		now := time.Now()
+		due := make(map[string][]*WebhookDelivery)
+		reg.mu.Lock()
+		reg.prune(now)
+		for _, delivery := range reg.deliveries {
+			if reg.sending[delivery.SubscriptionID] {
+				continue
+			}
+			if delivery.Status == WebhookDeliveryPending && delivery.NextAttemptAt != nil && !now.Before(*delivery.NextAttemptAt) {
+				due[delivery.SubscriptionID] = append(due[delivery.SubscriptionID], delivery)
+			}
+		}
+		for subscriptionID := range due {
+			reg.sending[subscriptionID] = true
+		}
+		reg.mu.Unlock()
+
+		for subscriptionID, deliveries := range due {
+			go reg.send(subscriptionID, deliveries)
+		}
+	}
+}
+
+// send attempts the due deliveries of one subscription once a worker is
+// free.
+func (reg *webhookRegistry) send(subscriptionID string, deliveries []*WebhookDelivery) {
+	reg.workers <- struct{}{}
+	defer func() {
+		<-reg.workers
+		reg.mu.Lock()
+		delete(reg.sending, subscriptionID)
+		reg.mu.Unlock()
+	}()
+
+	for _, delivery := range deliveries {
+		reg.attempt(delivery)
+	}
+}
+
+// prune drops the deliveries delivered longer than webhookDeliveryRetention
+// ago. Pending deliveries and dead letters are kept. The caller holds mu.
+func (reg *webhookRegistry) prune(now time.Time) {
+	kept := reg.deliveries[:0]
+	for _, delivery := range reg.deliveries {
+		if delivery.Status == WebhookDeliveryDelivered && delivery.DeliveredAt != nil && now.Sub(*delivery.DeliveredAt) > webhookDeliveryRetention {
+			continue
+		}
+		kept = append(kept, delivery)
+	}
+	for i := len(kept); i < len(reg.deliveries); i++ {
+		reg.deliveries[i] = nil
+	}
+	reg.deliveries = kept
+}
+
+// attempt posts the event once. Failures are retried with exponential
+// backoff, after maxWebhookAttempts the delivery goes to the dead letters.
+func (reg *webhookRegistry) attempt(delivery *WebhookDelivery) {
+	reg.mu.Lock()
+	subscription, exists := reg.subscriptions[delivery.SubscriptionID]
+	var target, secret string
+	if exists {
+		target, secret = subscription.URL, subscription.Secret
+	}
+	reg.mu.Unlock()
+
+	result := WebhookAttempt{At: time.Now()}
+	if !exists {
+		result.Error = "subscription deleted"
+	} else {
+		result = reg.post(target, secret, delivery)
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	delivery.Attempts = append(delivery.Attempts, result)
+	switch {
+	case result.Error == "" && result.StatusCode >= 200 && result.StatusCode < 300:
+		delivery.Status = WebhookDeliveryDelivered
+		delivery.DeliveredAt = &result.At
+		delivery.NextAttemptAt = nil
+	case !exists || len(delivery.Attempts) >= maxWebhookAttempts:
+		delivery.Status = WebhookDeliveryDead
+		delivery.NextAttemptAt = nil
+		log.Printf("webhook delivery %s of event %s moved to dead letters", delivery.ID, delivery.Event.ID)
+	default:
+		next := time.Now().Add(webhookRetryBackoff << (len(delivery.Attempts) - 1))
+		delivery.NextAttemptAt = &next
+	}
+}
+
+// post sends the signed payload. The signature covers the timestamp and the
+// body, so receivers can reject replayed requests.
+func (reg *webhookRegistry) post(target, secret string, delivery *WebhookDelivery) WebhookAttempt {
+	started := time.Now()
+	result := WebhookAttempt{At: started}
+
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	timestamp := strconv.FormatInt(started.Unix(), 10)
+
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Bringee-Webhooks/1.0")
+	req.Header.Set("X-Bringee-Event", delivery.Event.Type)
+	req.Header.Set("X-Bringee-Delivery", delivery.ID)
+	req.Header.Set("X-Bringee-Timestamp", timestamp)
+	req.Header.Set("X-Bringee-Signature", "t="+timestamp+",v1="+signWebhook(secret, timestamp, body))
+
+	resp, err := reg.client.Do(req)
+	result.DurationMs = time.Since(started).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	response, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponseBody))
+	result.StatusCode = resp.StatusCode
+	result.ResponseBody = string(response)
+	return result
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "{timestamp}.{body}".
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (reg *webhookRegistry) deliveriesOf(subscriptionID, status string) []WebhookDelivery {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	list := []WebhookDelivery{}
+	for _, delivery := range reg.deliveries {
+		if (subscriptionID == "" || delivery.SubscriptionID == subscriptionID) && (status == "" || delivery.Status == status) {
+			list = append(list, *delivery)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+func validWebhookURL(raw string) error {
+	target, err := url.Parse(raw)
+	if err != nil || target.Host == "" {
+		return fmt.Errorf("url must be an absolute URL")
+	}
+	// Plain HTTP is only accepted for local test receivers
+	host := target.Hostname()
+	local := host == "localhost" || net.ParseIP(host).IsLoopback()
+	if target.Scheme != "https" && !(target.Scheme == "http" && local) {
+		return fmt.Errorf("url must use https")
+	}
+	return nil
+}
+
+func validWebhookEventTypes(eventTypes []string) error {
+	for _, eventType := range eventTypes {
+		if !webhookEventTypes[eventType] {
+			return fmt.Errorf("unknown event type %q", eventType)
+		}
+	}
+	return nil
+}
+
+// webhooksHandler lists and creates webhook subscriptions.
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		webhooks.mu.Lock()
+		list := []WebhookSubscription{}
+		for _, subscription := range webhooks.subscriptions {
+			view := *subscription
+			view.Secret = ""
+			list = append(list, view)
+		}
+		webhooks.mu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"webhooks": list,
+			"total":    len(list),
+		})
+
+	case "POST":
+		var req WebhookSubscriptionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := validWebhookURL(req.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validWebhookEventTypes(req.EventTypes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Secret == "" {
+			req.Secret = "whsec_" + randomHex(24)
+		}
+		if req.EventTypes == nil {
+			req.EventTypes = []string{}
+		}
+
+		now := time.Now()
+		subscription := &WebhookSubscription{
+			ID:         "wh-" + randomHex(8),
+			URL:        req.URL,
+			EventTypes: req.EventTypes,
+			Secret:     req.Secret,
+			Active:     req.Active == nil || *req.Active,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+		webhooks.mu.Lock()
+		webhooks.subscriptions[subscription.ID] = subscription
+		webhooks.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(subscription)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookHandler serves /api/v1/admin/webhooks/{id} and its deliveries and
+// test actions.
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/webhooks/"), "/")
+	subscriptionID, action, _ := strings.Cut(rest, "/")
+
+	webhooks.mu.Lock()
+	subscription, exists := webhooks.subscriptions[subscriptionID]
+	webhooks.mu.Unlock()
+	if !exists {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "":
+	case "deliveries":
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		list := webhooks.deliveriesOf(subscriptionID, strings.ToUpper(r.URL.Query().Get("status")))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"deliveries": list,
+			"total":      len(list),
+		})
+		return
+	case "test":
+		webhookTestHandler(w, r, subscription)
+		return
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		webhooks.mu.Lock()
+		view := *subscription
+		webhooks.mu.Unlock()
+		view.Secret = ""
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(view)
+
+	case "PUT":
+		var req WebhookSubscriptionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.URL != "" {
+			if err := validWebhookURL(req.URL); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := validWebhookEventTypes(req.EventTypes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		webhooks.mu.Lock()
+		if req.URL != "" {
+			subscription.URL = req.URL
+		}
+		if req.EventTypes != nil {
+			subscription.EventTypes = req.EventTypes
+		}
+		if req.Secret != "" {
+			subscription.Secret = req.Secret
+		}
+		if req.Active != nil {
+			subscription.Active = *req.Active
+		}
+		subscription.UpdatedAt = time.Now()
+		view := *subscription
+		webhooks.mu.Unlock()
+		view.Secret = ""
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(view)
+
+	case "DELETE":
+		webhooks.mu.Lock()
+		delete(webhooks.subscriptions, subscriptionID)
+		webhooks.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookTestHandler sends a WebhookTest event right away and returns the
+// delivery, so partners can check their endpoint and signature check. The
+// delivery is not queued: the relay would send it a second time, and a
+// failed test is reported rather than retried.
+func webhookTestHandler(w http.ResponseWriter, r *http.Request, subscription *WebhookSubscription) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	event := DomainEvent{
+		ID:          newEventID(),
+		Type:        EventWebhookTest,
+		AggregateID: "shipment-test",
+		Version:     1,
+		OccurredAt:  time.Now(),
+		Data: ShipmentEventData{
+			ShipmentID:   "shipment-test",
+			SenderID:     "sender-test",
+			Status:       "POSTED",
+			FromLocation: "Berlin",
+			ToLocation:   "München",
+		},
+	}
+	delivery := newWebhookDelivery(subscription.ID, event)
+	delivery.NextAttemptAt = nil
+	webhooks.mu.Lock()
+	target, secret := subscription.URL, subscription.Secret
+	webhooks.mu.Unlock()
+
+	result := webhooks.post(target, secret, delivery)
+	delivery.Attempts = append(delivery.Attempts, result)
+	if result.Error == "" && result.StatusCode >= 200 && result.StatusCode < 300 {
+		delivery.Status = WebhookDeliveryDelivered
+		delivery.DeliveredAt = &result.At
+	} else {
+		delivery.Status = WebhookDeliveryFailed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(delivery)
+}
+
+// webhookDeadLettersHandler lists deliveries that ran out of attempts.
+func webhookDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	list := webhooks.deliveriesOf(r.URL.Query().Get("subscription_id"), WebhookDeliveryDead)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dead_letters": list,
+		"total":        len(list),
+	})
+}
+
+// webhookDeadLetterHandler serves POST
+// /api/v1/admin/webhook-dead-letters/{id}/redeliver, which queues a dead
+// delivery again with a fresh set of attempts.
+func webhookDeadLetterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/webhook-dead-letters/"), "/")
+	deliveryID, action, _ := strings.Cut(rest, "/")
+	if action != "redeliver" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	webhooks.mu.Lock()
+	defer webhooks.mu.Unlock()
+	for _, delivery := range webhooks.deliveries {
+		if delivery.ID != deliveryID {
+			continue
+		}
+		if delivery.Status != WebhookDeliveryDead {
+			http.Error(w, "Only dead deliveries can be redelivered", http.StatusConflict)
+			return
+		}
+		if _, exists := webhooks.subscriptions[delivery.SubscriptionID]; !exists {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		redelivery := newWebhookDelivery(delivery.SubscriptionID, delivery.Event)
+		webhooks.deliveries = append(webhooks.deliveries, redelivery)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(redelivery)
+		return
+	}
+	http.Error(w, "Dead letter not found", http.StatusNotFound)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
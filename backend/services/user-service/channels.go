@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ChannelPush  = "push"
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// NotificationChannel is the adapter every delivery provider implements:
+// Firebase Cloud Messaging for push, an e-mail provider and an SMS gateway.
+type NotificationChannel interface {
+	Name() string
+	Send(notification Notification) error
+}
+
+var notificationChannels = map[string]NotificationChannel{
+	ChannelPush:  newPushChannel(os.Getenv("PUSH_CHANNEL")),
+	ChannelEmail: newEmailChannel(os.Getenv("EMAIL_CHANNEL")),
+	ChannelSMS:   newSMSChannel(os.Getenv("SMS_CHANNEL")),
+}
+
+func newPushChannel(name string) NotificationChannel {
+	switch strings.ToLower(name) {
+	case "", "log":
+		return logChannel{name: ChannelPush}
+	default:
+		log.Printf("⚠️ Unknown push channel %q, falling back to log channel", name)
+		return logChannel{name: ChannelPush}
+	}
+}
+
+func newEmailChannel(name string) NotificationChannel {
+	switch strings.ToLower(name) {
+	case "", "file":
+		return newFileEmailChannel(os.Getenv("NOTIFICATION_MAIL_DIR"))
+	case "log":
+		return logChannel{name: ChannelEmail}
+	default:
+		log.Printf("⚠️ Unknown email channel %q, falling back to file channel", name)
+		return newFileEmailChannel(os.Getenv("NOTIFICATION_MAIL_DIR"))
+	}
+}
+
+func newSMSChannel(name string) NotificationChannel {
+	switch strings.ToLower(name) {
+	case "", "log":
+		return logChannel{name: ChannelSMS}
+	default:
+		log.Printf("⚠️ Unknown SMS channel %q, falling back to log channel", name)
+		return logChannel{name: ChannelSMS}
+	}
+}
+
+// logChannel writes notifications to the log instead of delivering them.
+type logChannel struct {
+	name string
+}
+
+func (c logChannel) Name() string {
+	return c.name
+}
+
+func (c logChannel) Send(notification Notification) error {
+	if notification.Recipient == "" {
+		return fmt.Errorf("no %s recipient for user %s", c.name, notification.UserID)
+	}
+	log.Printf("📨 %s to %s: %s - %s", c.name, notification.Recipient, notification.Subject, notification.Body)
+	return nil
+}
+
+// fileEmailChannel stores every e-mail as an .eml file, so local mails can
+// be opened with any mail client.
+type fileEmailChannel struct {
+	dir string
+}
+
+func newFileEmailChannel(dir string) *fileEmailChannel {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "bringee-mail")
+	}
+	return &fileEmailChannel{dir: dir}
+}
+
+func (c *fileEmailChannel) Name() string {
+	return ChannelEmail
+}
+
+func (c *fileEmailChannel) Send(notification Notification) error {
+	if notification.Recipient == "" {
+		return fmt.Errorf("no email address for user %s", notification.UserID)
+	}
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("To: %s\r\nFrom: Bringee <noreply@bringee.com>\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		notification.Recipient, notification.Subject, time.Now().Format(time.RFC1123Z), notification.Body)
+	return os.WriteFile(filepath.Join(c.dir, notification.ID+".eml"), []byte(message), 0o644)
+}
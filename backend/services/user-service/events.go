@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	EventBidPlaced         = "BidPlaced"
+	EventShipmentAccepted  = "ShipmentAccepted"
+	EventShipmentDelivered = "ShipmentDelivered"
+	EventShipmentCancelled = "ShipmentCancelled"
+	EventShipmentDelayed   = "ShipmentDelayed"
+
+	// Pub/Sub retains unacknowledged messages for at most 7 days, older
+	// event IDs cannot be redelivered
+	processedEventRetention = 7 * 24 * time.Hour
+)
+
+// ShipmentEvent is the domain event envelope published by shipment-service.
+type ShipmentEvent struct {
+	ID          string            `json:"id"`
+	Type        string            `json:"type"`
+	AggregateID string            `json:"aggregate_id"`
+	Version     int               `json:"version"`
+	OccurredAt  time.Time         `json:"occurred_at"`
+	Data        ShipmentEventData `json:"data"`
+}
+
+type ShipmentEventData struct {
+	ShipmentID      string     `json:"shipment_id"`
+	SenderID        string     `json:"sender_id"`
+	TravelerID      string     `json:"traveler_id"`
+	Status          string     `json:"status"`
+	AgreedFeeUSD    float64    `json:"agreed_fee_usd"`
+	BidID           string     `json:"bid_id"`
+	BidderID        string     `json:"bidder_id"`
+	BidPriceUSD     float64    `json:"bid_price_usd"`
+	CancelledBy     string     `json:"cancelled_by"`
+	CancelledByRole string     `json:"cancelled_by_role"`
+	Reason          string     `json:"reason"`
+	Reopened        bool       `json:"reopened"`
+	ETA             *time.Time `json:"eta"`
+	SlippageHours   float64    `json:"slippage_hours"`
+}
+
+// pubSubPushRequest is the body of a Pub/Sub push subscription request.
+type pubSubPushRequest struct {
+	Message struct {
+		Data       string            `json:"data"`
+		Attributes map[string]string `json:"attributes"`
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// processedEvents remembers handled events, because Pub/Sub delivers at
+// least once. It holds the event IDs and the eventKey of each event, so an
+// event published twice under different IDs is not applied twice either.
+// The lock also serialises the check and the update, so two concurrent
+// redeliveries cannot both be applied.
+var (
+	eventsMu        sync.Mutex
+	processedEvents = make(map[string]time.Time)
+	// processedOrder lists the processedEvents entries in the order they
+	// were added, so the expired ones are always at the front
+	processedOrder []processedEvent
+)
+
+type processedEvent struct {
+	id          string
+	processedAt time.Time
+}
+
+// pushToken must be set as ?token= on the push subscription. Without it
+// the endpoint refuses every request, as anyone could forge events.
+var pushToken = os.Getenv("PUBSUB_PUSH_TOKEN")
+
+// shipmentEventsPushHandler is the endpoint of the Pub/Sub push
+// subscription on the shipment-events topic. A 2xx response acknowledges
+// the message, anything else makes Pub/Sub redeliver it.
+func shipmentEventsPushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if pushToken == "" || subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(pushToken)) != 1 {
+		http.Error(w, "Invalid push token", http.StatusForbidden)
+		return
+	}
+
+	var push pubSubPushRequest
+	if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(push.Message.Data)
+	if err != nil {
+		http.Error(w, "Invalid message data", http.StatusBadRequest)
+		return
+	}
+	var event ShipmentEvent
+	if err := json.Unmarshal(data, &event); err != nil || event.ID == "" {
+		http.Error(w, "Invalid shipment event", http.StatusBadRequest)
+		return
+	}
+
+	applied := applyShipmentEvent(event)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"event_id": event.ID,
+		"applied":  applied,
+	})
+}
+
+// applyShipmentEvent updates the reputation counters and notifies the
+// participants once per event ID and reports whether the event was new.
+func applyShipmentEvent(event ShipmentEvent) bool {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+
+	key := eventKey(event)
+	if _, done := processedEvents[event.ID]; done {
+		return false
+	}
+	if _, done := processedEvents[key]; done {
+		markEventProcessed(event.ID)
+		return false
+	}
+
+	switch event.Type {
+	case EventBidPlaced:
+		notifyUser(event.Data.SenderID, TemplateBidPlaced, event.ID, event.Data)
+
+	case EventShipmentAccepted:
+		notifyUser(event.Data.SenderID, TemplateShipmentAccepted, event.ID, event.Data)
+
+	case EventShipmentDelayed:
+		notifyUser(event.Data.SenderID, TemplateShipmentDelayed, event.ID, event.Data)
+
+	case EventShipmentDelivered:
+		for _, userID := range []string{event.Data.SenderID, event.Data.TravelerID} {
+			updateUser(userID, func(user *User) {
+				user.CompletedShipments++
+			})
+			notifyUser(userID, TemplateShipmentDelivered, event.ID, event.Data)
+		}
+
+	case EventShipmentCancelled:
+		updateUser(event.Data.CancelledBy, func(user *User) {
+			user.CancelledShipments++
+		})
+		// The other party learns about the cancellation
+		for _, userID := range []string{event.Data.SenderID, event.Data.TravelerID} {
+			if userID != event.Data.CancelledBy {
+				notifyUser(userID, TemplateShipmentCancelled, event.ID, event.Data)
+			}
+		}
+		// A refused inspection is an incident of the sender. It is normally
+		// recorded synchronously, the event only fills the gap if that
+		// call failed.
+		if event.Data.Reason == "INSPECTION_REFUSED" && !hasIncident(event.Data.SenderID, "INSPECTION_REFUSED", event.Data.ShipmentID) {
+			if user, exists := users[event.Data.SenderID]; exists {
+				recordIncident(user, CreateIncidentRequest{
+					Type:       "INSPECTION_REFUSED",
+					ShipmentID: event.Data.ShipmentID,
+					ReportedBy: event.Data.CancelledBy,
+				})
+			}
+		}
+	}
+
+	markEventProcessed(event.ID)
+	markEventProcessed(key)
+	return true
+}
+
+// eventKey identifies what an event reports independently of its ID: the
+// shipment and event type, plus whatever may legitimately repeat for the
+// same shipment, e.g. each bid or a cancellation by the next traveler.
+func eventKey(event ShipmentEvent) string {
+	key := event.Data.ShipmentID + "/" + event.Type
+	switch event.Type {
+	case EventBidPlaced:
+		key += "/" + event.Data.BidID
+	case EventShipmentAccepted:
+		key += "/" + event.Data.TravelerID
+	case EventShipmentCancelled:
+		key += "/" + event.Data.CancelledBy
+	case EventShipmentDelayed:
+		// A shipment can fall behind again after catching up
+		key += "/" + event.OccurredAt.UTC().Format(time.RFC3339Nano)
+	}
+	return key
+}
+
+func updateUser(userID string, update func(user *User)) {
+	user, exists := users[userID]
+	if !exists {
+		if userID != "" {
+			log.Printf("shipment event for unknown user %s ignored", userID)
+		}
+		return
+	}
+	update(&user)
+	user.UpdatedAt = time.Now()
+	users[userID] = user
+}
+
+// markEventProcessed records an event and forgets those older than
+// processedEventRetention.
+func markEventProcessed(eventID string) {
+	now := time.Now()
+	for len(processedOrder) > 0 && now.Sub(processedOrder[0].processedAt) > processedEventRetention {
+		expired := processedOrder[0]
+		if processedEvents[expired.id].Equal(expired.processedAt) {
+			delete(processedEvents, expired.id)
+		}
+		processedOrder = processedOrder[1:]
+	}
+	processedEvents[eventID] = now
+	processedOrder = append(processedOrder, processedEvent{id: eventID, processedAt: now})
+}
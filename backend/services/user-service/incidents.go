@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	AccountActive    = "ACTIVE"
+	AccountWarned    = "WARNED"
+	AccountSuspended = "SUSPENDED"
+
+	// Incidents needed before a user is warned or suspended (spec 6.2.3)
+	incidentWarningThreshold    = 2
+	incidentSuspensionThreshold = 3
+
+	// Penalties for late traveler cancellations (spec 6.5.2)
+	PenaltyRankingDemotion = "RANKING_DEMOTION"
+	PenaltyProStatusLoss   = "PRO_STATUS_LOSS"
+)
+
+// Incident is a terms-of-service violation recorded on a user's profile,
+// e.g. a sender refusing the inspection of their item.
+type Incident struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	Type       string    `json:"type"`
+	ShipmentID string    `json:"shipment_id"`
+	Notes      string    `json:"notes,omitempty"`
+	ReportedBy string    `json:"reported_by"`
+	Penalties  []string  `json:"penalties,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type CreateIncidentRequest struct {
+	Type         string   `json:"type"`
+	ShipmentID   string   `json:"shipment_id"`
+	Notes        string   `json:"notes"`
+	ReportedBy   string   `json:"reported_by"`
+	Penalties    []string `json:"penalties"`
+	DemotionDays int      `json:"demotion_days"`
+}
+
+var userIncidents = make(map[string][]Incident)
+
+// serviceToken is the shared secret other services send in X-Service-Token
+// to record incidents. Without it incidents cannot be recorded over HTTP.
+var serviceToken = os.Getenv("SERVICE_TOKEN")
+
+func requireServiceToken(w http.ResponseWriter, r *http.Request) bool {
+	if serviceToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Service-Token")), []byte(serviceToken)) == 1 {
+		return true
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+func userIncidentsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := userPathParts(r.URL.Path)
+	user, exists := users[userID]
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		incidents := userIncidents[userID]
+		if incidents == nil {
+			incidents = []Incident{}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"incidents":      incidents,
+			"total":          len(incidents),
+			"account_status": user.AccountStatus,
+		})
+
+	case "POST":
+		// Incidents penalize a user, only services may record them
+		if !requireServiceToken(w, r) {
+			return
+		}
+		var req CreateIncidentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Type == "" {
+			http.Error(w, "Incident type is required", http.StatusBadRequest)
+			return
+		}
+
+		incident, user := recordIncident(user, req)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"incident":       incident,
+			"incident_count": user.IncidentCount,
+			"account_status": user.AccountStatus,
+			"pro_status":     user.ProStatus,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// recordIncident stores the incident and updates the account status and
+// penalties of the user.
+func recordIncident(user User, req CreateIncidentRequest) (Incident, User) {
+	incident := Incident{
+		ID:         "incident-" + strconv.FormatInt(time.Now().UnixNano(), 10),
+		UserID:     user.ID,
+		Type:       req.Type,
+		ShipmentID: req.ShipmentID,
+		Notes:      req.Notes,
+		ReportedBy: req.ReportedBy,
+		Penalties:  req.Penalties,
+		CreatedAt:  time.Now(),
+	}
+	userIncidents[user.ID] = append(userIncidents[user.ID], incident)
+
+	user.IncidentCount = len(userIncidents[user.ID])
+	user.AccountStatus = accountStatusFor(user.IncidentCount)
+	applyPenalties(&user, req.Penalties, req.DemotionDays)
+	user.UpdatedAt = time.Now()
+	users[user.ID] = user
+	return incident, user
+}
+
+// hasIncident reports whether an incident of this type was already recorded
+// for the shipment, e.g. synchronously before its event arrives.
+func hasIncident(userID, incidentType, shipmentID string) bool {
+	for _, incident := range userIncidents[userID] {
+		if incident.Type == incidentType && incident.ShipmentID == shipmentID {
+			return true
+		}
+	}
+	return false
+}
+
+func accountStatusFor(incidentCount int) string {
+	switch {
+	case incidentCount >= incidentSuspensionThreshold:
+		return AccountSuspended
+	case incidentCount >= incidentWarningThreshold:
+		return AccountWarned
+	}
+	return AccountActive
+}
+
+// applyPenalties demotes the user in the traveler ranking for the given
+// number of days and revokes the Pro status. A demotion never shortens an
+// earlier, longer one.
+func applyPenalties(user *User, penalties []string, demotionDays int) {
+	for _, penalty := range penalties {
+		switch penalty {
+		case PenaltyRankingDemotion:
+			if demotionDays <= 0 {
+				continue
+			}
+			until := time.Now().AddDate(0, 0, demotionDays)
+			if user.RankingDemotedUntil == nil || until.After(*user.RankingDemotedUntil) {
+				user.RankingDemotedUntil = &until
+			}
+		case PenaltyProStatusLoss:
+			user.ProStatus = false
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"bringee.com/listing"
+)
+
+var userSortKeys = listing.SortKeys[User]{
+	"created_at":          func(u User) string { return listing.TimeKey(u.CreatedAt) },
+	"rating":              func(u User) string { return listing.NumberKey(u.Rating) },
+	"completed_shipments": func(u User) string { return listing.NumberKey(float64(u.CompletedShipments)) },
+	"username":            func(u User) string { return strings.ToLower(u.Username) },
+}
+
+// listUsers answers GET /api/v1/users. Filters: account_status (comma
+// separated), verified, pro_status, language, min_rating/max_rating,
+// created_after/created_before and the free-text search q over name,
+// username and email.
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query, err := listing.ParseQuery(values, userSortKeys, "-created_at")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := listing.Filter{Values: values}
+	accountStatuses := filter.Set("account_status")
+	languages := filter.Set("language")
+	verified, pro := filter.Boolean("verified"), filter.Boolean("pro_status")
+	minRating, maxRating := filter.Number("min_rating"), filter.Number("max_rating")
+	createdAfter, createdBefore := filter.Time("created_after"), filter.Time("created_before")
+	if filter.Err != nil {
+		http.Error(w, filter.Err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := values.Get("q")
+
+	matches := make([]User, 0, len(users))
+	for _, user := range users {
+		switch {
+		case !listing.InSet(accountStatuses, user.AccountStatus), !listing.InSet(languages, user.Language):
+		case verified != nil && user.Verified != *verified:
+		case pro != nil && user.ProStatus != *pro:
+		case !listing.InRange(user.Rating, minRating, maxRating):
+		case !listing.InTimeRange(user.CreatedAt, createdAfter, createdBefore):
+		case !listing.ContainsText(q, user.Username, user.FirstName+" "+user.LastName, user.Email):
+		default:
+			matches = append(matches, user)
+		}
+	}
+
+	page, next := listing.Paginate(matches, query, userSortKeys, func(u User) string { return u.ID })
+	listing.WritePage(w, "users", page, len(matches), query, next)
+}
+
+var chatSortKeys = listing.SortKeys[ChatMessage]{
+	"timestamp": func(m ChatMessage) string { return listing.TimeKey(m.Timestamp) },
+}
+
+// listChatMessages answers GET /api/v1/chat. Filters: sender_id,
+// receiver_id, user_id (either side of the conversation), with (together
+// with user_id, a single conversation), created_after/created_before and q.
+func listChatMessages(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query, err := listing.ParseQuery(values, chatSortKeys, "-timestamp")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := listing.Filter{Values: values}
+	createdAfter, createdBefore := filter.Time("created_after"), filter.Time("created_before")
+	if filter.Err != nil {
+		http.Error(w, filter.Err.Error(), http.StatusBadRequest)
+		return
+	}
+	senderID, receiverID := values.Get("sender_id"), values.Get("receiver_id")
+	userID, with, q := values.Get("user_id"), values.Get("with"), values.Get("q")
+
+	matches := make([]ChatMessage, 0, len(chatMessages))
+	for _, message := range chatMessages {
+		switch {
+		case senderID != "" && message.SenderID != senderID:
+		case receiverID != "" && message.ReceiverID != receiverID:
+		case userID != "" && message.SenderID != userID && message.ReceiverID != userID:
+		case with != "" && message.SenderID != with && message.ReceiverID != with:
+		case !listing.InTimeRange(message.Timestamp, createdAfter, createdBefore):
+		case !listing.ContainsText(q, message.Message):
+		default:
+			matches = append(matches, message)
+		}
+	}
+
+	page, next := listing.Paginate(matches, query, chatSortKeys, func(m ChatMessage) string { return m.ID })
+	listing.WritePage(w, "messages", page, len(matches), query, next)
+}
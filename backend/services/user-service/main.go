@@ -8,6 +8,8 @@ import (
 	"os"
 	"time"
 	"strconv"
+	"strings"
+	"sync"
 	"crypto/rand"
 	"encoding/hex"
 )
@@ -22,6 +24,15 @@ type User struct {
 	Verified    bool      `json:"verified"`
 	Rating      float64   `json:"rating"`
 	CompletedShipments int `json:"completed_shipments"`
+	CancelledShipments int `json:"cancelled_shipments"`
+	IncidentCount int      `json:"incident_count"`
+	AccountStatus string   `json:"account_status"`
+	ProStatus   bool      `json:"pro_status"`
+	RankingDemotedUntil *time.Time `json:"ranking_demoted_until,omitempty"`
+	Language    string    `json:"language"`
+	NotificationChannels []string `json:"notification_channels"`
+	NotificationPreferences NotificationPreferences `json:"notification_preferences"`
+	DeviceTokens []string `json:"-"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
@@ -39,6 +50,9 @@ type UpdateUserRequest struct {
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
 	Phone     string `json:"phone"`
+	Language  string `json:"language"`
+	NotificationChannels []string `json:"notification_channels"`
+	NotificationPreferences *NotificationPreferences `json:"notification_preferences"`
 }
 
 type AuthRequest struct {
@@ -80,6 +94,21 @@ type ChatMessage struct {
 // In production, this would be a database
 var users = make(map[string]User)
 var userTokens = make(map[string]string)
+var chatMessages []ChatMessage
+
+// storeMu guards the in-memory maps of this service. Every request holds it
+// (see withStoreLock), and background jobs take it before they read a user,
+// so the maps are never read and written at the same time.
+var storeMu sync.Mutex
+
+// withStoreLock runs each request with storeMu held.
+func withStoreLock(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storeMu.Lock()
+		defer storeMu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
 
 func main() {
 	log.Println("🚀 Starting Bringee User Service...")
@@ -91,6 +120,8 @@ func main() {
 
 	// Initialize some demo users
 	initializeDemoUsers()
+	
+	go retryNotifications()
 
 	http.HandleFunc("/", handler)
 	http.HandleFunc("/health", healthHandler)
@@ -101,9 +132,10 @@ func main() {
 	http.HandleFunc("/api/v1/auth/verify", verifyHandler)
 	http.HandleFunc("/api/v1/shipments", shipmentsHandler)
 	http.HandleFunc("/api/v1/chat", chatHandler)
+	http.HandleFunc("/api/v1/events/shipments", shipmentEventsPushHandler)
 	
 	log.Printf("📡 Listening on port %s", port)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), withStoreLock(http.DefaultServeMux)))
 }
 
 func initializeDemoUsers() {
@@ -117,6 +149,10 @@ func initializeDemoUsers() {
 		Verified:    true,
 		Rating:      4.8,
 		CompletedShipments: 8,
+		AccountStatus: AccountActive,
+		ProStatus:   true,
+		Language:    "de",
+		NotificationPreferences: defaultNotificationPreferences(),
 		CreatedAt:   time.Now().AddDate(0, -2, 0),
 		UpdatedAt:   time.Now(),
 	}
@@ -131,9 +167,37 @@ func initializeDemoUsers() {
 		Verified:    true,
 		Rating:      4.9,
 		CompletedShipments: 12,
+		AccountStatus: AccountActive,
+		ProStatus:   true,
+		Language:    "de",
+		NotificationPreferences: defaultNotificationPreferences(),
 		CreatedAt:   time.Now().AddDate(0, -3, 0),
 		UpdatedAt:   time.Now(),
 	}
+	
+	chatMessages = []ChatMessage{
+		{
+			ID:         "msg-001",
+			SenderID:   "1",
+			ReceiverID: "2",
+			Message:    "Wann können Sie die Sendung abholen?",
+			Timestamp:  time.Now().Add(-time.Hour),
+		},
+		{
+			ID:         "msg-002",
+			SenderID:   "2",
+			ReceiverID: "1",
+			Message:    "Morgen um 14:00 Uhr wäre perfekt",
+			Timestamp:  time.Now().Add(-30 * time.Minute),
+		},
+		{
+			ID:         "msg-003",
+			SenderID:   "1",
+			ReceiverID: "2",
+			Message:    "Perfekt, bis morgen!",
+			Timestamp:  time.Now().Add(-15 * time.Minute),
+		},
+	}
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
@@ -146,15 +210,22 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		"status": "running",
 		"endpoints": []string{
 			"GET /health",
-			"GET /api/v1/users",
+			"GET /api/v1/users?account_status=&verified=&pro_status=&language=&min_rating=&max_rating=&created_after=&created_before=&q=&sort=&limit=&cursor=",
 			"GET /api/v1/users/{id}",
+			"GET /api/v1/users/{id}/incidents",
+			"POST /api/v1/users/{id}/incidents",
+			"GET /api/v1/users/{id}/notifications",
+			"POST /api/v1/users/{id}/devices",
+			"GET /api/v1/users/{id}/preferences",
+			"PUT /api/v1/users/{id}/preferences",
 			"POST /api/v1/auth/login",
 			"POST /api/v1/auth/register",
 			"POST /api/v1/auth/verify",
 			"GET /api/v1/shipments",
 			"POST /api/v1/shipments",
-			"GET /api/v1/chat",
+			"GET /api/v1/chat?user_id=&with=&sender_id=&receiver_id=&created_after=&created_before=&q=&sort=&limit=&cursor=",
 			"POST /api/v1/chat",
+			"POST /api/v1/events/shipments",
 		},
 	}
 	
@@ -177,17 +248,7 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 func usersHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		// Return all users
-		userList := make([]User, 0, len(users))
-		for _, user := range users {
-			userList = append(userList, user)
-		}
-		
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"users": userList,
-			"total": len(userList),
-		})
+		listUsers(w, r)
 		
 	case "POST":
 		// Create new user
@@ -210,6 +271,9 @@ func usersHandler(w http.ResponseWriter, r *http.Request) {
 			Verified:    false,
 			Rating:      0.0,
 			CompletedShipments: 0,
+			AccountStatus: AccountActive,
+			Language:    defaultLanguage,
+			NotificationPreferences: defaultNotificationPreferences(),
 			CreatedAt:   time.Now(),
 			UpdatedAt:   time.Now(),
 		}
@@ -226,9 +290,27 @@ func usersHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func userHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract user ID from URL path
-	// This is a simplified implementation
-	userID := "1" // Mock ID for demo
+	userID, action := userPathParts(r.URL.Path)
+	
+	// Handle sub-routes like /api/v1/users/{id}/incidents
+	switch action {
+	case "":
+	case "incidents":
+		userIncidentsHandler(w, r)
+		return
+	case "notifications":
+		userNotificationsHandler(w, r)
+		return
+	case "devices":
+		userDevicesHandler(w, r)
+		return
+	case "preferences":
+		userPreferencesHandler(w, r)
+		return
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
 	
 	switch r.Method {
 	case "GET":
@@ -246,10 +328,31 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		
+		if err := validateChannels(req.NotificationChannels); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.NotificationPreferences != nil {
+			normalizePreferences(req.NotificationPreferences)
+			if err := validatePreferences(*req.NotificationPreferences); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		
 		if user, exists := users[userID]; exists {
 			user.FirstName = req.FirstName
 			user.LastName = req.LastName
 			user.Phone = req.Phone
+			if req.Language != "" {
+				user.Language = req.Language
+			}
+			if req.NotificationChannels != nil {
+				user.NotificationChannels = req.NotificationChannels
+			}
+			if req.NotificationPreferences != nil {
+				user.NotificationPreferences = *req.NotificationPreferences
+			}
 			user.UpdatedAt = time.Now()
 			
 			users[userID] = user
@@ -265,6 +368,15 @@ func userHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// userPathParts splits /api/v1/users/{id}/{action}/... into its ID and the
+// first segment of the optional action.
+func userPathParts(path string) (string, string) {
+	rest := strings.Trim(strings.TrimPrefix(path, "/api/v1/users/"), "/")
+	id, rest, _ := strings.Cut(rest, "/")
+	action, _, _ := strings.Cut(rest, "/")
+	return id, action
+}
+
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -280,6 +392,11 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	// Mock authentication - in production, verify password
 	for _, user := range users {
 		if user.Email == req.Email {
+			if user.AccountStatus == AccountSuspended {
+				http.Error(w, "Account suspended", http.StatusForbidden)
+				return
+			}
+			
 			// Generate mock token
 			token := generateToken()
 			userTokens[token] = user.ID
@@ -330,6 +447,9 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		Verified:    false,
 		Rating:      0.0,
 		CompletedShipments: 0,
+		AccountStatus: AccountActive,
+		Language:    defaultLanguage,
+		NotificationPreferences: defaultNotificationPreferences(),
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 	}
@@ -443,47 +563,27 @@ func shipmentsHandler(w http.ResponseWriter, r *http.Request) {
 func chatHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		// Mock chat messages
-		messages := []ChatMessage{
-			{
-				ID:         "msg-001",
-				SenderID:   "user-001",
-				ReceiverID: "user-002",
-				Message:    "Wann können Sie die Sendung abholen?",
-				Timestamp:  time.Now().Add(-time.Hour),
-			},
-			{
-				ID:         "msg-002",
-				SenderID:   "user-002",
-				ReceiverID: "user-001",
-				Message:    "Morgen um 14:00 Uhr wäre perfekt",
-				Timestamp:  time.Now().Add(-30 * time.Minute),
-			},
-			{
-				ID:         "msg-003",
-				SenderID:   "user-001",
-				ReceiverID: "user-002",
-				Message:    "Perfekt, bis morgen!",
-				Timestamp:  time.Now().Add(-15 * time.Minute),
-			},
-		}
-		
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"messages": messages,
-			"total":    len(messages),
-		})
+		listChatMessages(w, r)
 		
 	case "POST":
-		// Mock message creation
 		var message ChatMessage
 		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 		
-		message.ID = "msg-" + strconv.FormatInt(time.Now().Unix(), 10)
+		message.ID = "msg-" + strconv.FormatInt(time.Now().UnixNano(), 10)
 		message.Timestamp = time.Now()
+		chatMessages = append(chatMessages, message)
+		
+		senderName := "Bringee"
+		if sender, exists := users[message.SenderID]; exists {
+			senderName = sender.FirstName
+		}
+		notifyUser(message.ReceiverID, TemplateChatMessage, message.ID, map[string]interface{}{
+			"SenderName": senderName,
+			"Message":    message.Message,
+		})
 		
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
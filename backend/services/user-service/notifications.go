@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	NotificationPending = "PENDING"
+	NotificationSent    = "SENT"
+	NotificationFailed  = "FAILED"
+	// Held back for quiet hours or a digest
+	NotificationQueued = "QUEUED"
+	// Sent as part of a digest notification
+	NotificationBatched = "BATCHED"
+
+	TemplateBidPlaced         = "bid_placed"
+	TemplateShipmentAccepted  = "shipment_accepted"
+	TemplateShipmentDelivered = "shipment_delivered"
+	TemplateShipmentCancelled = "shipment_cancelled"
+	TemplateShipmentDelayed   = "shipment_delayed"
+	TemplateChatMessage       = "chat_message"
+	TemplateDigest            = "digest"
+
+	defaultLanguage          = "de"
+	maxNotificationAttempts  = 5
+	notificationRetryBackoff = 30 * time.Second
+	notificationRetryTick    = 15 * time.Second
+)
+
+var defaultNotificationChannels = []string{ChannelPush, ChannelEmail}
+
+// Notification is one message to one user over one channel, together with
+// its delivery status.
+type Notification struct {
+	ID            string     `json:"id"`
+	UserID        string     `json:"user_id"`
+	EventID       string     `json:"event_id,omitempty"`
+	Template      string     `json:"template"`
+	Language      string     `json:"language"`
+	Channel       string     `json:"channel"`
+	Recipient     string     `json:"recipient"`
+	Subject       string     `json:"subject"`
+	Body          string     `json:"body"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	Digest        bool       `json:"digest,omitempty"`
+	DigestID      string     `json:"digest_id,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+}
+
+type notificationTemplate struct {
+	Subject string
+	Body    string
+}
+
+// notificationTemplates holds the localized texts, German first like the
+// rest of the platform.
+var notificationTemplates = map[string]map[string]notificationTemplate{
+	TemplateBidPlaced: {
+		"de": {Subject: "Neues Angebot für Ihre Sendung", Body: "Für Ihre Sendung {{.ShipmentID}} liegt ein neues Angebot über {{printf \"%.2f\" .BidPriceUSD}} USD vor."},
+		"en": {Subject: "New offer for your shipment", Body: "You received a new offer of {{printf \"%.2f\" .BidPriceUSD}} USD for your shipment {{.ShipmentID}}."},
+	},
+	TemplateShipmentAccepted: {
+		"de": {Subject: "Ihre Sendung wurde angenommen", Body: "Ein Transporteur hat Ihre Sendung {{.ShipmentID}} für {{printf \"%.2f\" .AgreedFeeUSD}} USD angenommen."},
+		"en": {Subject: "Your shipment was accepted", Body: "A traveler accepted your shipment {{.ShipmentID}} for {{printf \"%.2f\" .AgreedFeeUSD}} USD."},
+	},
+	TemplateShipmentDelivered: {
+		"de": {Subject: "Sendung zugestellt", Body: "Die Sendung {{.ShipmentID}} wurde erfolgreich zugestellt. Vielen Dank, dass Sie Bringee nutzen!"},
+		"en": {Subject: "Shipment delivered", Body: "Shipment {{.ShipmentID}} was delivered successfully. Thank you for using Bringee!"},
+	},
+	TemplateShipmentCancelled: {
+		"de": {Subject: "Sendung storniert", Body: "{{if .Reopened}}Der Transporteur hat die Sendung {{.ShipmentID}} storniert. Ihre Sendung ist wieder für andere Transporteure ausgeschrieben.{{else}}Die Sendung {{.ShipmentID}} wurde storniert.{{end}}"},
+		"en": {Subject: "Shipment cancelled", Body: "{{if .Reopened}}The traveler cancelled shipment {{.ShipmentID}}. Your shipment is open to other travelers again.{{else}}Shipment {{.ShipmentID}} was cancelled.{{end}}"},
+	},
+	TemplateShipmentDelayed: {
+		"de": {Subject: "Ihre Sendung verspätet sich", Body: "Die Sendung {{.ShipmentID}} kommt voraussichtlich {{printf \"%.0f\" .SlippageHours}} Stunden später an als geplant{{if .ETA}}, neue Ankunftszeit: {{.ETA.UTC.Format \"02.01.2006 15:04\"}} UTC{{end}}."},
+		"en": {Subject: "Your shipment is delayed", Body: "Shipment {{.ShipmentID}} is expected to arrive {{printf \"%.0f\" .SlippageHours}} hours later than planned{{if .ETA}}, new arrival time: {{.ETA.UTC.Format \"2006-01-02 15:04\"}} UTC{{end}}."},
+	},
+	TemplateChatMessage: {
+		"de": {Subject: "Neue Nachricht", Body: "{{.SenderName}}: {{.Message}}"},
+		"en": {Subject: "New message", Body: "{{.SenderName}}: {{.Message}}"},
+	},
+	TemplateDigest: {
+		"de": {Subject: "Ihre Bringee-Zusammenfassung", Body: "Sie haben {{len .}} neue Benachrichtigungen:{{range .}}\n- {{.Subject}}: {{.Body}}{{end}}"},
+		"en": {Subject: "Your Bringee summary", Body: "You have {{len .}} new notifications:{{range .}}\n- {{.Subject}}: {{.Body}}{{end}}"},
+	},
+}
+
+type DeviceRequest struct {
+	Token string `json:"token"`
+}
+
+var (
+	notificationsMu   sync.Mutex
+	userNotifications = make(map[string][]*Notification)
+)
+
+// notifyUser renders the template in the user's language and sends it over
+// every channel the user has chosen for the event. Non-urgent notifications
+// wait for the digest, push and SMS wait for the end of quiet hours.
+func notifyUser(userID, templateKey, eventID string, data interface{}) {
+	user, exists := users[userID]
+	if !exists {
+		return
+	}
+	language := user.Language
+	if _, translated := notificationTemplates[templateKey][language]; !translated {
+		language = defaultLanguage
+	}
+	subject, body, err := renderNotification(templateKey, language, data)
+	if err != nil {
+		log.Printf("rendering notification %s for user %s failed: %v", templateKey, userID, err)
+		return
+	}
+
+	prefs := user.NotificationPreferences
+	created := []*Notification{}
+	for _, channel := range eventChannels(user, templateKey) {
+		for _, recipient := range channelRecipients(user, channel) {
+			created = append(created, &Notification{
+				ID:        "notif-" + generateToken()[:16],
+				UserID:    userID,
+				EventID:   eventID,
+				Template:  templateKey,
+				Language:  language,
+				Channel:   channel,
+				Recipient: recipient,
+				Subject:   subject,
+				Body:      body,
+				Status:    NotificationPending,
+				CreatedAt: time.Now(),
+			})
+		}
+	}
+	for _, notification := range created {
+		if prefs.Digest != "" && prefs.Digest != DigestOff && !urgentTemplates[templateKey] {
+			next := nextDigestAt(prefs, notification.CreatedAt)
+			notification.Status = NotificationQueued
+			notification.Digest = true
+			notification.NextAttemptAt = &next
+		} else {
+			holdForQuietHours(prefs, notification)
+		}
+	}
+
+	storeAndDeliver(userID, created)
+}
+
+// holdForQuietHours queues a push or SMS notification until the quiet hours
+// are over. E-mails do not disturb anyone and are sent right away.
+func holdForQuietHours(prefs NotificationPreferences, notification *Notification) {
+	if notification.Channel != ChannelPush && notification.Channel != ChannelSMS {
+		return
+	}
+	if end, quiet := quietHoursEnd(prefs.QuietHours, notification.CreatedAt); quiet {
+		notification.Status = NotificationQueued
+		notification.NextAttemptAt = &end
+	}
+}
+
+func storeAndDeliver(userID string, created []*Notification) {
+	notificationsMu.Lock()
+	userNotifications[userID] = append(userNotifications[userID], created...)
+	notificationsMu.Unlock()
+
+	for _, notification := range created {
+		if notification.Status == NotificationPending {
+			deliverNotification(notification)
+		}
+	}
+}
+
+func renderNotification(templateKey, language string, data interface{}) (string, string, error) {
+	text := notificationTemplates[templateKey][language]
+	subject, err := renderText(text.Subject, data)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := renderText(text.Body, data)
+	if err != nil {
+		return "", "", err
+	}
+	return subject, body, nil
+}
+
+func renderText(text string, data interface{}) (string, error) {
+	tmpl, err := template.New("notification").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func userChannels(user User) []string {
+	if len(user.NotificationChannels) == 0 {
+		return defaultNotificationChannels
+	}
+	return user.NotificationChannels
+}
+
+// channelRecipients returns the addresses of the user on a channel. Push
+// goes to every registered device.
+func channelRecipients(user User, channel string) []string {
+	switch channel {
+	case ChannelPush:
+		return user.DeviceTokens
+	case ChannelEmail:
+		if user.Email != "" {
+			return []string{user.Email}
+		}
+	case ChannelSMS:
+		if user.Phone != "" {
+			return []string{user.Phone}
+		}
+	}
+	return nil
+}
+
+// deliverNotification sends once and schedules a retry with exponential
+// backoff on failure, until maxNotificationAttempts is reached.
+func deliverNotification(notification *Notification) {
+	channel, exists := notificationChannels[notification.Channel]
+	var err error
+	if exists {
+		err = channel.Send(*notification)
+	}
+
+	notificationsMu.Lock()
+	defer notificationsMu.Unlock()
+
+	notification.Attempts++
+	now := time.Now()
+	switch {
+	case !exists:
+		notification.Status = NotificationFailed
+		notification.LastError = "unknown channel " + notification.Channel
+		notification.NextAttemptAt = nil
+	case err == nil:
+		notification.Status = NotificationSent
+		notification.LastError = ""
+		notification.NextAttemptAt = nil
+		notification.SentAt = &now
+	case notification.Attempts >= maxNotificationAttempts:
+		notification.Status = NotificationFailed
+		notification.LastError = err.Error()
+		notification.NextAttemptAt = nil
+	default:
+		next := now.Add(notificationRetryBackoff << (notification.Attempts - 1))
+		notification.LastError = err.Error()
+		notification.NextAttemptAt = &next
+	}
+}
+
+// retryNotifications periodically resends pending notifications, sends
+// notifications held back by quiet hours and bundles due digests.
+func retryNotifications() {
+	for {
+		time.Sleep(notificationRetryTick)
+
+		now := time.Now()
+		due := []*Notification{}
+		digests := make(map[string]map[string][]*Notification)
+		notificationsMu.Lock()
+		for userID, list := range userNotifications {
+			for _, notification := range list {
+				if notification.NextAttemptAt == nil || now.Before(*notification.NextAttemptAt) {
+					continue
+				}
+				switch {
+				case notification.Status == NotificationQueued && notification.Digest:
+					if digests[userID] == nil {
+						digests[userID] = make(map[string][]*Notification)
+					}
+					key := notification.Channel + "|" + notification.Recipient
+					digests[userID][key] = append(digests[userID][key], notification)
+				case notification.Status == NotificationPending || notification.Status == NotificationQueued:
+					due = append(due, notification)
+				}
+			}
+		}
+		notificationsMu.Unlock()
+
+		for _, notification := range due {
+			deliverNotification(notification)
+		}
+		for userID, groups := range digests {
+			for _, batch := range groups {
+				sendDigest(userID, batch)
+			}
+		}
+	}
+}
+
+// sendDigest bundles the queued notifications of one channel and recipient
+// into a single notification.
+func sendDigest(userID string, batch []*Notification) {
+	storeMu.Lock()
+	user, exists := users[userID]
+	storeMu.Unlock()
+	if !exists {
+		return
+	}
+	language := user.Language
+	if _, translated := notificationTemplates[TemplateDigest][language]; !translated {
+		language = defaultLanguage
+	}
+
+	notificationsMu.Lock()
+	items := make([]Notification, len(batch))
+	for i, notification := range batch {
+		items[i] = *notification
+	}
+	notificationsMu.Unlock()
+	sort.Slice(items, func(i, j int) bool { return items[i].CreatedAt.Before(items[j].CreatedAt) })
+
+	subject, body, err := renderNotification(TemplateDigest, language, items)
+	if err != nil {
+		log.Printf("rendering digest for user %s failed: %v", userID, err)
+		return
+	}
+	digest := &Notification{
+		ID:        "notif-" + generateToken()[:16],
+		UserID:    userID,
+		Template:  TemplateDigest,
+		Language:  language,
+		Channel:   items[0].Channel,
+		Recipient: items[0].Recipient,
+		Subject:   subject,
+		Body:      body,
+		Status:    NotificationPending,
+		CreatedAt: time.Now(),
+	}
+	holdForQuietHours(user.NotificationPreferences, digest)
+
+	notificationsMu.Lock()
+	for _, notification := range batch {
+		notification.Status = NotificationBatched
+		notification.DigestID = digest.ID
+		notification.NextAttemptAt = nil
+	}
+	notificationsMu.Unlock()
+
+	storeAndDeliver(userID, []*Notification{digest})
+}
+
+// userNotificationsHandler lists the notifications of a user with their
+// delivery status, optionally filtered by ?status=.
+func userNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, _ := userPathParts(r.URL.Path)
+	if _, exists := users[userID]; !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	status := strings.ToUpper(r.URL.Query().Get("status"))
+	list := []Notification{}
+	notificationsMu.Lock()
+	for _, notification := range userNotifications[userID] {
+		if status == "" || notification.Status == status {
+			list = append(list, *notification)
+		}
+	}
+	notificationsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"notifications": list,
+		"total":         len(list),
+	})
+}
+
+// userDevicesHandler registers an FCM device token for push notifications.
+func userDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, _ := userPathParts(r.URL.Path)
+	user, exists := users[userID]
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var req DeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Token) == "" {
+		http.Error(w, "Device token is required", http.StatusBadRequest)
+		return
+	}
+	registered := false
+	for _, token := range user.DeviceTokens {
+		registered = registered || token == req.Token
+	}
+	if !registered {
+		user.DeviceTokens = append(user.DeviceTokens, req.Token)
+		user.UpdatedAt = time.Now()
+		users[userID] = user
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !registered {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id": userID,
+		"devices": len(user.DeviceTokens),
+	})
+}
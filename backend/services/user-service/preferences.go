@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	// The runtime image is plain alpine without tzdata, quiet hours need
+	// the zone database for any user timezone
+	_ "time/tzdata"
+)
+
+const (
+	DigestOff    = "OFF"
+	DigestHourly = "HOURLY"
+	DigestDaily  = "DAILY"
+
+	// Daily digests go out at this local hour of the user
+	dailyDigestHour = 8
+)
+
+// urgentTemplates are sent right away even in digest mode, because the user
+// has to act on them.
+var urgentTemplates = map[string]bool{
+	TemplateShipmentAccepted:  true,
+	TemplateShipmentCancelled: true,
+	TemplateChatMessage:       true,
+}
+
+// NotificationPreferences controls which channels a user is notified on per
+// event type, when push and SMS stay silent and whether non-urgent
+// notifications are bundled.
+type NotificationPreferences struct {
+	// Events maps a template key to its channels. Missing event types use
+	// the user's notification_channels, an empty list mutes the event.
+	Events     map[string][]string `json:"events,omitempty"`
+	QuietHours *QuietHours         `json:"quiet_hours,omitempty"`
+	Digest     string              `json:"digest"`
+}
+
+// QuietHours is a daily window in the user's timezone, e.g. 22:00 to 07:00.
+// Push and SMS notifications created inside it are held back until it ends.
+type QuietHours struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone"`
+}
+
+func defaultNotificationPreferences() NotificationPreferences {
+	return NotificationPreferences{Digest: DigestOff}
+}
+
+func validateChannels(channels []string) error {
+	for _, channel := range channels {
+		if _, exists := notificationChannels[channel]; !exists {
+			return fmt.Errorf("unknown notification channel %q", channel)
+		}
+	}
+	return nil
+}
+
+// normalizePreferences accepts the digest in any case, an empty digest
+// means OFF.
+func normalizePreferences(prefs *NotificationPreferences) {
+	prefs.Digest = strings.ToUpper(prefs.Digest)
+	if prefs.Digest == "" {
+		prefs.Digest = DigestOff
+	}
+}
+
+func validatePreferences(prefs NotificationPreferences) error {
+	for templateKey, channels := range prefs.Events {
+		if _, exists := notificationTemplates[templateKey]; !exists {
+			return fmt.Errorf("unknown event type %q", templateKey)
+		}
+		if err := validateChannels(channels); err != nil {
+			return err
+		}
+	}
+	switch prefs.Digest {
+	case DigestOff, DigestHourly, DigestDaily:
+	default:
+		return fmt.Errorf("digest must be %s, %s or %s", DigestOff, DigestHourly, DigestDaily)
+	}
+	if quiet := prefs.QuietHours; quiet != nil {
+		if _, err := time.LoadLocation(quiet.Timezone); err != nil || quiet.Timezone == "" {
+			return fmt.Errorf("unknown timezone %q", quiet.Timezone)
+		}
+		if _, err := time.Parse("15:04", quiet.Start); err != nil {
+			return fmt.Errorf("quiet hours start must be HH:MM")
+		}
+		if _, err := time.Parse("15:04", quiet.End); err != nil {
+			return fmt.Errorf("quiet hours end must be HH:MM")
+		}
+	}
+	return nil
+}
+
+// eventChannels returns the channels a template is sent on for the user.
+func eventChannels(user User, templateKey string) []string {
+	if channels, configured := user.NotificationPreferences.Events[templateKey]; configured {
+		return channels
+	}
+	return userChannels(user)
+}
+
+// quietHoursEnd returns the end of the quiet hours if t falls inside them.
+func quietHoursEnd(quiet *QuietHours, t time.Time) (time.Time, bool) {
+	if quiet == nil {
+		return time.Time{}, false
+	}
+	location, err := time.LoadLocation(quiet.Timezone)
+	if err != nil {
+		return time.Time{}, false
+	}
+	local := t.In(location)
+	start := clockOn(local, quiet.Start)
+	end := clockOn(local, quiet.End)
+	if start.Equal(end) {
+		return time.Time{}, false
+	}
+
+	if start.Before(end) {
+		// Window within one day, e.g. 13:00 to 15:00
+		if !local.Before(start) && local.Before(end) {
+			return end, true
+		}
+		return time.Time{}, false
+	}
+	// Window across midnight, e.g. 22:00 to 07:00
+	if !local.Before(start) {
+		return end.AddDate(0, 0, 1), true
+	}
+	if local.Before(end) {
+		return end, true
+	}
+	return time.Time{}, false
+}
+
+// clockOn returns the HH:MM clock time on the day of t in t's location.
+func clockOn(t time.Time, clock string) time.Time {
+	parsed, _ := time.Parse("15:04", clock)
+	return time.Date(t.Year(), t.Month(), t.Day(), parsed.Hour(), parsed.Minute(), 0, 0, t.Location())
+}
+
+// nextDigestAt returns when the digest that a notification created at t
+// belongs to is sent. Daily digests use the quiet hours timezone, or UTC.
+func nextDigestAt(prefs NotificationPreferences, t time.Time) time.Time {
+	if prefs.Digest == DigestHourly {
+		return t.Truncate(time.Hour).Add(time.Hour)
+	}
+	location := time.UTC
+	if prefs.QuietHours != nil {
+		if loc, err := time.LoadLocation(prefs.QuietHours.Timezone); err == nil {
+			location = loc
+		}
+	}
+	local := t.In(location)
+	next := time.Date(local.Year(), local.Month(), local.Day(), dailyDigestHour, 0, 0, 0, location)
+	if !next.After(local) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// userPreferencesHandler reads and replaces the notification preferences of
+// a user.
+func userPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _ := userPathParts(r.URL.Path)
+	user, exists := users[userID]
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user.NotificationPreferences)
+
+	case "PUT":
+		prefs := defaultNotificationPreferences()
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		normalizePreferences(&prefs)
+		if err := validatePreferences(prefs); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		user.NotificationPreferences = prefs
+		user.UpdatedAt = time.Now()
+		users[userID] = user
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(user.NotificationPreferences)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -116,7 +116,7 @@ build_and_deploy_services() {
     go build -o server .
     
     # Create Docker image
-    docker build -t gcr.io/$GCP_PROJECT_ID/user-service:latest .
+    docker build -t gcr.io/$GCP_PROJECT_ID/user-service:latest -f Dockerfile ../..
     docker push gcr.io/$GCP_PROJECT_ID/user-service:latest
     
     # Deploy to Cloud Run
@@ -138,7 +138,7 @@ build_and_deploy_services() {
     go build -o server .
     
     # Create Docker image
-    docker build -t gcr.io/$GCP_PROJECT_ID/shipment-service:latest .
+    docker build -t gcr.io/$GCP_PROJECT_ID/shipment-service:latest -f Dockerfile ../..
     docker push gcr.io/$GCP_PROJECT_ID/shipment-service:latest
     
     # Deploy to Cloud Run
@@ -88,14 +88,14 @@ echo "🐳 Docker Build und Push..."
 # User Service
 echo "Building user-service..."
 cd backend/services/user-service
-docker build -t europe-west3-docker.pkg.dev/$GCP_PROJECT_ID/bringee-artifacts/user-service:latest .
+docker build -t europe-west3-docker.pkg.dev/$GCP_PROJECT_ID/bringee-artifacts/user-service:latest -f Dockerfile ../..
 docker push europe-west3-docker.pkg.dev/$GCP_PROJECT_ID/bringee-artifacts/user-service:latest
 cd ../../..
 
 # Shipment Service
 echo "Building shipment-service..."
 cd backend/services/shipment-service
-docker build -t europe-west3-docker.pkg.dev/$GCP_PROJECT_ID/bringee-artifacts/shipment-service:latest .
+docker build -t europe-west3-docker.pkg.dev/$GCP_PROJECT_ID/bringee-artifacts/shipment-service:latest -f Dockerfile ../..
 docker push europe-west3-docker.pkg.dev/$GCP_PROJECT_ID/bringee-artifacts/shipment-service:latest
 cd ../../..
 
@@ -211,7 +211,8 @@ build_and_push_images() {
     
     docker build --platform linux/amd64 \
         --tag europe-west3-docker.pkg.dev/$GCP_PROJECT_ID/bringee-artifacts/user-service:latest \
-        .
+        --file Dockerfile \
+        ../..
     
     docker push europe-west3-docker.pkg.dev/$GCP_PROJECT_ID/bringee-artifacts/user-service:latest
     
@@ -223,7 +224,8 @@ build_and_push_images() {
     
     docker build --platform linux/amd64 \
         --tag europe-west3-docker.pkg.dev/$GCP_PROJECT_ID/bringee-artifacts/shipment-service:latest \
-        .
+        --file Dockerfile \
+        ../..
     
     docker push europe-west3-docker.pkg.dev/$GCP_PROJECT_ID/bringee-artifacts/shipment-service:latest
     
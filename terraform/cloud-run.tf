@@ -22,6 +22,14 @@ resource "google_cloud_run_service" "user_service" {
           name  = "PORT"
           value = "8080"
         }
+        env {
+          name  = "PUBSUB_PUSH_TOKEN"
+          value = var.pubsub_push_token
+        }
+        env {
+          name  = "SERVICE_TOKEN"
+          value = var.service_token
+        }
       }
       service_account_name = google_service_account.user_service_sa.email
     }
@@ -60,6 +68,30 @@ resource "google_cloud_run_service" "shipment_service" {
           name  = "PORT"
           value = "8080"
         }
+        env {
+          name  = "EVENT_BROKER"
+          value = "pubsub"
+        }
+        env {
+          name  = "PUBSUB_PROJECT_ID"
+          value = var.gcp_project_id
+        }
+        env {
+          name  = "SHIPMENT_EVENTS_TOPIC"
+          value = google_pubsub_topic.shipment_events.name
+        }
+        env {
+          name  = "GEOCODER_PROVIDER"
+          value = "nominatim"
+        }
+        env {
+          name  = "ADMIN_TOKEN"
+          value = var.admin_token
+        }
+        env {
+          name  = "SERVICE_TOKEN"
+          value = var.service_token
+        }
       }
       service_account_name = google_service_account.shipment_service_sa.email
     }
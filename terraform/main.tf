@@ -37,7 +37,8 @@ resource "google_project_service" "required_services" {
     "run.googleapis.com",
     "iamcredentials.googleapis.com",
     "logging.googleapis.com",
-    "monitoring.googleapis.com"
+    "monitoring.googleapis.com",
+    "pubsub.googleapis.com"
   ])
 
   service                    = each.key
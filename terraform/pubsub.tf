@@ -0,0 +1,33 @@
+# Pub/Sub für ereignisgesteuerte Kommunikation (Spezifikation 4.3)
+
+resource "google_pubsub_topic" "shipment_events" {
+  name = "shipment-events"
+
+  message_retention_duration = "604800s"
+
+  depends_on = [google_project_service.required_services]
+}
+
+# Der Shipment Service veröffentlicht Domain Events über seinen Outbox-Relay
+resource "google_pubsub_topic_iam_member" "shipment_service_publisher" {
+  topic  = google_pubsub_topic.shipment_events.name
+  role   = "roles/pubsub.publisher"
+  member = "serviceAccount:${google_service_account.shipment_service_sa.email}"
+}
+
+# Der User Service aktualisiert die Reputation über eine Push-Subscription
+resource "google_pubsub_subscription" "user_service_shipment_events" {
+  name  = "user-service-shipment-events"
+  topic = google_pubsub_topic.shipment_events.name
+
+  ack_deadline_seconds = 20
+
+  push_config {
+    push_endpoint = "${google_cloud_run_service.user_service.status[0].url}/api/v1/events/shipments?token=${var.pubsub_push_token}"
+  }
+
+  retry_policy {
+    minimum_backoff = "10s"
+    maximum_backoff = "600s"
+  }
+}
@@ -18,4 +18,25 @@ variable "environment" {
   description = "Die Umgebung für das Deployment (dev, staging, prod)."
   type        = string
   default     = "dev"
-}
\ No newline at end of file
+}
+
+variable "pubsub_push_token" {
+  description = "Geheimes Token, mit dem der User Service Pub/Sub-Push-Anfragen prüft (ohne Token werden alle abgelehnt)."
+  type        = string
+  default     = ""
+  sensitive   = true
+}
+
+variable "service_token" {
+  description = "Geheimes Token, mit dem sich die Services untereinander authentifizieren (z.B. beim Erfassen von Vorfällen)."
+  type        = string
+  default     = ""
+  sensitive   = true
+}
+
+variable "admin_token" {
+  description = "Geheimes Token für die Admin-Endpunkte des Shipment Service (ohne Token bleiben sie gesperrt)."
+  type        = string
+  default     = ""
+  sensitive   = true
+}